@@ -11,7 +11,7 @@ fi
 
 set -x
 
-docker compose build --pull
+docker compose build --pull --build-arg VERSION="$RELEASE_VERSION"
 git tag -s -m "Release $RELEASE_VERSION" "v$RELEASE_VERSION"
 docker tag luontola/gcp-dynamic-dns "luontola/gcp-dynamic-dns:$RELEASE_VERSION"
 docker push luontola/gcp-dynamic-dns
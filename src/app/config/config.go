@@ -6,39 +6,545 @@ package config
 
 import (
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// DefaultServiceUrls are the external services which detect the IP, when SERVICE_URLS is not set
+var DefaultServiceUrls = []string{"https://ipv4.icanhazip.com/", "https://checkip.amazonaws.com/", "https://ifconfig.me/ip", "https://ipinfo.io/ip"}
+
+// DefaultStunServers are the STUN servers which detect the IP, when STUN_SERVERS is not set
+var DefaultStunServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+var defaultSourceTimeouts = map[string]time.Duration{
+	"service":   time.Minute,
+	"interface": 10 * time.Second,
+	"upnp":      time.Minute,
+	"stun":      10 * time.Second,
+}
+
+// the external services are polled less often, to not overload them
+var defaultPollIntervals = map[string]time.Duration{
+	"service":   5 * time.Minute,
+	"interface": time.Minute,
+	"upnp":      time.Minute,
+	"stun":      time.Minute,
+}
+
 type Config struct {
+	// Link is the default WAN link, configured with the variables which have no LINK_<NAME>_ prefix
+	Link
+	Links             []*Link
+	SourceCooldown    time.Duration
+	SourceFailures    int
+	DnsNames          []string
+	RecordGroups      []RecordGroup
+	AllowCidrs        []string
+	DenyCidrs         []string
+	GoogleProjects    []string
+	PreHook           []string
+	PreHookTimeout    time.Duration
+	PostHook          []string
+	PostHookTimeout   time.Duration
+	AlertHook         []string
+	AlertHookTimeout  time.Duration
+	StableDetections  int
+	StableDuration    time.Duration
+	MaxChangesPerHour int
+	StateFile         string
+	OwnerID           string
+	HeartbeatInterval time.Duration
+	HeartbeatMaxAge   time.Duration
+	AdminAddress      string
+	ServeAddress      string
+	ServeTLSCert      string
+	ServeTLSKey       string
+	ServeUsers        []Account
+	HubAddress        string
+	HubTLSCert        string
+	HubTLSKey         string
+	HubAgents         []Account
+	HubUrl            string
+	HubToken          string
+	HubCACert         string
+
+	// GoogleCredentialsBase64 and GoogleCredentialsFile are the explicitly configured credentials, if any
+	GoogleCredentialsBase64   string
+	GoogleCredentialsFile     string
+	ImpersonateServiceAccount []string
+
+	DnsApiEndpoint string
+	FakeDnsAddress string
+
+	// ShutdownTimeout is how long an update may still run after SIGTERM or SIGINT before it's cancelled
+	ShutdownTimeout time.Duration
+	// DnsApiTimeout limits each round of reading or changing DNS records
+	DnsApiTimeout time.Duration
+	HubTimeout    time.Duration
+	// HubReportInterval is how often the agent reports its IP even if it hasn't changed,
+	// so that the hub corrects the DNS records if they were changed by someone else
+	HubReportInterval time.Duration
+
+	// PollJitter is the most that an IP source may be polled earlier or later than its interval
+	PollJitter time.Duration
+
+	// HubInsecureHttp lets the hub serve plain HTTP, for running behind a TLS-terminating reverse proxy
+	HubInsecureHttp bool
+	// ServeInsecureHttp lets the dyndns server serve plain HTTP, e.g. for routers which don't support HTTPS
+	ServeInsecureHttp bool
+}
+
+// Link is one internet connection, and the settings for detecting its public IP address.
+type Link struct {
+	Name                string
 	Mode                string
+	Modes               []string
+	SourceTimeouts      map[string]time.Duration
+	PollIntervals       map[string]time.Duration
 	ServiceUrls         []string
 	nextServiceUrlIndex int
 	InterfaceName       string
-	DnsNames            []string
-	GoogleProject       string
+	StunServers         []string
+	BindAddress         string
+	BindInterface       string
+	ProxyUrl            string
+	DnsResolver         string
+}
+
+// RecordGroup is a set of DNS records which are updated together using the same rules.
+type RecordGroup struct {
+	Name       string
+	DnsNames   []string
+	AllowCidrs []string
+	DenyCidrs  []string
+	// MergeValues keeps the values of the records which this instance didn't publish
+	MergeValues bool
+	// HeartbeatName is the TXT record which tells when this group was last updated, or "" to not write it
+	HeartbeatName string
+	// Links are the names of the WAN links whose addresses are published; nil means the default link
+	Links []string
+	// GoogleProject is the only project whose DNS records the group updates, or "" to search all projects
+	GoogleProject string
+	// ZoneVisibility limits the search to "public" or "private" zones, or is "both"
+	ZoneVisibility string
+	// ManagedZones are the only zones whose DNS records the group updates, or nil to search all zones
+	ManagedZones []string
+}
+
+type Account struct {
+	Username string
+	Password string
+	DnsNames []string
 }
 
 func FromEnv() *Config {
 	config := &Config{
-		Mode:                envOrDefault("MODE", "service"),
-		ServiceUrls:         strings.Fields(envOrDefault("SERVICE_URLS", "https://ipv4.icanhazip.com/ https://checkip.amazonaws.com/ https://ifconfig.me/ip https://ipinfo.io/ip")),
-		nextServiceUrlIndex: 0,
-		InterfaceName:       envOrDefault("INTERFACE_NAME", ""),
-		DnsNames:            strings.Fields(envOrFail("DNS_NAMES")),
-		GoogleProject:       envOrFail("GOOGLE_PROJECT"),
+		Link: Link{
+			Name:          DefaultLink,
+			Mode:          envOrDefault("MODE", "service"),
+			ServiceUrls:   strings.Fields(envOrDefault("SERVICE_URLS", strings.Join(DefaultServiceUrls, " "))),
+			InterfaceName: envOrDefault("INTERFACE_NAME", ""),
+			StunServers:   strings.Fields(envOrDefault("STUN_SERVERS", strings.Join(DefaultStunServers, " "))),
+			BindAddress:   envOrDefault("BIND_ADDRESS", ""),
+			BindInterface: envOrDefault("BIND_INTERFACE", ""),
+			ProxyUrl:      envOrDefault("PROXY_URL", ""),
+			DnsResolver:   withDefaultPort(envOrDefault("DNS_RESOLVER", ""), "53"),
+		},
+		SourceCooldown:    envDurationOrDefault("SOURCE_COOLDOWN", 5*time.Minute),
+		SourceFailures:    envIntOrDefault("SOURCE_FAILURES", 3),
+		DnsNames:          strings.Fields(envOrDefault("DNS_NAMES", "")),
+		AllowCidrs:        envFields("ALLOW_CIDRS"),
+		DenyCidrs:         envFields("DENY_CIDRS"),
+		GoogleProjects:    envFields("GOOGLE_PROJECT"),
+		PreHook:           strings.Fields(envOrDefault("PRE_HOOK", "")),
+		PreHookTimeout:    envDurationOrDefault("PRE_HOOK_TIMEOUT", 30*time.Second),
+		PostHook:          strings.Fields(envOrDefault("POST_HOOK", "")),
+		PostHookTimeout:   envDurationOrDefault("POST_HOOK_TIMEOUT", 30*time.Second),
+		AlertHook:         strings.Fields(envOrDefault("ALERT_HOOK", "")),
+		AlertHookTimeout:  envDurationOrDefault("ALERT_HOOK_TIMEOUT", 30*time.Second),
+		StableDetections:  envIntOrDefault("STABLE_DETECTIONS", 1),
+		StableDuration:    envDurationOrDefault("STABLE_DURATION", 0),
+		MaxChangesPerHour: envIntOrDefault("MAX_CHANGES_PER_HOUR", 0),
+		StateFile:         envOrDefault("STATE_FILE", ""),
+		OwnerID:           envOrDefault("OWNER_ID", ""),
+		HeartbeatInterval: envDurationOrDefault("HEARTBEAT_INTERVAL", time.Hour),
+		AdminAddress:      envOrDefault("ADMIN_ADDRESS", ""),
+		ServeAddress:      envOrDefault("SERVE_ADDRESS", ":8080"),
+		ServeTLSCert:      envOrDefault("SERVE_TLS_CERT", ""),
+		ServeTLSKey:       envOrDefault("SERVE_TLS_KEY", ""),
+		ServeUsers:        parseAccounts("SERVE_USERS"),
+		HubAddress:        envOrDefault("HUB_ADDRESS", ":8443"),
+		HubTLSCert:        envOrDefault("HUB_TLS_CERT", ""),
+		HubTLSKey:         envOrDefault("HUB_TLS_KEY", ""),
+		HubAgents:         parseAccounts("HUB_AGENTS"),
+		HubUrl:            envOrDefault("HUB_URL", ""),
+		HubToken:          envOrDefault("HUB_TOKEN", ""),
+		HubCACert:         envOrDefault("HUB_CA_CERT", ""),
+	}
+	config.HeartbeatMaxAge = envDurationOrDefault("HEARTBEAT_MAX_AGE", 3*config.HeartbeatInterval)
+	config.GoogleCredentialsBase64 = envOrDefault("GOOGLE_CREDENTIALS_BASE64", "")
+	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		config.GoogleCredentialsFile = dockerSecret("google-credentials")
 	}
+	config.ImpersonateServiceAccount = envList("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT")
+	config.DnsApiEndpoint = envOrDefault("DNS_API_ENDPOINT", "")
+	config.FakeDnsAddress = envOrDefault("FAKE_DNS_ADDRESS", "localhost:8081")
+	config.ShutdownTimeout = envDurationOrDefault("SHUTDOWN_TIMEOUT", 5*time.Second)
+	config.DnsApiTimeout = envDurationOrDefault("DNS_API_TIMEOUT", time.Minute)
+	config.HubTimeout = envDurationOrDefault("HUB_TIMEOUT", time.Minute)
+	config.HubReportInterval = envDurationOrDefault("HUB_REPORT_INTERVAL", time.Hour)
+	config.Link.parseModes("")
+	config.Links = parseLinks(config)
+	config.RecordGroups = parseRecordGroups(config)
+	config.PollJitter = envDurationOrDefault("POLL_JITTER", config.shortestPollInterval()/10)
+	config.HubInsecureHttp = envBoolOrDefault("HUB_INSECURE_HTTP", false)
+	config.ServeInsecureHttp = envBoolOrDefault("SERVE_INSECURE_HTTP", false)
 	return config
 }
 
-func (config *Config) NextServiceUrl() string {
-	urls := config.ServiceUrls
-	index := config.nextServiceUrlIndex
+const DefaultLink = "default"
+
+// SplitHorizon is the name of the WAN link and the record group which SPLIT_HORIZON_INTERFACE creates.
+const SplitHorizon = "split-horizon"
+
+func (link *Link) parseModes(prefix string) {
+	link.Modes = strings.Fields(link.Mode)
+	link.SourceTimeouts = make(map[string]time.Duration)
+	link.PollIntervals = make(map[string]time.Duration)
+	for _, mode := range link.Modes {
+		key := strings.ToUpper(mode) + "_TIMEOUT"
+		link.SourceTimeouts[mode] = envDurationOrDefault(prefix+key, envDurationOrDefault(key, defaultSourceTimeouts[mode]))
+		key = strings.ToUpper(mode) + "_INTERVAL"
+		defaultInterval := envDurationOrDefault("POLL_INTERVAL", defaultPollIntervals[mode])
+		link.PollIntervals[mode] = envDurationOrDefault(prefix+key, envDurationOrDefault(key, defaultInterval))
+	}
+}
+
+// WithDefaults returns a copy of the link, whose unset settings have the same defaults as when
+// the link is read from the environment variables. Without a MODE, the IP is detected using
+// external services. It's for programs which configure the links themselves.
+func (link *Link) WithDefaults() *Link {
+	result := *link
+	if result.Mode == "" {
+		result.Mode = strings.Join(result.Modes, " ")
+	}
+	if result.Mode == "" {
+		result.Mode = "service"
+	}
+	if len(result.Modes) == 0 {
+		result.Modes = strings.Fields(result.Mode)
+	}
+	if len(result.ServiceUrls) == 0 {
+		result.ServiceUrls = DefaultServiceUrls
+	}
+	if len(result.StunServers) == 0 {
+		result.StunServers = DefaultStunServers
+	}
+	result.SourceTimeouts = make(map[string]time.Duration)
+	result.PollIntervals = make(map[string]time.Duration)
+	for _, mode := range result.Modes {
+		if timeout, ok := link.SourceTimeouts[mode]; ok {
+			result.SourceTimeouts[mode] = timeout
+		} else {
+			result.SourceTimeouts[mode] = defaultSourceTimeouts[mode]
+		}
+		if interval, ok := link.PollIntervals[mode]; ok {
+			result.PollIntervals[mode] = interval
+		} else {
+			result.PollIntervals[mode] = defaultPollIntervals[mode]
+		}
+	}
+	return &result
+}
+
+// shortestPollInterval is the shortest poll interval of the IP sources of the used WAN links.
+func (config *Config) shortestPollInterval() time.Duration {
+	var shortest time.Duration
+	for _, link := range config.UsedLinks() {
+		for _, interval := range link.PollIntervals {
+			if shortest == 0 || interval < shortest {
+				shortest = interval
+			}
+		}
+	}
+	if shortest == 0 {
+		return time.Minute
+	}
+	return shortest
+}
+
+func (link *Link) NextServiceUrl() string {
+	urls := link.ServiceUrls
+	index := link.nextServiceUrlIndex
 	url := urls[index]
-	config.nextServiceUrlIndex = (index + 1) % len(urls)
+	link.nextServiceUrlIndex = (index + 1) % len(urls)
 	return url
 }
 
+// LinkByName returns the WAN link with the name, or nil.
+func (config *Config) LinkByName(name string) *Link {
+	for _, link := range config.Links {
+		if link.Name == name {
+			return link
+		}
+	}
+	return nil
+}
+
+// UsedLinks returns the WAN links whose addresses are published by some record group.
+// Without record groups, only the default link is used.
+func (config *Config) UsedLinks() []*Link {
+	if len(config.RecordGroups) == 0 {
+		return []*Link{&config.Link}
+	}
+	used := make(map[string]bool)
+	for _, group := range config.RecordGroups {
+		for _, name := range group.LinkNames() {
+			used[name] = true
+		}
+	}
+	var links []*Link
+	for _, link := range config.Links {
+		if used[link.Name] {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// LinkNames returns the names of the WAN links whose addresses the group publishes.
+func (group RecordGroup) LinkNames() []string {
+	if group.Links == nil {
+		return []string{DefaultLink}
+	}
+	return group.Links
+}
+
+// RequireCloudDns fails unless the settings needed for updating Cloud DNS are present.
+func (config *Config) RequireCloudDns() {
+	if len(config.RecordGroups) == 0 {
+		envOrFail("DNS_NAMES")
+	}
+	if len(config.Projects()) == 0 {
+		envOrFail("GOOGLE_PROJECT")
+	}
+}
+
+// Projects returns the Google Cloud projects whose DNS records are searched,
+// including those of the record groups.
+func (config *Config) Projects() []string {
+	projects := append([]string{}, config.GoogleProjects...)
+	for _, group := range config.RecordGroups {
+		if group.GoogleProject != "" && !contains(projects, group.GoogleProject) {
+			projects = append(projects, group.GoogleProject)
+		}
+	}
+	return projects
+}
+
+// MergesValues tells whether some record group keeps values which this instance didn't publish.
+func (config *Config) MergesValues() bool {
+	for _, group := range config.RecordGroups {
+		if group.MergeValues {
+			return true
+		}
+	}
+	return false
+}
+
+// HasHeartbeats tells whether some record group writes a heartbeat record.
+func (config *Config) HasHeartbeats() bool {
+	for _, group := range config.RecordGroups {
+		if group.HeartbeatName != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllDnsNames returns the DNS names of all record groups.
+func (config *Config) AllDnsNames() []string {
+	var names []string
+	for _, group := range config.RecordGroups {
+		names = append(names, group.DnsNames...)
+	}
+	return names
+}
+
+// parseRecordGroups returns the default group based on DNS_NAMES, followed by the
+// groups listed in RECORD_GROUPS, whose settings are in GROUP_<NAME>_* variables.
+func parseRecordGroups(config *Config) []RecordGroup {
+	var groups []RecordGroup
+	if len(config.DnsNames) > 0 {
+		groups = append(groups, RecordGroup{
+			Name:           "default",
+			DnsNames:       config.DnsNames,
+			AllowCidrs:     config.AllowCidrs,
+			DenyCidrs:      config.DenyCidrs,
+			MergeValues:    envBoolOrDefault("MERGE_VALUES", false),
+			HeartbeatName:  envOrDefault("HEARTBEAT_NAME", ""),
+			ZoneVisibility: envZoneVisibility("ZONE_VISIBILITY", "both"),
+			ManagedZones:   envFields("MANAGED_ZONES"),
+		})
+	}
+	for _, name := range strings.Fields(envOrDefault("RECORD_GROUPS", "")) {
+		prefix := GroupEnvPrefix(name)
+		groups = append(groups, RecordGroup{
+			Name:           name,
+			DnsNames:       strings.Fields(envOrFail(prefix + "DNS_NAMES")),
+			AllowCidrs:     envFields(prefix + "ALLOW_CIDRS"),
+			DenyCidrs:      envFields(prefix + "DENY_CIDRS"),
+			Links:          envFields(prefix + "LINKS"),
+			MergeValues:    envBoolOrDefault(prefix+"MERGE_VALUES", envBoolOrDefault("MERGE_VALUES", false)),
+			HeartbeatName:  envOrDefault(prefix+"HEARTBEAT_NAME", ""),
+			GoogleProject:  envOrDefault(prefix+"GOOGLE_PROJECT", ""),
+			ZoneVisibility: envZoneVisibility(prefix+"ZONE_VISIBILITY", envZoneVisibility("ZONE_VISIBILITY", "both")),
+			ManagedZones:   envFields(prefix + "MANAGED_ZONES"),
+		})
+	}
+	if envOrDefault("SPLIT_HORIZON_INTERFACE", "") != "" {
+		if len(config.DnsNames) == 0 {
+			log.Fatal("Environment variable SPLIT_HORIZON_INTERFACE requires DNS_NAMES to be set")
+		}
+		// the same names get the internal IP in the private zones and the external IP in the public zones
+		groups[0].ZoneVisibility = "public"
+		groups = append(groups, RecordGroup{
+			Name:           SplitHorizon,
+			DnsNames:       groups[0].DnsNames,
+			AllowCidrs:     []string{"0.0.0.0/0"},
+			DenyCidrs:      groups[0].DenyCidrs,
+			MergeValues:    groups[0].MergeValues,
+			Links:          []string{SplitHorizon},
+			GoogleProject:  groups[0].GoogleProject,
+			ZoneVisibility: "private",
+			ManagedZones:   groups[0].ManagedZones,
+		})
+	}
+	for _, group := range groups {
+		for _, name := range group.LinkNames() {
+			if config.LinkByName(name) == nil {
+				log.Fatal("Record group ", group.Name, " uses an unknown link ", name, "; add it to WAN_LINKS")
+			}
+		}
+	}
+	return groups
+}
+
+// parseLinks returns the default link, followed by the links listed in WAN_LINKS, whose
+// settings are in LINK_<NAME>_* variables. Unset variables default to the default link's settings.
+func parseLinks(config *Config) []*Link {
+	links := []*Link{&config.Link}
+	for _, name := range strings.Fields(envOrDefault("WAN_LINKS", "")) {
+		if name == DefaultLink || name == SplitHorizon {
+			log.Fatal("Environment variable WAN_LINKS must not contain the reserved name ", name)
+		}
+		prefix := LinkEnvPrefix(name)
+		defaults := config.Link
+		link := &Link{
+			Name:          name,
+			Mode:          envOrDefault(prefix+"MODE", defaults.Mode),
+			ServiceUrls:   strings.Fields(envOrDefault(prefix+"SERVICE_URLS", strings.Join(defaults.ServiceUrls, " "))),
+			InterfaceName: envOrDefault(prefix+"INTERFACE_NAME", defaults.InterfaceName),
+			StunServers:   strings.Fields(envOrDefault(prefix+"STUN_SERVERS", strings.Join(defaults.StunServers, " "))),
+			BindAddress:   envOrDefault(prefix+"BIND_ADDRESS", defaults.BindAddress),
+			BindInterface: envOrDefault(prefix+"BIND_INTERFACE", defaults.BindInterface),
+			ProxyUrl:      envOrDefault(prefix+"PROXY_URL", defaults.ProxyUrl),
+			DnsResolver:   withDefaultPort(envOrDefault(prefix+"DNS_RESOLVER", defaults.DnsResolver), "53"),
+		}
+		link.parseModes(prefix)
+		links = append(links, link)
+	}
+	if name := envOrDefault("SPLIT_HORIZON_INTERFACE", ""); name != "" {
+		link := &Link{
+			Name:          SplitHorizon,
+			Mode:          "interface",
+			InterfaceName: name,
+		}
+		link.parseModes("")
+		links = append(links, link)
+	}
+	return links
+}
+
+// LinkEnvPrefix returns the prefix of the WAN link's environment variables, e.g. "LINK_ISP_A_"
+func LinkEnvPrefix(name string) string {
+	return "LINK_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// GroupEnvPrefix returns the prefix of the record group's environment variables, e.g. "GROUP_WAN1_"
+func GroupEnvPrefix(name string) string {
+	return "GROUP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// parseAccounts parses a space separated list of "username:password:name1,name2" entries.
+func parseAccounts(key string) []Account {
+	var users []Account
+	for _, entry := range strings.Fields(envOrDefault(key, "")) {
+		first := strings.Index(entry, ":")
+		last := strings.LastIndex(entry, ":")
+		if first <= 0 || first == last {
+			log.Fatal("Environment variable ", key, " has an invalid entry; expected username:password:dns-names, but was: ", entry)
+		}
+		users = append(users, Account{
+			Username: entry[:first],
+			Password: entry[first+1 : last],
+			DnsNames: strings.Split(entry[last+1:], ","),
+		})
+	}
+	return users
+}
+
+// envFields returns the space separated values, or nil if the variable is not set.
+func envFields(key string) []string {
+	v := strings.Fields(os.Getenv(key))
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// envList returns the comma separated values of the environment variable.
+func envList(key string) []string {
+	var results []string
+	for _, value := range strings.Split(envOrDefault(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			results = append(results, value)
+		}
+	}
+	return results
+}
+
+// dockerSecret returns the path of the Docker secret, or "" if it doesn't exist.
+func dockerSecret(name string) string {
+	path := "/run/secrets/" + name
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// withDefaultPort adds the port to a host name or IP address which doesn't have one.
+func withDefaultPort(address string, port string) string {
+	if address == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+func envZoneVisibility(key string, defaultValue string) string {
+	v := envOrDefault(key, defaultValue)
+	if v != "public" && v != "private" && v != "both" {
+		log.Fatal("Environment variable ", key, " must be public, private or both, but it was ", v)
+	}
+	return v
+}
+
 func envOrDefault(key string, defaultValue string) string {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -54,3 +560,48 @@ func envOrFail(key string) string {
 	}
 	return v
 }
+
+func envBoolOrDefault(key string, defaultValue bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatal("Environment variable ", key, " is not a valid boolean: ", err)
+	}
+	return b
+}
+
+func envIntOrDefault(key string, defaultValue int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatal("Environment variable ", key, " is not a valid integer: ", err)
+	}
+	return i
+}
+
+func envDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatal("Environment variable ", key, " is not a valid duration: ", err)
+	}
+	return d
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
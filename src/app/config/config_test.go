@@ -8,6 +8,7 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -32,6 +33,349 @@ func ConfigSpec() {
 		So(conf.DnsNames, ShouldResemble, []string{"domain1.example.com.", "domain2.example.com.", "domain3.example.com."})
 	})
 
+	Convey("MODE", func() {
+		defer os.Unsetenv("MODE")
+		defer os.Unsetenv("UPNP_TIMEOUT")
+
+		Convey("defaults to service", func() {
+			conf := FromEnv()
+			So(conf.Modes, ShouldResemble, []string{"service"})
+			So(conf.SourceTimeouts, ShouldResemble, map[string]time.Duration{"service": time.Minute})
+		})
+
+		Convey("may list multiple sources, each with its own timeout", func() {
+			os.Setenv("MODE", "upnp stun service")
+			os.Setenv("UPNP_TIMEOUT", "5s")
+			conf := FromEnv()
+			So(conf.Modes, ShouldResemble, []string{"upnp", "stun", "service"})
+			So(conf.SourceTimeouts, ShouldResemble, map[string]time.Duration{
+				"upnp":    5 * time.Second,
+				"stun":    10 * time.Second,
+				"service": time.Minute,
+			})
+		})
+	})
+
+	Convey("poll interval", func() {
+		defer os.Unsetenv("MODE")
+		defer os.Unsetenv("POLL_INTERVAL")
+		defer os.Unsetenv("POLL_JITTER")
+		defer os.Unsetenv("STUN_INTERVAL")
+		defer os.Unsetenv("WAN_LINKS")
+		defer os.Unsetenv("LINK_ISP_A_MODE")
+		defer os.Unsetenv("LINK_ISP_A_UPNP_INTERVAL")
+
+		Convey("external services are polled less often than the local sources", func() {
+			conf := FromEnv()
+			So(conf.PollIntervals, ShouldResemble, map[string]time.Duration{"service": 5 * time.Minute})
+			So(conf.PollJitter, ShouldEqual, 30*time.Second)
+
+			os.Setenv("MODE", "upnp service")
+			conf = FromEnv()
+			So(conf.PollIntervals, ShouldResemble, map[string]time.Duration{
+				"upnp":    time.Minute,
+				"service": 5 * time.Minute,
+			})
+			So(conf.PollJitter, ShouldEqual, 6*time.Second)
+		})
+
+		Convey("each mode's interval can be configured, and POLL_INTERVAL changes the default", func() {
+			os.Setenv("MODE", "stun service")
+			os.Setenv("POLL_INTERVAL", "2m")
+			os.Setenv("STUN_INTERVAL", "30s")
+			os.Setenv("POLL_JITTER", "0s")
+			conf := FromEnv()
+			So(conf.PollIntervals, ShouldResemble, map[string]time.Duration{
+				"stun":    30 * time.Second,
+				"service": 2 * time.Minute,
+			})
+			So(conf.PollJitter, ShouldEqual, time.Duration(0))
+		})
+
+		Convey("each WAN link has its own intervals, and the default jitter is based on the shortest of the used links", func() {
+			os.Setenv("WAN_LINKS", "isp-a")
+			os.Setenv("LINK_ISP_A_MODE", "upnp")
+			os.Setenv("LINK_ISP_A_UPNP_INTERVAL", "20s")
+			conf := FromEnv()
+			So(conf.LinkByName("isp-a").PollIntervals, ShouldResemble, map[string]time.Duration{"upnp": 20 * time.Second})
+			So(conf.PollJitter, ShouldEqual, 30*time.Second)
+
+			os.Setenv("RECORD_GROUPS", "wan1")
+			os.Setenv("GROUP_WAN1_DNS_NAMES", "wan1.example.com.")
+			os.Setenv("GROUP_WAN1_LINKS", "isp-a")
+			defer os.Unsetenv("RECORD_GROUPS")
+			defer os.Unsetenv("GROUP_WAN1_DNS_NAMES")
+			defer os.Unsetenv("GROUP_WAN1_LINKS")
+			conf = FromEnv()
+			So(conf.PollJitter, ShouldEqual, 2*time.Second)
+		})
+	})
+
+	Convey("record groups", func() {
+		defer os.Unsetenv("ALLOW_CIDRS")
+		defer os.Unsetenv("RECORD_GROUPS")
+		defer os.Unsetenv("GROUP_WAN1_DNS_NAMES")
+		defer os.Unsetenv("GROUP_WAN1_DENY_CIDRS")
+		defer os.Unsetenv("GROUP_OFFICE_LAN_DNS_NAMES")
+		os.Setenv(DnsNames, "example.com.")
+		os.Setenv("ALLOW_CIDRS", "10.0.0.0/8")
+
+		Convey("DNS_NAMES makes up the default group", func() {
+			conf := FromEnv()
+			So(conf.RecordGroups, ShouldResemble, []RecordGroup{
+				{Name: "default", DnsNames: []string{"example.com."}, AllowCidrs: []string{"10.0.0.0/8"}, ZoneVisibility: "both"},
+			})
+		})
+
+		Convey("more groups can be listed in RECORD_GROUPS", func() {
+			os.Setenv("RECORD_GROUPS", "wan1 office-lan")
+			os.Setenv("GROUP_WAN1_DNS_NAMES", "wan1.example.com. vpn.example.com.")
+			os.Setenv("GROUP_WAN1_DENY_CIDRS", "100.64.0.0/10")
+			os.Setenv("GROUP_OFFICE_LAN_DNS_NAMES", "office.example.com.")
+			conf := FromEnv()
+			So(conf.RecordGroups, ShouldResemble, []RecordGroup{
+				{Name: "default", DnsNames: []string{"example.com."}, AllowCidrs: []string{"10.0.0.0/8"}, ZoneVisibility: "both"},
+				{Name: "wan1", DnsNames: []string{"wan1.example.com.", "vpn.example.com."}, DenyCidrs: []string{"100.64.0.0/10"}, ZoneVisibility: "both"},
+				{Name: "office-lan", DnsNames: []string{"office.example.com."}, ZoneVisibility: "both"},
+			})
+		})
+
+		Convey("MERGE_VALUES applies to all groups, unless overridden per group", func() {
+			defer os.Unsetenv("MERGE_VALUES")
+			defer os.Unsetenv("GROUP_OFFICE_LAN_MERGE_VALUES")
+			os.Setenv("MERGE_VALUES", "true")
+			os.Setenv("RECORD_GROUPS", "wan1 office-lan")
+			os.Setenv("GROUP_WAN1_DNS_NAMES", "wan1.example.com.")
+			os.Setenv("GROUP_OFFICE_LAN_DNS_NAMES", "office.example.com.")
+			os.Setenv("GROUP_OFFICE_LAN_MERGE_VALUES", "false")
+			conf := FromEnv()
+			So(conf.RecordGroups[0].MergeValues, ShouldBeTrue)
+			So(conf.RecordGroups[1].MergeValues, ShouldBeTrue)
+			So(conf.RecordGroups[2].MergeValues, ShouldBeFalse)
+			So(conf.MergesValues(), ShouldBeTrue)
+		})
+
+		Convey("the default group is omitted if DNS_NAMES is not set", func() {
+			os.Unsetenv(DnsNames)
+			os.Setenv("RECORD_GROUPS", "wan1")
+			os.Setenv("GROUP_WAN1_DNS_NAMES", "wan1.example.com.")
+			conf := FromEnv()
+			So(conf.RecordGroups, ShouldResemble, []RecordGroup{
+				{Name: "wan1", DnsNames: []string{"wan1.example.com."}, ZoneVisibility: "both"},
+			})
+		})
+	})
+
+	Convey("Google projects", func() {
+		defer os.Unsetenv("RECORD_GROUPS")
+		defer os.Unsetenv("GROUP_OTHER_DNS_NAMES")
+		defer os.Unsetenv("GROUP_OTHER_GOOGLE_PROJECT")
+
+		Convey("GOOGLE_PROJECT may list several projects", func() {
+			os.Setenv(GoogleProject, "project1 project2")
+			defer os.Setenv(GoogleProject, "dummy")
+			conf := FromEnv()
+			So(conf.Projects(), ShouldResemble, []string{"project1", "project2"})
+			So(conf.RecordGroups[0].GoogleProject, ShouldEqual, "")
+		})
+
+		Convey("record groups may name their project", func() {
+			os.Setenv("RECORD_GROUPS", "other")
+			os.Setenv("GROUP_OTHER_DNS_NAMES", "other.example.com.")
+			os.Setenv("GROUP_OTHER_GOOGLE_PROJECT", "project3")
+			conf := FromEnv()
+			So(conf.RecordGroups[1].GoogleProject, ShouldEqual, "project3")
+			So(conf.Projects(), ShouldResemble, []string{"dummy", "project3"})
+		})
+	})
+
+	Convey("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT lists the delegation chain, separated by comma", func() {
+		defer os.Unsetenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT")
+		os.Setenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT", "delegate@example.iam.gserviceaccount.com, dns@example.iam.gserviceaccount.com")
+		conf := FromEnv()
+		So(conf.ImpersonateServiceAccount, ShouldResemble, []string{"delegate@example.iam.gserviceaccount.com", "dns@example.iam.gserviceaccount.com"})
+	})
+
+	Convey("managed zones", func() {
+		defer os.Unsetenv("ZONE_VISIBILITY")
+		defer os.Unsetenv("MANAGED_ZONES")
+		defer os.Unsetenv("SPLIT_HORIZON_INTERFACE")
+		defer os.Unsetenv("RECORD_GROUPS")
+		defer os.Unsetenv("GROUP_LAN_DNS_NAMES")
+		defer os.Unsetenv("GROUP_LAN_ZONE_VISIBILITY")
+
+		Convey("are searched regardless of their visibility by default", func() {
+			conf := FromEnv()
+			So(conf.RecordGroups[0].ZoneVisibility, ShouldEqual, "both")
+			So(conf.RecordGroups[0].ManagedZones, ShouldBeNil)
+		})
+
+		Convey("may be limited by visibility and name, per record group", func() {
+			os.Setenv("ZONE_VISIBILITY", "public")
+			os.Setenv("MANAGED_ZONES", "home-public")
+			os.Setenv("RECORD_GROUPS", "lan")
+			os.Setenv("GROUP_LAN_DNS_NAMES", "nas.example.com.")
+			os.Setenv("GROUP_LAN_ZONE_VISIBILITY", "private")
+			conf := FromEnv()
+			So(conf.RecordGroups[0].ZoneVisibility, ShouldEqual, "public")
+			So(conf.RecordGroups[0].ManagedZones, ShouldResemble, []string{"home-public"})
+			So(conf.RecordGroups[1].ZoneVisibility, ShouldEqual, "private")
+			So(conf.RecordGroups[1].ManagedZones, ShouldBeNil)
+		})
+
+		Convey("SPLIT_HORIZON_INTERFACE publishes the interface's IP to the private zones", func() {
+			os.Setenv("SPLIT_HORIZON_INTERFACE", "eth0")
+			conf := FromEnv()
+
+			So(conf.RecordGroups, ShouldHaveLength, 2)
+			So(conf.RecordGroups[0].ZoneVisibility, ShouldEqual, "public")
+			So(conf.RecordGroups[0].LinkNames(), ShouldResemble, []string{DefaultLink})
+			internal := conf.RecordGroups[1]
+			So(internal.Name, ShouldEqual, SplitHorizon)
+			So(internal.DnsNames, ShouldResemble, conf.DnsNames)
+			So(internal.ZoneVisibility, ShouldEqual, "private")
+			So(internal.LinkNames(), ShouldResemble, []string{SplitHorizon})
+
+			link := conf.LinkByName(SplitHorizon)
+			So(link.Modes, ShouldResemble, []string{"interface"})
+			So(link.InterfaceName, ShouldEqual, "eth0")
+			So(conf.UsedLinks(), ShouldResemble, []*Link{&conf.Link, link})
+		})
+	})
+
+	Convey("WAN links", func() {
+		defer os.Unsetenv("MODE")
+		defer os.Unsetenv("WAN_LINKS")
+		defer os.Unsetenv("LINK_ISP_A_BIND_INTERFACE")
+		defer os.Unsetenv("LINK_ISP_B_MODE")
+		defer os.Unsetenv("LINK_ISP_B_STUN_TIMEOUT")
+		defer os.Unsetenv("RECORD_GROUPS")
+		defer os.Unsetenv("GROUP_WAN1_DNS_NAMES")
+		defer os.Unsetenv("GROUP_WAN1_LINKS")
+		defer os.Unsetenv("GROUP_BOTH_DNS_NAMES")
+		defer os.Unsetenv("GROUP_BOTH_LINKS")
+		os.Setenv("MODE", "service")
+
+		Convey("there is only the default link by default", func() {
+			conf := FromEnv()
+			So(len(conf.Links), ShouldEqual, 1)
+			So(conf.Links[0], ShouldEqual, &conf.Link)
+			So(conf.Links[0].Name, ShouldEqual, DefaultLink)
+			So(conf.RecordGroups[0].LinkNames(), ShouldResemble, []string{DefaultLink})
+			So(conf.UsedLinks(), ShouldResemble, []*Link{&conf.Link})
+		})
+
+		Convey("more links can be listed in WAN_LINKS, and they inherit the default link's settings", func() {
+			os.Setenv("WAN_LINKS", "isp-a isp-b")
+			os.Setenv("LINK_ISP_A_BIND_INTERFACE", "eth1")
+			os.Setenv("LINK_ISP_B_MODE", "stun")
+			os.Setenv("LINK_ISP_B_STUN_TIMEOUT", "3s")
+			conf := FromEnv()
+
+			So(len(conf.Links), ShouldEqual, 3)
+			ispA := conf.LinkByName("isp-a")
+			So(ispA.Modes, ShouldResemble, []string{"service"})
+			So(ispA.BindInterface, ShouldEqual, "eth1")
+			So(ispA.ServiceUrls, ShouldResemble, conf.ServiceUrls)
+			ispB := conf.LinkByName("isp-b")
+			So(ispB.Modes, ShouldResemble, []string{"stun"})
+			So(ispB.SourceTimeouts, ShouldResemble, map[string]time.Duration{"stun": 3 * time.Second})
+			So(ispB.BindInterface, ShouldEqual, "")
+			So(conf.LinkByName("isp-c"), ShouldBeNil)
+		})
+
+		Convey("record groups can publish the addresses of several links", func() {
+			os.Setenv("WAN_LINKS", "isp-a isp-b")
+			os.Setenv("RECORD_GROUPS", "wan1 both")
+			os.Setenv("GROUP_WAN1_DNS_NAMES", "wan1.example.com.")
+			os.Setenv("GROUP_WAN1_LINKS", "isp-a")
+			os.Setenv("GROUP_BOTH_DNS_NAMES", "example.com.")
+			os.Setenv("GROUP_BOTH_LINKS", "isp-a isp-b")
+			os.Unsetenv(DnsNames)
+			defer os.Setenv(DnsNames, "dummy")
+			conf := FromEnv()
+
+			So(conf.RecordGroups[0].LinkNames(), ShouldResemble, []string{"isp-a"})
+			So(conf.RecordGroups[1].LinkNames(), ShouldResemble, []string{"isp-a", "isp-b"})
+			So(conf.UsedLinks(), ShouldResemble, []*Link{conf.LinkByName("isp-a"), conf.LinkByName("isp-b")})
+		})
+	})
+
+	Convey("hooks", func() {
+		defer os.Unsetenv("PRE_HOOK")
+		defer os.Unsetenv("POST_HOOK_TIMEOUT")
+
+		Convey("are disabled by default", func() {
+			conf := FromEnv()
+			So(conf.PreHook, ShouldBeEmpty)
+			So(conf.PostHook, ShouldBeEmpty)
+			So(conf.PreHookTimeout, ShouldEqual, 30*time.Second)
+			So(conf.PostHookTimeout, ShouldEqual, 30*time.Second)
+		})
+
+		Convey("command and timeout can be configured", func() {
+			os.Setenv("PRE_HOOK", "/hooks/check.sh --verbose")
+			os.Setenv("POST_HOOK_TIMEOUT", "2m")
+			conf := FromEnv()
+			So(conf.PreHook, ShouldResemble, []string{"/hooks/check.sh", "--verbose"})
+			So(conf.PostHookTimeout, ShouldEqual, 2*time.Minute)
+		})
+	})
+
+	Convey("flap protection", func() {
+		defer os.Unsetenv("STABLE_DETECTIONS")
+		defer os.Unsetenv("STABLE_DURATION")
+		defer os.Unsetenv("MAX_CHANGES_PER_HOUR")
+
+		Convey("is disabled by default", func() {
+			conf := FromEnv()
+			So(conf.StableDetections, ShouldEqual, 1)
+			So(conf.StableDuration, ShouldEqual, 0)
+			So(conf.MaxChangesPerHour, ShouldEqual, 0)
+		})
+
+		Convey("can be configured", func() {
+			os.Setenv("STABLE_DETECTIONS", "3")
+			os.Setenv("STABLE_DURATION", "10m")
+			os.Setenv("MAX_CHANGES_PER_HOUR", "4")
+			conf := FromEnv()
+			So(conf.StableDetections, ShouldEqual, 3)
+			So(conf.StableDuration, ShouldEqual, 10*time.Minute)
+			So(conf.MaxChangesPerHour, ShouldEqual, 4)
+		})
+	})
+
+	Convey("DNS_RESOLVER", func() {
+		defer os.Unsetenv("DNS_RESOLVER")
+
+		Convey("is not set by default", func() {
+			conf := FromEnv()
+			So(conf.DnsResolver, ShouldEqual, "")
+		})
+
+		Convey("defaults to port 53", func() {
+			os.Setenv("DNS_RESOLVER", "192.168.1.1")
+			So(FromEnv().DnsResolver, ShouldEqual, "192.168.1.1:53")
+			os.Setenv("DNS_RESOLVER", "[2001:db8::1]")
+			So(FromEnv().DnsResolver, ShouldEqual, "[2001:db8::1]:53")
+		})
+
+		Convey("may have a custom port", func() {
+			os.Setenv("DNS_RESOLVER", "192.168.1.1:5353")
+			So(FromEnv().DnsResolver, ShouldEqual, "192.168.1.1:5353")
+		})
+	})
+
+	Convey("SERVE_USERS", func() {
+		defer os.Unsetenv("SERVE_USERS")
+		os.Setenv("SERVE_USERS", "alice:secret:home.example.com.,nas.example.com. bob:pass:word:office.example.com.")
+		conf := FromEnv()
+		So(conf.ServeUsers, ShouldResemble, []Account{
+			{Username: "alice", Password: "secret", DnsNames: []string{"home.example.com.", "nas.example.com."}},
+			{Username: "bob", Password: "pass:word", DnsNames: []string{"office.example.com."}},
+		})
+	})
+
 	Convey("NextServiceUrl rotates through all URLs", func() {
 		os.Setenv(ServiceUrls, "http://url1 http://url2")
 		conf := FromEnv()
@@ -39,4 +383,23 @@ func ConfigSpec() {
 		So(conf.NextServiceUrl(), ShouldEqual, "http://url2")
 		So(conf.NextServiceUrl(), ShouldEqual, "http://url1")
 	})
+
+	Convey("links which are not read from the environment variables have the same defaults", func() {
+		Convey("without a MODE, the IP is detected using external services", func() {
+			link := (&Link{Name: "isp-a"}).WithDefaults()
+			So(link.Name, ShouldEqual, "isp-a")
+			So(link.Modes, ShouldResemble, []string{"service"})
+			So(link.ServiceUrls, ShouldResemble, DefaultServiceUrls)
+			So(link.SourceTimeouts, ShouldResemble, map[string]time.Duration{"service": time.Minute})
+			So(link.PollIntervals, ShouldResemble, map[string]time.Duration{"service": 5 * time.Minute})
+		})
+
+		Convey("the settings which are set are kept", func() {
+			link := (&Link{Mode: "upnp stun", StunServers: []string{"stun.example.com:3478"}, SourceTimeouts: map[string]time.Duration{"upnp": 5 * time.Second}}).WithDefaults()
+			So(link.Modes, ShouldResemble, []string{"upnp", "stun"})
+			So(link.StunServers, ShouldResemble, []string{"stun.example.com:3478"})
+			So(link.SourceTimeouts, ShouldResemble, map[string]time.Duration{"upnp": 5 * time.Second, "stun": 10 * time.Second})
+			So(link.PollIntervals, ShouldResemble, map[string]time.Duration{"upnp": time.Minute, "stun": time.Minute})
+		})
+	})
 }
@@ -0,0 +1,109 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package damping protects the DNS records from a flapping IP address.
+package damping
+
+import (
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	"time"
+)
+
+const historySize = 50
+
+type Damper struct {
+	// StableDetections is how many consecutive times a new IP must be detected before it is applied
+	StableDetections int
+	// StableDuration is how long a new IP must be detected consistently before it is applied
+	StableDuration time.Duration
+	// MaxChangesPerHour limits how often the DNS records may be updated; zero means no limit
+	MaxChangesPerHour int
+	state             *state.State
+}
+
+func New(st *state.State) *Damper {
+	return &Damper{state: st}
+}
+
+// Observe records a detected IP and tells whether it has been stable long enough to be applied.
+// If neither StableDetections nor StableDuration is set, every IP is stable immediately.
+func (this *Damper) Observe(now time.Time, ip string) bool {
+	detections := append(this.state.Detections, state.Detection{Time: now, IP: ip})
+	if len(detections) > historySize {
+		detections = detections[len(detections)-historySize:]
+	}
+	this.state.Detections = detections
+	return this.IsStable(now)
+}
+
+// IsStable tells whether the latest detected IP has been stable long enough to be applied.
+func (this *Damper) IsStable(now time.Time) bool {
+	count, since := this.Candidate()
+	if count == 0 {
+		return false
+	}
+	if this.StableDetections <= 1 && this.StableDuration <= 0 {
+		return true
+	}
+	if this.StableDetections > 1 && count >= this.StableDetections {
+		return true
+	}
+	if this.StableDuration > 0 && now.Sub(since) >= this.StableDuration {
+		return true
+	}
+	return false
+}
+
+// Candidate returns how many consecutive times the latest IP has been detected, and since when.
+func (this *Damper) Candidate() (int, time.Time) {
+	detections := this.state.Detections
+	if len(detections) == 0 {
+		return 0, time.Time{}
+	}
+	latest := detections[len(detections)-1]
+	count := 0
+	since := latest.Time
+	for i := len(detections) - 1; i >= 0 && detections[i].IP == latest.IP; i-- {
+		count++
+		since = detections[i].Time
+	}
+	return count, since
+}
+
+// AllowChange tells whether another DNS change fits within MaxChangesPerHour.
+func (this *Damper) AllowChange(now time.Time) bool {
+	this.forgetOldChanges(now)
+	return this.MaxChangesPerHour <= 0 || len(this.state.Changes) < this.MaxChangesPerHour
+}
+
+func (this *Damper) RecordChange(now time.Time) {
+	this.forgetOldChanges(now)
+	this.state.Changes = append(this.state.Changes, now)
+}
+
+// ShouldAlert tells whether to fire an alert about hitting the rate limit.
+// It returns true at most once per hour.
+func (this *Damper) ShouldAlert(now time.Time) bool {
+	if now.Sub(this.state.Alerted) < time.Hour {
+		return false
+	}
+	this.state.Alerted = now
+	return true
+}
+
+// ChangesWithinHour returns how many DNS changes were done during the past hour.
+func (this *Damper) ChangesWithinHour(now time.Time) int {
+	this.forgetOldChanges(now)
+	return len(this.state.Changes)
+}
+
+func (this *Damper) forgetOldChanges(now time.Time) {
+	var recent []time.Time
+	for _, t := range this.state.Changes {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	this.state.Changes = recent
+}
@@ -0,0 +1,109 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package damping
+
+import (
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestDamping(t *testing.T) {
+	Convey("StabilitySpec", t, StabilitySpec)
+	Convey("RateLimitSpec", t, RateLimitSpec)
+}
+
+func StabilitySpec() {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time {
+		return t0.Add(time.Duration(n) * time.Minute)
+	}
+	damper := New(&state.State{})
+
+	Convey("by default every IP is stable immediately", func() {
+		So(damper.Observe(minute(0), "1.1.1.1"), ShouldBeTrue)
+		So(damper.Observe(minute(1), "2.2.2.2"), ShouldBeTrue)
+	})
+
+	Convey("IP must be detected N consecutive times", func() {
+		damper.StableDetections = 3
+
+		So(damper.Observe(minute(0), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(1), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(2), "1.1.1.1"), ShouldBeTrue)
+		So(damper.Observe(minute(3), "2.2.2.2"), ShouldBeFalse)
+		So(damper.Observe(minute(4), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(5), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(6), "1.1.1.1"), ShouldBeTrue)
+	})
+
+	Convey("IP must be detected consistently for T minutes", func() {
+		damper.StableDuration = 10 * time.Minute
+
+		So(damper.Observe(minute(0), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(5), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(10), "1.1.1.1"), ShouldBeTrue)
+		So(damper.Observe(minute(15), "2.2.2.2"), ShouldBeFalse)
+		So(damper.Observe(minute(20), "2.2.2.2"), ShouldBeFalse)
+		So(damper.Observe(minute(25), "2.2.2.2"), ShouldBeTrue)
+	})
+
+	Convey("whichever of N detections or T minutes comes first", func() {
+		damper.StableDetections = 3
+		damper.StableDuration = 10 * time.Minute
+
+		So(damper.Observe(minute(0), "1.1.1.1"), ShouldBeFalse)
+		So(damper.Observe(minute(10), "1.1.1.1"), ShouldBeTrue)
+		So(damper.Observe(minute(11), "2.2.2.2"), ShouldBeFalse)
+		So(damper.Observe(minute(12), "2.2.2.2"), ShouldBeFalse)
+		So(damper.Observe(minute(13), "2.2.2.2"), ShouldBeTrue)
+	})
+
+	Convey("remembers a limited history", func() {
+		for i := 0; i < 100; i++ {
+			damper.Observe(minute(i), "1.1.1.1")
+		}
+
+		So(damper.state.Detections, ShouldHaveLength, historySize)
+		count, since := damper.Candidate()
+		So(count, ShouldEqual, historySize)
+		So(since, ShouldEqual, minute(100-historySize))
+	})
+}
+
+func RateLimitSpec() {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time {
+		return t0.Add(time.Duration(n) * time.Minute)
+	}
+	damper := New(&state.State{})
+
+	Convey("unlimited by default", func() {
+		for i := 0; i < 100; i++ {
+			So(damper.AllowChange(minute(i)), ShouldBeTrue)
+			damper.RecordChange(minute(i))
+		}
+	})
+
+	Convey("maximum number of changes per hour", func() {
+		damper.MaxChangesPerHour = 2
+
+		So(damper.AllowChange(minute(0)), ShouldBeTrue)
+		damper.RecordChange(minute(0))
+		So(damper.AllowChange(minute(10)), ShouldBeTrue)
+		damper.RecordChange(minute(10))
+		So(damper.AllowChange(minute(20)), ShouldBeFalse)
+		So(damper.ChangesWithinHour(minute(20)), ShouldEqual, 2)
+		So(damper.AllowChange(minute(60)), ShouldBeTrue)
+		So(damper.ChangesWithinHour(minute(60)), ShouldEqual, 1)
+	})
+
+	Convey("alerts at most once per hour", func() {
+		So(damper.ShouldAlert(minute(0)), ShouldBeTrue)
+		So(damper.ShouldAlert(minute(30)), ShouldBeFalse)
+		So(damper.ShouldAlert(minute(60)), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,424 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package doctor diagnoses common setup problems step by step,
+// and tells what to do about each of them.
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/huin/goupnp"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"github.com/luontola/gcp-dynamic-dns/src/app/updater"
+	"io"
+	"os"
+	"strings"
+)
+
+type Doctor struct {
+	out      io.Writer
+	failures int
+}
+
+func New(out io.Writer) *Doctor {
+	return &Doctor{out: out}
+}
+
+// Ok tells whether all checks which were run have passed.
+func (this *Doctor) Ok() bool {
+	return this.failures == 0
+}
+
+// Check runs one diagnostic step and prints its result. If the step fails,
+// the hint tells the user what to do about it.
+func (this *Doctor) Check(name string, hint string, step func() (string, error)) bool {
+	return this.check("FAIL", name, hint, step)
+}
+
+// Try is like Check, but a failure is only a warning and does not make the diagnosis fail.
+func (this *Doctor) Try(name string, hint string, step func() (string, error)) bool {
+	return this.check("WARN", name, hint, step)
+}
+
+func (this *Doctor) check(failure string, name string, hint string, step func() (string, error)) bool {
+	detail, err := step()
+	if err != nil {
+		if failure == "FAIL" {
+			this.failures++
+		}
+		fmt.Fprintf(this.out, "[%v] %v: %v\n", failure, name, err)
+		for _, line := range strings.Split(hint, "\n") {
+			fmt.Fprintf(this.out, "       %v\n", line)
+		}
+		return false
+	}
+	if detail != "" {
+		fmt.Fprintf(this.out, "[ OK ] %v: %v\n", name, detail)
+	} else {
+		fmt.Fprintf(this.out, "[ OK ] %v\n", name)
+	}
+	return true
+}
+
+func (this *Doctor) Skip(name string, reason string) {
+	fmt.Fprintf(this.out, "[SKIP] %v: %v\n", name, reason)
+}
+
+// Run checks the whole setup, from the Google Cloud credentials to the IP detection methods.
+func Run(ctx context.Context, conf *config.Config, out io.Writer) bool {
+	d := New(out)
+	client := d.checkGoogleCloud(ctx, conf)
+	d.checkDnsNames(ctx, conf, client)
+	d.checkIPDetection(ctx, conf)
+	return d.Ok()
+}
+
+// Google Cloud
+
+type credentialsFile struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+}
+
+func (this *Doctor) checkGoogleCloud(ctx context.Context, conf *config.Config) *gcloud.Client {
+	auth := updater.GoogleAuth(conf)
+	ok := true
+	if auth.Anonymous() {
+		this.Skip("Google credentials can be read", fmt.Sprintf("DNS_API_ENDPOINT %v is used without credentials", auth.Endpoint))
+	} else {
+		ok = this.checkGoogleCredentials(ctx, auth)
+	}
+
+	var client *gcloud.Client
+	ok = ok && this.Check("GOOGLE_PROJECT is set",
+		"Set GOOGLE_PROJECT to the ID of the project which hosts your Cloud DNS zones.",
+		func() (string, error) {
+			if len(conf.Projects()) == 0 {
+				return "", errors.New("environment variable is not set")
+			}
+			return strings.Join(conf.Projects(), " "), nil
+		})
+	ok = ok && this.Check("Cloud DNS managed zones can be listed",
+		"Check that GOOGLE_PROJECT is the project ID (not its name), that the Cloud DNS API is enabled\n"+
+			"in the project, and that the service account has the DNS Administrator role in it.",
+		func() (string, error) {
+			var err error
+			client, err = gcloud.New(auth, conf.Projects()...)
+			if err != nil {
+				return "", err
+			}
+			ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+			defer cancel()
+			zones, err := client.ManagedZones(ctx)
+			if err != nil {
+				return "", err
+			}
+			for _, project := range conf.Projects() {
+				if len(zonesOfProject(zones, project)) == 0 {
+					return "", fmt.Errorf("the project %v has no managed zones", project)
+				}
+			}
+			var names []string
+			for _, zone := range zones {
+				names = append(names, zone.DnsName)
+			}
+			return strings.Join(names, " "), nil
+		})
+	if !ok {
+		return nil
+	}
+	return client
+}
+
+func (this *Doctor) checkGoogleCredentials(ctx context.Context, auth gcloud.Auth) bool {
+	var data []byte
+	ok := this.Check("Google credentials can be read",
+		"Set GOOGLE_APPLICATION_CREDENTIALS to the path of the service account's JSON key file, or GOOGLE_CREDENTIALS_BASE64\n"+
+			"to its base64 encoded contents. When using Docker, mount the file into the container, and make sure it's\n"+
+			"readable by user 1000. Without them, the credentials of the gcloud CLI or the metadata server are used.",
+		func() (string, error) {
+			var source string
+			var err error
+			data, source, err = auth.CredentialsJson()
+			if err != nil {
+				return "", err
+			}
+			if data == nil {
+				if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+					data, err = os.ReadFile(path)
+					return path, err
+				}
+				return "Application Default Credentials", nil
+			}
+			return source, nil
+		})
+	if ok && data != nil {
+		ok = this.Check("Google credentials can be parsed",
+			"The file should be a JSON key which was created under IAM & admin > Service accounts > Keys,\n"+
+				"or an external account configuration for workload identity federation.",
+			func() (string, error) {
+				var creds credentialsFile
+				if err := json.Unmarshal(data, &creds); err != nil {
+					return "", err
+				}
+				if creds.Type == "" {
+					return "", errors.New("the file has no \"type\" field")
+				}
+				return strings.TrimSpace(creds.Type + " " + creds.ClientEmail), nil
+			})
+	}
+	ok = ok && this.Check("Google access token can be obtained",
+		"The key may have been deleted or disabled. Create a new key for the service account.\n"+
+			"When impersonating a service account, the credentials need the Service Account Token Creator role on it.\n"+
+			"Also check that the system clock is correct.",
+		func() (string, error) {
+			creds, err := auth.Credentials(ctx)
+			if err != nil {
+				return "", err
+			}
+			_, err = creds.TokenSource.Token()
+			if err != nil || len(auth.ImpersonateServiceAccount) == 0 {
+				return "", err
+			}
+			return "impersonating " + auth.ImpersonateServiceAccount[len(auth.ImpersonateServiceAccount)-1], nil
+		})
+	return ok
+}
+
+// DNS names
+
+func (this *Doctor) checkDnsNames(ctx context.Context, conf *config.Config, client *gcloud.Client) {
+	if len(conf.AllDnsNames()) == 0 {
+		this.Check("DNS_NAMES is set",
+			"Set DNS_NAMES (or RECORD_GROUPS) to the DNS records which should be updated, separated by space.",
+			func() (string, error) {
+				return "", errors.New("environment variable is not set")
+			})
+		return
+	}
+	var zones []*gcloud.ManagedZone
+	if client != nil {
+		var err error
+		ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+		defer cancel()
+		zones, err = client.ManagedZones(ctx)
+		if err != nil {
+			client = nil
+		}
+	}
+	for _, group := range conf.RecordGroups {
+		var groupClient *gcloud.Client
+		var groupZones []*gcloud.ManagedZone
+		if client != nil {
+			groupClient = updater.GroupClient(client, group)
+			groupZones = groupClient.FilterZones(zones)
+		}
+		for _, name := range group.DnsNames {
+			label := name
+			if len(conf.RecordGroups) > 1 {
+				label = fmt.Sprintf("%v (group %v)", name, group.Name)
+			}
+			this.checkDnsName(ctx, conf, groupClient, groupZones, name, label)
+		}
+	}
+}
+
+func (this *Doctor) checkDnsName(ctx context.Context, conf *config.Config, client *gcloud.Client, zones []*gcloud.ManagedZone, name string, label string) {
+	baseName, _ := gcloud.SplitRoutingItem(name)
+	ok := this.Check(fmt.Sprintf("DNS name %v ends with a dot", label),
+		fmt.Sprintf("Write the name as a fully qualified domain name: %v.", name),
+		func() (string, error) {
+			return "", CheckFullyQualified(baseName)
+		})
+	ok = ok && this.Check(fmt.Sprintf("DNS name %v is a valid wildcard", label),
+		"A wildcard name must have the * as its whole leftmost label, e.g. *.home.example.com.",
+		func() (string, error) {
+			return "", CheckWildcard(baseName)
+		})
+	if !ok {
+		return
+	}
+	if client == nil {
+		this.Skip(fmt.Sprintf("DNS name %v has an A record", label), "could not access Cloud DNS")
+		return
+	}
+	var zone *gcloud.ManagedZone
+	ok = this.Check(fmt.Sprintf("DNS name %v belongs to a managed zone", label),
+		fmt.Sprintf("Create a Cloud DNS zone for the domain in project %v, or fix the typo in DNS_NAMES.\n"+
+			"If the record group limits its zones with ZONE_VISIBILITY or MANAGED_ZONES, check them too.", strings.Join(conf.Projects(), " or ")),
+		func() (string, error) {
+			zone = gcloud.ZoneForName(zones, baseName)
+			if zone == nil {
+				return "", errors.New("no managed zone contains it")
+			}
+			return zone.Key(), nil
+		})
+	if !ok {
+		return
+	}
+	this.Check(fmt.Sprintf("DNS name %v has an A record", label),
+		fmt.Sprintf("Create an A record for %v in zone %v. Its initial value can be anything.", baseName, zone.Name),
+		func() (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+			defer cancel()
+			records, err := client.DnsRecords(ctx)
+			if err != nil {
+				return "", err
+			}
+			found, err := gcloud.FindDnsRecords(records, []string{name}, "A")
+			if err != nil {
+				return "", err
+			}
+			record := found[0]
+			if record.Name != baseName {
+				return fmt.Sprintf("CNAME to %v, which has %v", record.Name, strings.Join(record.Values(), " ")), nil
+			}
+			return strings.Join(record.Values(), " "), nil
+		})
+}
+
+func CheckFullyQualified(name string) error {
+	if !strings.HasSuffix(name, ".") {
+		return errors.New("the name does not end with a dot")
+	}
+	return nil
+}
+
+// CheckWildcard fails if the name has a "*" anywhere else than as the whole leftmost label.
+func CheckWildcard(name string) error {
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return errors.New("the * may be only the leftmost label")
+	}
+	return nil
+}
+
+func zonesOfProject(zones []*gcloud.ManagedZone, project string) []*gcloud.ManagedZone {
+	var results []*gcloud.ManagedZone
+	for _, zone := range zones {
+		if zone.Project == project {
+			results = append(results, zone)
+		}
+	}
+	return results
+}
+
+// IP detection
+
+func (this *Doctor) checkIPDetection(ctx context.Context, conf *config.Config) {
+	this.Check("MODE is valid",
+		"Set MODE to one or more of: "+strings.Join(ip.Modes(), ", "),
+		func() (string, error) {
+			if len(conf.Modes) == 0 {
+				return "", errors.New("no IP sources listed")
+			}
+			for _, mode := range conf.Modes {
+				if _, err := ip.NewDetector(mode, ip.Settings{}); err != nil {
+					return "", err
+				}
+			}
+			return conf.Mode, nil
+		})
+
+	// only the configured modes must work, but the others are tried to show the alternatives
+	checkFor := func(mode string) func(string, string, func() (string, error)) bool {
+		for _, m := range conf.Modes {
+			if m == mode {
+				return this.Check
+			}
+		}
+		return this.Try
+	}
+
+	network := &ip.Network{
+		LocalAddress: conf.BindAddress,
+		Interface:    conf.BindInterface,
+		Proxy:        conf.ProxyUrl,
+		Resolver:     conf.DnsResolver,
+	}
+	ok := this.Check("Network settings are valid",
+		"Check BIND_ADDRESS, BIND_INTERFACE, PROXY_URL and DNS_RESOLVER.",
+		func() (string, error) {
+			return network.String(), network.Validate()
+		})
+	if !ok {
+		return
+	}
+
+	check := checkFor("stun")
+	for _, server := range conf.StunServers {
+		check(fmt.Sprintf("STUN server %v", server),
+			"Check that the firewall allows outgoing UDP to the server, or remove it from STUN_SERVERS.",
+			func() (string, error) {
+				ctx, cancel := context.WithTimeout(ctx, ip.DefaultStunTimeout)
+				defer cancel()
+				return network.StunIPContext(ctx, server)
+			})
+	}
+
+	check = checkFor("service")
+	for _, url := range conf.ServiceUrls {
+		check(fmt.Sprintf("External service %v", ip.RedactServiceUrl(url)),
+			"Check that the container can reach the internet and resolve DNS names, or remove the URL from SERVICE_URLS.",
+			func() (string, error) {
+				ctx, cancel := context.WithTimeout(ctx, ip.DefaultServiceTimeout)
+				defer cancel()
+				return network.ExternalServiceIPContext(ctx, url)
+			})
+	}
+
+	check = checkFor("interface")
+	if conf.InterfaceName != "" {
+		check(fmt.Sprintf("Network interface %v", conf.InterfaceName),
+			"Check the interface name with `ip addr`. The container must use network_mode: host to see the host's interfaces.",
+			func() (string, error) {
+				return ip.InterfaceIP(conf.InterfaceName)
+			})
+	} else {
+		check("Primary network interface",
+			"The container must use network_mode: host to see the host's interfaces.",
+			ip.OutgoingIP)
+	}
+
+	check = checkFor("upnp")
+	var clients []ip.RouterClient
+	ok = check("UPnP internet gateway discovery",
+		"Enable UPnP on the router, and make sure that the firewall allows SSDP (UDP port 1900).\n"+
+			"The container must use network_mode: host for the multicast discovery to work.\n"+
+			"To debug, check if `upnpc -s` reports the ExternalIPAddress.",
+		func() (string, error) {
+			var err error
+			clients, err = ip.DetectRouterClients(ctx)
+			return fmt.Sprintf("found %d", len(clients)), err
+		})
+	if !ok {
+		return
+	}
+	for _, client := range clients {
+		client := client
+		check(fmt.Sprintf("UPnP %v", describeRouterClient(client)),
+			"The router may have UPnP only partially enabled. Try another router client or MODE.",
+			func() (string, error) {
+				address, err := client.GetExternalIPAddressCtx(ctx)
+				if err == nil && address == "" {
+					err = errors.New("the router returned an empty IP address")
+				}
+				return address, err
+			})
+	}
+}
+
+func describeRouterClient(client ip.RouterClient) string {
+	name := fmt.Sprintf("%T", client)
+	name = name[strings.LastIndex(name, ".")+1:]
+	if sc, ok := client.(interface{ GetServiceClient() *goupnp.ServiceClient }); ok && sc.GetServiceClient().Location != nil {
+		return fmt.Sprintf("%v at %v", name, sc.GetServiceClient().Location)
+	}
+	return name
+}
@@ -0,0 +1,70 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package doctor
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	Convey("CheckSpec", t, CheckSpec)
+	Convey("CheckFullyQualifiedSpec", t, CheckFullyQualifiedSpec)
+	Convey("CheckWildcardSpec", t, CheckWildcardSpec)
+}
+
+func CheckSpec() {
+	var out bytes.Buffer
+	d := New(&out)
+
+	Convey("passing checks are OK", func() {
+		ok := d.Check("the thing", "do something", func() (string, error) {
+			return "details", nil
+		})
+
+		So(ok, ShouldBeTrue)
+		So(d.Ok(), ShouldBeTrue)
+		So(out.String(), ShouldEqual, "[ OK ] the thing: details\n")
+	})
+
+	Convey("failing checks print what to do", func() {
+		ok := d.Check("the thing", "do something\nor something else", func() (string, error) {
+			return "", errors.New("boom")
+		})
+
+		So(ok, ShouldBeFalse)
+		So(d.Ok(), ShouldBeFalse)
+		So(out.String(), ShouldEqual, ""+
+			"[FAIL] the thing: boom\n"+
+			"       do something\n"+
+			"       or something else\n")
+	})
+
+	Convey("failing tries are only warnings", func() {
+		ok := d.Try("the thing", "do something", func() (string, error) {
+			return "", errors.New("boom")
+		})
+
+		So(ok, ShouldBeFalse)
+		So(d.Ok(), ShouldBeTrue)
+		So(out.String(), ShouldEqual, ""+
+			"[WARN] the thing: boom\n"+
+			"       do something\n")
+	})
+}
+
+func CheckFullyQualifiedSpec() {
+	So(CheckFullyQualified("example.com."), ShouldBeNil)
+	So(CheckFullyQualified("example.com"), ShouldBeError, "the name does not end with a dot")
+}
+
+func CheckWildcardSpec() {
+	So(CheckWildcard("home.example.com."), ShouldBeNil)
+	So(CheckWildcard("*.home.example.com."), ShouldBeNil)
+	So(CheckWildcard("foo.*.example.com."), ShouldBeError, "the * may be only the leftmost label")
+	So(CheckWildcard("*foo.example.com."), ShouldBeError, "the * may be only the leftmost label")
+}
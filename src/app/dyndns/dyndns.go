@@ -0,0 +1,218 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package dyndns implements the server side of the dyndns2 update protocol,
+// which is supported by most routers' dynamic DNS clients.
+package dyndns
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	good    = "good"
+	nochg   = "nochg"
+	nohost  = "nohost"
+	notfqdn = "notfqdn"
+	numhost = "numhost"
+	badauth = "badauth"
+	abuse   = "abuse"
+	dnserr  = "dnserr"
+	fatal   = "911"
+)
+
+type DnsUpdater interface {
+	DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error)
+	UpdateDnsRecords(ctx context.Context, records gcloud.DnsRecords, newValues []string) (gcloud.DnsRecords, error)
+}
+
+type User struct {
+	Password string
+	DnsNames []string
+}
+
+type Server struct {
+	updater DnsUpdater
+	users   map[string]User
+	// IPPolicy decides which addresses may be published, unless the DNS name has its own in NamePolicies
+	IPPolicy     *ip.Policy
+	NamePolicies map[string]*ip.Policy
+	// AbuseLimit is the maximum number of update requests per user per AbuseWindow
+	AbuseLimit  int
+	AbuseWindow time.Duration
+	now         func() time.Time
+	mutex       sync.Mutex
+	requests    map[string][]time.Time
+	hostLocks   map[string]*sync.Mutex
+}
+
+func NewServer(updater DnsUpdater, users map[string]User) *Server {
+	return &Server{
+		updater:     updater,
+		users:       users,
+		IPPolicy:    &ip.Policy{},
+		AbuseLimit:  60,
+		AbuseWindow: time.Hour,
+		now:         time.Now,
+		requests:    make(map[string][]time.Time),
+		hostLocks:   make(map[string]*sync.Mutex),
+	}
+}
+
+func (this *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nic/update", this.handleUpdate)
+	mux.HandleFunc("/v3/update", this.handleUpdate)
+	return mux
+}
+
+func (this *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	username, password, ok := r.BasicAuth()
+	user, found := this.users[username]
+	if !ok || !found || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		log.Printf("dyndns: bad authentication for user %q from %v\n", username, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="gcp-dynamic-dns"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, badauth)
+		return
+	}
+
+	// all responses except badauth use status 200, because that's what the clients expect
+	if this.isAbusive(username) {
+		log.Printf("dyndns: user %q exceeded %d requests per %v\n", username, this.AbuseLimit, this.AbuseWindow)
+		fmt.Fprintln(w, abuse)
+		return
+	}
+
+	hostnames := strings.Split(r.URL.Query().Get("hostname"), ",")
+	if len(hostnames) > 20 {
+		fmt.Fprintln(w, numhost)
+		return
+	}
+	myip, err := requestedIP(r)
+	if err != nil {
+		log.Printf("dyndns: user %q sent an invalid request: %v\n", username, err)
+		fmt.Fprintln(w, fatal)
+		return
+	}
+	for _, hostname := range hostnames {
+		fmt.Fprintln(w, this.updateHostname(r.Context(), username, user, hostname, myip))
+	}
+}
+
+func (this *Server) isAbusive(username string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	now := this.now()
+	var recent []time.Time
+	for _, t := range this.requests[username] {
+		if now.Sub(t) < this.AbuseWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	this.requests[username] = recent
+	return len(recent) > this.AbuseLimit
+}
+
+func requestedIP(r *http.Request) (string, error) {
+	myip := strings.TrimSpace(r.URL.Query().Get("myip"))
+	if myip == "" {
+		// fall back to the address which the request came from
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return "", err
+		}
+		myip = host
+	}
+	address := net.ParseIP(myip).To4()
+	if address == nil {
+		return "", fmt.Errorf("not an IPv4 address: %q", myip)
+	}
+	return address.String(), nil
+}
+
+func (this *Server) updateHostname(ctx context.Context, username string, user User, hostname string, myip string) string {
+	hostname = strings.TrimSpace(hostname)
+	if hostname == "" || !strings.Contains(hostname, ".") {
+		return notfqdn
+	}
+	if !strings.HasSuffix(hostname, ".") {
+		hostname += "."
+	}
+	if !contains(user.DnsNames, hostname) {
+		log.Printf("dyndns: user %q is not allowed to update %v\n", username, hostname)
+		return nohost
+	}
+	if err := this.policyOf(hostname).Check(myip); err != nil {
+		log.Printf("dyndns: user %q may not publish the IP to %v: %v\n", username, hostname, err)
+		return fatal
+	}
+	defer this.lockHostname(hostname)()
+
+	newValues := []string{myip}
+	records, err := this.updater.DnsRecordsByNameAndType(ctx, []string{hostname}, "A")
+	if err != nil {
+		log.Printf("dyndns: failed to read DNS record %v: %v\n", hostname, err)
+		return dnserr
+	}
+	if len(records) == 0 {
+		log.Printf("dyndns: DNS record %v was not found\n", hostname)
+		return dnserr
+	}
+	outdated := records.Outdated(newValues)
+	if len(outdated) == 0 {
+		return nochg + " " + myip
+	}
+	updated, err := this.updater.UpdateDnsRecords(ctx, outdated, newValues)
+	if err != nil {
+		log.Printf("dyndns: failed to update DNS record %v: %v\n", hostname, err)
+		return dnserr
+	}
+	for _, record := range updated {
+		log.Printf("dyndns: user %q updated %v  %v -> %v\n", username, record.Name, record.OldRrdatas, record.Rrdatas)
+	}
+	return good + " " + myip
+}
+
+func (this *Server) policyOf(hostname string) *ip.Policy {
+	if policy, found := this.NamePolicies[hostname]; found {
+		return policy
+	}
+	return this.IPPolicy
+}
+
+// lockHostname serializes the updates of a hostname, so that concurrent requests don't
+// overwrite each other's changes, yet a slow update doesn't hold up the other hostnames.
+func (this *Server) lockHostname(hostname string) (unlock func()) {
+	this.mutex.Lock()
+	lock, found := this.hostLocks[hostname]
+	if !found {
+		lock = &sync.Mutex{}
+		this.hostLocks[hostname] = lock
+	}
+	this.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
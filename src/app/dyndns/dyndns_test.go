@@ -0,0 +1,254 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package dyndns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDynDns(t *testing.T) {
+	Convey("UpdateSpec", t, UpdateSpec)
+}
+
+type fakeUpdater struct {
+	records map[string][]string
+	// extra are more records with the same names, e.g. in other zones
+	extra   gcloud.DnsRecords
+	updated gcloud.DnsRecords
+	// blocked makes reading the records wait until it's closed, after signaling reading
+	blocked chan struct{}
+	reading chan struct{}
+}
+
+func (this *fakeUpdater) DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error) {
+	if this.blocked != nil && names[0] == "office.example.com." {
+		this.reading <- struct{}{}
+		<-this.blocked
+	}
+	var results gcloud.DnsRecords
+	for _, name := range names {
+		values, found := this.records[name]
+		if !found {
+			return nil, fmt.Errorf("no such record: %v", name)
+		}
+		results = append(results, &gcloud.DnsRecord{
+			ManagedZone:       "zone1",
+			ResourceRecordSet: &dns.ResourceRecordSet{Name: name, Type: recordType, Rrdatas: values}})
+		for _, record := range this.extra {
+			if record.Name == name {
+				results = append(results, record)
+			}
+		}
+	}
+	return results, nil
+}
+
+func (this *fakeUpdater) UpdateDnsRecords(ctx context.Context, records gcloud.DnsRecords, newValues []string) (gcloud.DnsRecords, error) {
+	var updated gcloud.DnsRecords
+	for _, record := range records {
+		if record.Name == "broken.example.com." {
+			return nil, errors.New("boom")
+		}
+		updated = append(updated, &gcloud.DnsRecord{
+			ManagedZone:       record.ManagedZone,
+			OldRrdatas:        this.records[record.Name],
+			ResourceRecordSet: &dns.ResourceRecordSet{Name: record.Name, Type: record.Type, Rrdatas: newValues}})
+		this.records[record.Name] = newValues
+	}
+	this.updated = updated
+	return updated, nil
+}
+
+func UpdateSpec() {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	updater := &fakeUpdater{records: map[string][]string{
+		"home.example.com.":   {"1.1.1.1"},
+		"nas.example.com.":    {"1.1.1.1"},
+		"office.example.com.": {"3.3.3.3"},
+		"broken.example.com.": {"1.1.1.1"},
+	}}
+	server := NewServer(updater, map[string]User{
+		"alice": {Password: "secret", DnsNames: []string{"home.example.com.", "nas.example.com.", "broken.example.com.", "missing.example.com."}},
+		"bob":   {Password: "hunter2", DnsNames: []string{"office.example.com."}},
+	})
+	handler := server.Handler()
+
+	request := func(username, password, query string) (int, string) {
+		req := httptest.NewRequest("GET", "/nic/update?"+query, nil)
+		req.RemoteAddr = "5.5.5.5:12345"
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	Convey("good: updates the record", func() {
+		status, body := request("alice", "secret", "hostname=home.example.com&myip=2.2.2.2")
+
+		So(status, ShouldEqual, http.StatusOK)
+		So(body, ShouldEqual, "good 2.2.2.2\n")
+		So(updater.records["home.example.com."], ShouldResemble, []string{"2.2.2.2"})
+	})
+
+	Convey("good: hostname may be fully qualified with a trailing dot", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com.&myip=2.2.2.2")
+
+		So(body, ShouldEqual, "good 2.2.2.2\n")
+	})
+
+	Convey("good: multiple hostnames get one reply line each", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com,nas.example.com&myip=2.2.2.2")
+
+		So(body, ShouldEqual, "good 2.2.2.2\ngood 2.2.2.2\n")
+		So(updater.records["nas.example.com."], ShouldResemble, []string{"2.2.2.2"})
+	})
+
+	Convey("good: uses the client's address if myip is not given", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com")
+
+		So(body, ShouldEqual, "good 5.5.5.5\n")
+	})
+
+	Convey("good: updates the records of the hostname which are not up to date", func() {
+		updater.extra = gcloud.DnsRecords{{ManagedZone: "zone2",
+			ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A", Rrdatas: []string{"9.9.9.9"}}}}
+
+		_, body := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+
+		So(body, ShouldEqual, "good 1.1.1.1\n")
+		So(updater.updated, ShouldHaveLength, 1)
+		So(updater.updated[0].ManagedZone, ShouldEqual, "zone2")
+	})
+
+	Convey("nochg: the record is already up to date", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+
+		So(body, ShouldEqual, "nochg 1.1.1.1\n")
+	})
+
+	Convey("nohost: the user is not allowed to update the hostname", func() {
+		_, body := request("bob", "hunter2", "hostname=home.example.com&myip=2.2.2.2")
+
+		So(body, ShouldEqual, "nohost\n")
+		So(updater.records["home.example.com."], ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("notfqdn: the hostname is not a domain name", func() {
+		_, body := request("alice", "secret", "myip=2.2.2.2")
+
+		So(body, ShouldEqual, "notfqdn\n")
+	})
+
+	Convey("dnserr: the record does not exist in Cloud DNS", func() {
+		_, body := request("alice", "secret", "hostname=missing.example.com&myip=2.2.2.2")
+
+		So(body, ShouldEqual, "dnserr\n")
+	})
+
+	Convey("dnserr: updating the record failed", func() {
+		_, body := request("alice", "secret", "hostname=broken.example.com&myip=2.2.2.2")
+
+		So(body, ShouldEqual, "dnserr\n")
+	})
+
+	Convey("911: myip is not an IPv4 address", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com&myip=999.1.1.1")
+
+		So(body, ShouldEqual, "911\n")
+	})
+
+	Convey("911: myip is not a public address", func() {
+		_, body := request("alice", "secret", "hostname=home.example.com&myip=192.168.1.1")
+
+		So(body, ShouldEqual, "911\n")
+		So(updater.records["home.example.com."], ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("the DNS name's own policy decides which addresses may be published to it", func() {
+		lan, err := ip.NewPolicy([]string{"192.168.0.0/16"}, nil)
+		So(err, ShouldBeNil)
+		server.NamePolicies = map[string]*ip.Policy{"nas.example.com.": lan}
+
+		_, body := request("alice", "secret", "hostname=nas.example.com,home.example.com&myip=192.168.1.1")
+
+		So(body, ShouldEqual, "good 192.168.1.1\n911\n")
+		So(updater.records["home.example.com."], ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("badauth: wrong password", func() {
+		status, body := request("alice", "wrong", "hostname=home.example.com&myip=2.2.2.2")
+
+		So(status, ShouldEqual, http.StatusUnauthorized)
+		So(body, ShouldEqual, "badauth\n")
+		So(updater.records["home.example.com."], ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("badauth: unknown user", func() {
+		status, body := request("mallory", "secret", "hostname=home.example.com&myip=2.2.2.2")
+
+		So(status, ShouldEqual, http.StatusUnauthorized)
+		So(body, ShouldEqual, "badauth\n")
+	})
+
+	Convey("badauth: no credentials", func() {
+		status, body := request("", "", "hostname=home.example.com&myip=2.2.2.2")
+
+		So(status, ShouldEqual, http.StatusUnauthorized)
+		So(body, ShouldEqual, "badauth\n")
+	})
+
+	Convey("a slow update doesn't hold up the other users", func() {
+		updater.blocked = make(chan struct{})
+		updater.reading = make(chan struct{})
+		done := make(chan string)
+		go func() {
+			_, body := request("bob", "hunter2", "hostname=office.example.com&myip=4.4.4.4")
+			done <- body
+		}()
+		<-updater.reading
+
+		_, body := request("alice", "secret", "hostname=home.example.com&myip=2.2.2.2")
+		close(updater.blocked)
+
+		So(body, ShouldEqual, "good 2.2.2.2\n")
+		So(<-done, ShouldEqual, "good 4.4.4.4\n")
+	})
+
+	Convey("abuse: too many requests", func() {
+		now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+		server.now = func() time.Time { return now }
+		server.AbuseLimit = 2
+
+		_, body1 := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+		_, body2 := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+		_, body3 := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+		_, other := request("bob", "hunter2", "hostname=office.example.com&myip=3.3.3.3")
+		now = now.Add(server.AbuseWindow)
+		_, later := request("alice", "secret", "hostname=home.example.com&myip=1.1.1.1")
+
+		So(body1, ShouldEqual, "nochg 1.1.1.1\n")
+		So(body2, ShouldEqual, "nochg 1.1.1.1\n")
+		So(body3, ShouldEqual, "abuse\n")
+		So(other, ShouldEqual, "nochg 3.3.3.3\n")
+		So(later, ShouldEqual, "nochg 1.1.1.1\n")
+	})
+}
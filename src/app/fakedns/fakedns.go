@@ -0,0 +1,277 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package fakedns is an in-memory fake of the Cloud DNS API, for testing
+// the whole application and for running local demos without a GCP account.
+// It supports listing managed zones and record sets, with paging, and
+// creating changes, with the same preconditions as the real API.
+package fakedns
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/dns/v1"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BasePath is where the API is served. The client library adds it to the API endpoint,
+// so the endpoint is only the server's URL, e.g. "http://localhost:8081/".
+const BasePath = "/dns/v1/"
+
+// Failure is an error response which is returned instead of handling a request.
+type Failure struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+type Server struct {
+	// PageSize is the maximum number of results per page, or 0 for no limit
+	PageSize int
+	mu       sync.Mutex
+	zones    map[string][]*zone
+	failures []Failure
+	changes  int
+}
+
+type zone struct {
+	*dns.ManagedZone
+	rrsets []*dns.ResourceRecordSet
+}
+
+func New() *Server {
+	return &Server{zones: make(map[string][]*zone)}
+}
+
+// AddZone creates a managed zone in the project.
+func (this *Server) AddZone(project string, managedZone *dns.ManagedZone) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if managedZone.Visibility == "" {
+		managedZone.Visibility = "public"
+	}
+	if managedZone.NameServers == nil && managedZone.Visibility == "public" {
+		managedZone.NameServers = []string{"ns-cloud-a1.googledomains.com.", "ns-cloud-a2.googledomains.com."}
+	}
+	this.zones[project] = append(this.zones[project], &zone{ManagedZone: managedZone})
+}
+
+// AddRecordSets creates record sets in the managed zone.
+func (this *Server) AddRecordSets(project string, managedZone string, rrsets ...*dns.ResourceRecordSet) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	z := this.zone(project, managedZone)
+	if z == nil {
+		panic(fmt.Sprintf("no such zone: %v/%v", project, managedZone))
+	}
+	z.rrsets = append(z.rrsets, rrsets...)
+}
+
+// RecordSets returns the current record sets of the managed zone.
+func (this *Server) RecordSets(project string, managedZone string) []*dns.ResourceRecordSet {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	z := this.zone(project, managedZone)
+	if z == nil {
+		return nil
+	}
+	return append([]*dns.ResourceRecordSet{}, z.rrsets...)
+}
+
+// Changes returns how many changes have been made.
+func (this *Server) Changes() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.changes
+}
+
+// FailNext makes the next requests fail, one failure per request.
+func (this *Server) FailNext(failures ...Failure) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.failures = append(this.failures, failures...)
+}
+
+// Seed creates an A record for each of the names, and a managed zone for the
+// domain which contains it, for trying out the application. Routing policy items are not supported.
+func (this *Server) Seed(project string, names []string) {
+	for _, name := range names {
+		name, _, _ = strings.Cut(name, "@")
+		if this.hasRecordSet(project, name) {
+			continue
+		}
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		if len(labels) < 2 {
+			continue
+		}
+		domain := strings.Join(labels[len(labels)-2:], ".") + "."
+		zoneName := strings.ReplaceAll(strings.TrimSuffix(domain, "."), ".", "-")
+		if this.RecordSets(project, zoneName) == nil {
+			this.AddZone(project, &dns.ManagedZone{Name: zoneName, DnsName: domain})
+		}
+		this.AddRecordSets(project, zoneName, &dns.ResourceRecordSet{
+			Name: name, Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"},
+		})
+	}
+}
+
+func (this *Server) hasRecordSet(project string, name string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, z := range this.zones[project] {
+		if indexOf(z.rrsets, name, "A") >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Server) zone(project string, managedZone string) *zone {
+	for _, z := range this.zones[project] {
+		if z.Name == managedZone {
+			return z
+		}
+	}
+	return nil
+}
+
+func (this *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.failures) > 0 {
+		failure := this.failures[0]
+		this.failures = this.failures[1:]
+		writeError(w, failure.Code, failure.Reason, failure.Message)
+		return
+	}
+
+	// projects/{project}/managedZones[/{managedZone}/rrsets|changes]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, BasePath), "/"), "/")
+	if len(parts) < 3 || parts[0] != "projects" || parts[2] != "managedZones" {
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	project := parts[1]
+	if len(parts) == 3 && r.Method == http.MethodGet {
+		this.listZones(w, r, project)
+		return
+	}
+	if len(parts) != 5 {
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	z := this.zone(project, parts[3])
+	if z == nil {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("The 'parameters.managedZone' resource named '%v' does not exist.", parts[3]))
+		return
+	}
+	switch {
+	case parts[4] == "rrsets" && r.Method == http.MethodGet:
+		this.listRecordSets(w, r, z)
+	case parts[4] == "changes" && r.Method == http.MethodPost:
+		this.createChange(w, r, z)
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+func (this *Server) listZones(w http.ResponseWriter, r *http.Request, project string) {
+	var zones []*dns.ManagedZone
+	for _, z := range this.zones[project] {
+		zones = append(zones, z.ManagedZone)
+	}
+	start, end, next := this.page(r, len(zones))
+	writeJson(w, http.StatusOK, &dns.ManagedZonesListResponse{ManagedZones: zones[start:end], NextPageToken: next})
+}
+
+func (this *Server) listRecordSets(w http.ResponseWriter, r *http.Request, z *zone) {
+	start, end, next := this.page(r, len(z.rrsets))
+	writeJson(w, http.StatusOK, &dns.ResourceRecordSetsListResponse{Rrsets: z.rrsets[start:end], NextPageToken: next})
+}
+
+// page returns the range of results to return, and the token of the next page or "" if this is the last page.
+func (this *Server) page(r *http.Request, total int) (int, int, string) {
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	size := this.PageSize
+	if maxResults, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil && (size == 0 || maxResults < size) {
+		size = maxResults
+	}
+	if start < 0 || start > total {
+		start = total
+	}
+	if size <= 0 || start+size >= total {
+		return start, total, ""
+	}
+	return start, start + size, strconv.Itoa(start + size)
+}
+
+// createChange applies the change atomically. Like the real API, a deletion must match
+// the current record set exactly, and an addition must not replace an existing record set.
+func (this *Server) createChange(w http.ResponseWriter, r *http.Request, z *zone) {
+	var change dns.Change
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	rrsets := append([]*dns.ResourceRecordSet{}, z.rrsets...)
+	for i, deletion := range change.Deletions {
+		j := indexOf(rrsets, deletion.Name, deletion.Type)
+		if j < 0 || !sameJson(rrsets[j], deletion) {
+			writeError(w, http.StatusPreconditionFailed, "conditionNotMet",
+				fmt.Sprintf("Precondition not met for 'entity.change.deletions[%d]'", i))
+			return
+		}
+		rrsets = append(rrsets[:j:j], rrsets[j+1:]...)
+	}
+	for i, addition := range change.Additions {
+		if indexOf(rrsets, addition.Name, addition.Type) >= 0 {
+			writeError(w, http.StatusConflict, "alreadyExists",
+				fmt.Sprintf("The resource 'entity.change.additions[%d]' named '%v (%v)' already exists", i, addition.Name, addition.Type))
+			return
+		}
+		rrsets = append(rrsets, addition)
+	}
+	z.rrsets = rrsets
+	this.changes++
+	change.Id = strconv.Itoa(this.changes)
+	change.Status = "done"
+	change.StartTime = time.Now().UTC().Format(time.RFC3339)
+	writeJson(w, http.StatusOK, &change)
+}
+
+func indexOf(rrsets []*dns.ResourceRecordSet, name string, recordType string) int {
+	for i, rrset := range rrsets {
+		if rrset.Name == name && rrset.Type == recordType {
+			return i
+		}
+	}
+	return -1
+}
+
+func sameJson(a any, b any) bool {
+	aJson, _ := json.Marshal(a)
+	bJson, _ := json.Marshal(b)
+	return string(aJson) == string(bJson)
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds in the format which the Google API client library understands.
+func writeError(w http.ResponseWriter, code int, reason string, message string) {
+	writeJson(w, code, map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]any{{"reason": reason, "message": message}},
+		},
+	})
+}
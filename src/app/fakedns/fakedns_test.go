@@ -0,0 +1,121 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package fakedns
+
+import (
+	"context"
+	"errors"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFakeDns(t *testing.T) {
+	Convey("FakeDnsSpec", t, FakeDnsSpec)
+}
+
+func FakeDnsSpec() {
+	ctx := context.Background()
+	server := New()
+	server.AddZone("project1", &dns.ManagedZone{Name: "example", DnsName: "example.com."})
+	server.AddZone("project1", &dns.ManagedZone{Name: "internal", DnsName: "example.com.", Visibility: "private"})
+	server.AddRecordSets("project1", "example",
+		&dns.ResourceRecordSet{Name: "foo.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+		&dns.ResourceRecordSet{Name: "bar.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}},
+		&dns.ResourceRecordSet{Name: "gazonk.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.1"}})
+	httpServer := httptest.NewServer(server)
+	Reset(httpServer.Close)
+	client, err := gcloud.New(gcloud.Auth{Endpoint: httpServer.URL + "/"}, "project1")
+	So(err, ShouldBeNil)
+
+	Convey("lists managed zones", func() {
+		zones, err := client.ManagedZones(ctx)
+		So(err, ShouldBeNil)
+		So(zones, ShouldHaveLength, 2)
+		So(zones[0].Key(), ShouldEqual, "project1/example")
+		So(zones[0].Visibility, ShouldEqual, "public")
+		So(zones[1].Visibility, ShouldEqual, "private")
+	})
+
+	Convey("lists record sets over many pages", func() {
+		server.PageSize = 2
+		records, err := client.DnsRecords(ctx)
+		So(err, ShouldBeNil)
+		So(records.Names(), ShouldResemble, []string{"foo.example.com.", "bar.example.com.", "gazonk.example.com."})
+	})
+
+	Convey("updates records", func() {
+		records, err := client.DnsRecordsByNameAndType(ctx, []string{"foo.example.com."}, "A")
+		So(err, ShouldBeNil)
+
+		updated, err := client.UpdateDnsRecords(ctx, records, []string{"192.0.2.2"})
+
+		So(err, ShouldBeNil)
+		So(updated, ShouldHaveLength, 1)
+		So(updated[0].Project, ShouldEqual, "project1")
+		So(updated[0].Rrdatas, ShouldResemble, []string{"192.0.2.2"})
+		So(server.RecordSets("project1", "example")[2].Rrdatas, ShouldResemble, []string{"192.0.2.2"})
+		So(server.Changes(), ShouldEqual, 1)
+	})
+
+	Convey("a deletion which doesn't match the current record fails the whole change", func() {
+		records, err := client.DnsRecordsByNameAndType(ctx, []string{"foo.example.com.", "bar.example.com."}, "A")
+		So(err, ShouldBeNil)
+		_, err = client.UpdateDnsRecords(ctx, records[1:], []string{"192.0.2.3"})
+		So(err, ShouldBeNil)
+
+		_, err = client.UpdateDnsRecords(ctx, records, []string{"192.0.2.2"})
+
+		So(errorCode(err), ShouldEqual, http.StatusPreconditionFailed)
+		So(server.Changes(), ShouldEqual, 1)
+		So(server.RecordSets("project1", "example")[0].Rrdatas, ShouldResemble, []string{"192.0.2.1"})
+	})
+
+	Convey("an addition of an existing record fails", func() {
+		change := &dns.Change{Additions: []*dns.ResourceRecordSet{
+			{Name: "foo.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"192.0.2.2"}},
+		}}
+
+		_, err := client.ApplyChange(ctx, "project1/example", change)
+
+		So(errorCode(err), ShouldEqual, http.StatusConflict)
+	})
+
+	Convey("unknown zones are not found", func() {
+		_, err := client.ApplyChange(ctx, "project1/nonexistent", &dns.Change{})
+
+		So(errorCode(err), ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("injected failures are returned one request at a time", func() {
+		server.FailNext(Failure{Code: http.StatusForbidden, Reason: "forbidden", Message: "Forbidden"})
+
+		_, err := client.ManagedZones(ctx)
+		So(errorCode(err), ShouldEqual, http.StatusForbidden)
+		So(err.Error(), ShouldContainSubstring, "Forbidden")
+
+		_, err = client.ManagedZones(ctx)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("seeds a zone for each domain", func() {
+		server.Seed("demo", []string{"www.example.org.", "example.org.", "www.example.net."})
+
+		So(server.RecordSets("demo", "example-org"), ShouldHaveLength, 2)
+		So(server.RecordSets("demo", "example-net"), ShouldHaveLength, 1)
+	})
+}
+
+func errorCode(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
@@ -0,0 +1,245 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package fakeupnp is a fake UPnP Internet Gateway Device, for testing the UPnP
+// IP detection without a real router. It answers SSDP M-SEARCH requests and serves
+// the GetExternalIPAddress action of the WANIPConnection:1, WANIPConnection:2
+// and WANPPPConnection:1 services, with configurable answers.
+package fakeupnp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	DeviceType        = "urn:schemas-upnp-org:device:InternetGatewayDevice:2"
+	WANIPConnection1  = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	WANIPConnection2  = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	WANPPPConnection1 = "urn:schemas-upnp-org:service:WANPPPConnection:1"
+)
+
+// Answer is what a service responds to GetExternalIPAddress. Without a Fault, the IP is
+// returned even if it's empty, like some routers do when they are not connected.
+type Answer struct {
+	IP string
+	// Fault is the description of a UPnP error which is returned instead of the IP
+	Fault string
+}
+
+type Gateway struct {
+	mu       sync.Mutex
+	services []string
+	answers  map[string]Answer
+	calls    map[string]int
+	searches int
+	http     net.Listener
+	ssdp     net.PacketConn
+}
+
+// New creates a gateway with the services, in the order they are listed in its device description.
+func New(services ...string) *Gateway {
+	return &Gateway{
+		services: services,
+		answers:  make(map[string]Answer),
+		calls:    make(map[string]int),
+	}
+}
+
+// SetAnswer changes what the service responds.
+func (this *Gateway) SetAnswer(service string, answer Answer) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.answers[service] = answer
+}
+
+// Calls returns how many times GetExternalIPAddress has been called on the service.
+func (this *Gateway) Calls(service string) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.calls[service]
+}
+
+// Searches returns how many SSDP M-SEARCH requests the gateway has answered.
+func (this *Gateway) Searches() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.searches
+}
+
+// Listen starts serving HTTP and SSDP on random localhost ports.
+func (this *Gateway) Listen() error {
+	var err error
+	this.http, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	this.ssdp, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		this.http.Close()
+		return err
+	}
+	go http.Serve(this.http, this)
+	go this.serveSSDP()
+	return nil
+}
+
+func (this *Gateway) Close() {
+	this.http.Close()
+	this.ssdp.Close()
+}
+
+// Location is the URL of the device description.
+func (this *Gateway) Location() string {
+	return "http://" + this.http.Addr().String() + "/rootDesc.xml"
+}
+
+// SSDPAddress is the UDP address where to send M-SEARCH requests, instead of the SSDP multicast address.
+func (this *Gateway) SSDPAddress() string {
+	return this.ssdp.LocalAddr().String()
+}
+
+func (this *Gateway) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := this.ssdp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		request := string(buf[:n])
+		if !strings.HasPrefix(request, "M-SEARCH ") {
+			continue
+		}
+		searchTarget := header(request, "ST")
+		if !this.matches(searchTarget) {
+			continue
+		}
+		this.mu.Lock()
+		this.searches++
+		this.mu.Unlock()
+		response := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + this.Location() + "\r\n" +
+			"SERVER: fakeupnp UPnP/1.1\r\n" +
+			"ST: " + searchTarget + "\r\n" +
+			"USN: uuid:fakeupnp-gateway::" + searchTarget + "\r\n" +
+			"\r\n"
+		_, _ = this.ssdp.WriteTo([]byte(response), addr)
+	}
+}
+
+func header(request string, name string) string {
+	for _, line := range strings.Split(request, "\r\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func (this *Gateway) matches(searchTarget string) bool {
+	if searchTarget == "ssdp:all" || searchTarget == "upnp:rootdevice" || searchTarget == DeviceType {
+		return true
+	}
+	for _, service := range this.services {
+		if service == searchTarget {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/rootDesc.xml" {
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(this.deviceDescription()))
+		return
+	}
+	for i, service := range this.services {
+		if r.URL.Path == controlURL(i) && r.Method == http.MethodPost {
+			this.control(w, r, service)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func controlURL(i int) string {
+	return fmt.Sprintf("/ctl/%d", i)
+}
+
+func (this *Gateway) deviceDescription() string {
+	var services bytes.Buffer
+	for i, service := range this.services {
+		fmt.Fprintf(&services, `<service><serviceType>%v</serviceType><serviceId>urn:upnp-org:serviceId:WANConnection%d</serviceId>`+
+			`<controlURL>%v</controlURL><eventSubURL>/evt/%d</eventSubURL><SCPDURL>/scpd/%d.xml</SCPDURL></service>`,
+			service, i, controlURL(i), i, i)
+	}
+	return `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>1</minor></specVersion>
+<device>
+<deviceType>` + DeviceType + `</deviceType>
+<friendlyName>Fake Gateway</friendlyName>
+<UDN>uuid:fakeupnp-gateway</UDN>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:2</deviceType>
+<friendlyName>WAN Device</friendlyName>
+<UDN>uuid:fakeupnp-wan</UDN>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:2</deviceType>
+<friendlyName>WAN Connection Device</friendlyName>
+<UDN>uuid:fakeupnp-wanconn</UDN>
+<serviceList>` + services.String() + `</serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>
+`
+}
+
+func (this *Gateway) control(w http.ResponseWriter, r *http.Request, service string) {
+	if action := strings.Trim(r.Header.Get("SOAPACTION"), `"`); action != service+"#GetExternalIPAddress" {
+		writeFault(w, 401, "Invalid Action")
+		return
+	}
+	this.mu.Lock()
+	this.calls[service]++
+	answer := this.answers[service]
+	this.mu.Unlock()
+	if answer.Fault != "" {
+		writeFault(w, 501, answer.Fault)
+		return
+	}
+	var ip bytes.Buffer
+	_ = xml.EscapeText(&ip, []byte(answer.IP))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	_, _ = w.Write([]byte(envelope(`<u:GetExternalIPAddressResponse xmlns:u="` + service + `">` +
+		`<NewExternalIPAddress>` + ip.String() + `</NewExternalIPAddress>` +
+		`</u:GetExternalIPAddressResponse>`)))
+}
+
+func writeFault(w http.ResponseWriter, code int, description string) {
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(description))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = w.Write([]byte(envelope(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>` +
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">` +
+		fmt.Sprintf(`<errorCode>%d</errorCode><errorDescription>%v</errorDescription>`, code, escaped.String()) +
+		`</UPnPError></detail></s:Fault>`)))
+}
+
+func envelope(body string) string {
+	return `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>` + body + `</s:Body></s:Envelope>`
+}
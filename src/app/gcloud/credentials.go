@@ -0,0 +1,109 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package gcloud
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"os"
+	"strings"
+)
+
+// Auth tells where the Google Cloud credentials come from. Without CredentialsBase64 or CredentialsFile,
+// the Application Default Credentials are used: the file in GOOGLE_APPLICATION_CREDENTIALS, the credentials
+// of the gcloud CLI, or the metadata server when running on Google Cloud.
+//
+// The credentials may be a service account key, or an external account configuration
+// for workload identity federation.
+//
+// Credentials are never sent over plain HTTP, so an Endpoint which starts with "http://",
+// such as a fake server, is used without credentials.
+type Auth struct {
+	// Endpoint is the URL of the Cloud DNS API, or "" for the default
+	Endpoint string
+	// CredentialsBase64 is the base64 encoded JSON of the credentials
+	CredentialsBase64 string
+	// CredentialsFile is the path of the credentials' JSON file, e.g. a Docker secret
+	CredentialsFile string
+	// ImpersonateServiceAccount is the service account whose identity is used, preceded by the
+	// service accounts of the delegation chain, if any
+	ImpersonateServiceAccount []string
+}
+
+// Anonymous tells whether the API is used without credentials.
+func (auth Auth) Anonymous() bool {
+	return strings.HasPrefix(auth.Endpoint, "http://")
+}
+
+// ClientOptions returns the options for connecting to the API with the credentials.
+func (auth Auth) ClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if auth.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(auth.Endpoint))
+	}
+	if auth.Anonymous() {
+		return append(opts, option.WithoutAuthentication()), nil
+	}
+	creds, err := auth.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, option.WithTokenSource(creds.TokenSource)), nil
+}
+
+// CredentialsJson returns the configured credentials and where they came from,
+// or nil if the Application Default Credentials should be used.
+func (auth Auth) CredentialsJson() ([]byte, string, error) {
+	if auth.CredentialsBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth.CredentialsBase64))
+		if err != nil {
+			return nil, "", fmt.Errorf("GOOGLE_CREDENTIALS_BASE64 is not valid base64: %w", err)
+		}
+		return data, "GOOGLE_CREDENTIALS_BASE64", nil
+	}
+	if auth.CredentialsFile != "" {
+		data, err := os.ReadFile(auth.CredentialsFile)
+		return data, auth.CredentialsFile, err
+	}
+	return nil, "", nil
+}
+
+// Credentials returns the credentials for accessing Cloud DNS.
+func (auth Auth) Credentials(ctx context.Context) (*google.Credentials, error) {
+	data, source, err := auth.CredentialsJson()
+	if err != nil {
+		return nil, err
+	}
+	var creds *google.Credentials
+	if data != nil {
+		creds, err = google.CredentialsFromJSON(ctx, data, dns.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", source, err)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, dns.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("no Google credentials were configured: %w", err)
+		}
+	}
+	if len(auth.ImpersonateServiceAccount) == 0 {
+		return creds, nil
+	}
+	last := len(auth.ImpersonateServiceAccount) - 1
+	tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: auth.ImpersonateServiceAccount[last],
+		Delegates:       auth.ImpersonateServiceAccount[:last],
+		Scopes:          []string{dns.CloudPlatformScope},
+	}, option.WithCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %v: %w", auth.ImpersonateServiceAccount[last], err)
+	}
+	return &google.Credentials{ProjectID: creds.ProjectID, TokenSource: tokenSource}, nil
+}
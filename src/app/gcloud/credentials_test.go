@@ -0,0 +1,83 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package gcloud
+
+import (
+	"context"
+	"encoding/base64"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+)
+
+func CredentialsSpec() {
+	externalAccount := `{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"file": "/var/run/token"}
+	}`
+
+	Convey("credentials may be given as base64", func() {
+		auth := Auth{CredentialsBase64: base64.StdEncoding.EncodeToString([]byte(externalAccount))}
+
+		data, source, err := auth.CredentialsJson()
+
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, externalAccount)
+		So(source, ShouldEqual, "GOOGLE_CREDENTIALS_BASE64")
+	})
+
+	Convey("credentials may be read from a file, e.g. a Docker secret", func() {
+		dir, err := os.MkdirTemp("", "credentials-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "google-credentials")
+		So(os.WriteFile(path, []byte(externalAccount), 0600), ShouldBeNil)
+		auth := Auth{CredentialsFile: path}
+
+		data, source, err := auth.CredentialsJson()
+
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, externalAccount)
+		So(source, ShouldEqual, path)
+	})
+
+	Convey("without explicit credentials, the Application Default Credentials are used", func() {
+		data, _, err := Auth{}.CredentialsJson()
+
+		So(err, ShouldBeNil)
+		So(data, ShouldBeNil)
+	})
+
+	Convey("external account configurations are supported", func() {
+		auth := Auth{CredentialsBase64: base64.StdEncoding.EncodeToString([]byte(externalAccount))}
+
+		creds, err := auth.Credentials(context.Background())
+
+		So(err, ShouldBeNil)
+		So(creds.TokenSource, ShouldNotBeNil)
+	})
+
+	Convey("the credentials may impersonate a service account", func() {
+		auth := Auth{
+			CredentialsBase64:         base64.StdEncoding.EncodeToString([]byte(externalAccount)),
+			ImpersonateServiceAccount: []string{"dns-admin@example.iam.gserviceaccount.com"},
+		}
+
+		creds, err := auth.Credentials(context.Background())
+
+		So(err, ShouldBeNil)
+		So(creds.TokenSource, ShouldNotBeNil)
+	})
+
+	Convey("error: invalid base64", func() {
+		_, err := Auth{CredentialsBase64: "not base64!"}.Credentials(context.Background())
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "GOOGLE_CREDENTIALS_BASE64 is not valid base64")
+	})
+}
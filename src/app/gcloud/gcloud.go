@@ -5,56 +5,145 @@
 package gcloud
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/dns/v1"
 	"log"
-	"os"
 	"reflect"
+	"sort"
 	"strings"
 )
 
+// Client searches the DNS records of one or more projects. The clients of different
+// projects share the same authenticated connection.
 type Client struct {
-	project    string
-	context    context.Context
+	projects []string
+	// visibility limits the search to "public" or "private" zones; "" or "both" searches both
+	visibility string
+	// zoneNames limits the search to the named zones, if not empty
+	zoneNames  []string
 	dnsService *dns.Service
 }
 
-func Configure(project string) *Client {
-	googleApplicationCredentials := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if googleApplicationCredentials == "" {
-		log.Fatal("Environment variable GOOGLE_APPLICATION_CREDENTIALS not set. " +
-			"See https://cloud.google.com/docs/authentication/production for instructions.")
+func Configure(auth Auth, projects ...string) *Client {
+	client, err := New(auth, projects...)
+	if err != nil {
+		log.Fatal(err, "\nSee https://cloud.google.com/docs/authentication/production for instructions.")
 	}
+	return client
+}
 
+// New connects to Cloud DNS. The connection outlives the context of any one operation,
+// so each method is given its own context.
+func New(auth Auth, projects ...string) (*Client, error) {
 	ctx := context.Background()
-	client, err := google.DefaultClient(ctx, dns.CloudPlatformScope)
+	opts, err := auth.ClientOptions(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	dnsService, err := dns.New(client)
+	dnsService, err := dns.NewService(ctx, opts...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return &Client{
-		project:    project,
-		context:    ctx,
+		projects:   projects,
 		dnsService: dnsService,
+	}, nil
+}
+
+// ForProject returns a client which searches only the project.
+func (this *Client) ForProject(project string) *Client {
+	client := *this
+	client.projects = []string{project}
+	return &client
+}
+
+// InZones returns a client which searches only the zones which have the visibility ("public", "private"
+// or "both"), and whose name or ZoneKey is one of the zone names. Empty arguments don't limit the search.
+func (this *Client) InZones(visibility string, zoneNames []string) *Client {
+	client := *this
+	client.visibility = visibility
+	client.zoneNames = zoneNames
+	return &client
+}
+
+// FilterZones returns the zones which the client searches.
+func (this *Client) FilterZones(zones []*ManagedZone) []*ManagedZone {
+	var results []*ManagedZone
+	for _, zone := range zones {
+		if !contains(this.projects, zone.Project) {
+			continue
+		}
+		if this.visibility != "" && this.visibility != "both" && zone.Visibility != this.visibility {
+			continue
+		}
+		if len(this.zoneNames) > 0 && !contains(this.zoneNames, zone.Name) && !contains(this.zoneNames, zone.Key()) {
+			continue
+		}
+		results = append(results, zone)
 	}
+	return results
 }
 
-func (this *Client) DnsRecordsByNameAndType(names []string, recordType string) (DnsRecords, error) {
-	records, err := this.DnsRecords()
+// ZoneForName returns the most specific zone which contains the name, or nil.
+func ZoneForName(zones []*ManagedZone, name string) *ManagedZone {
+	var found *ManagedZone
+	for _, zone := range zones {
+		if name == zone.DnsName || strings.HasSuffix(name, "."+zone.DnsName) {
+			if found == nil || len(zone.DnsName) > len(found.DnsName) {
+				found = zone
+			}
+		}
+	}
+	return found
+}
+
+// Projects returns the projects which the client searches.
+func (this *Client) Projects() []string {
+	return this.projects
+}
+
+func (this *Client) DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (DnsRecords, error) {
+	records, err := this.DnsRecords(ctx)
 	if err != nil {
 		return nil, err
 	}
-	found := filterDnsRecordsByName(records, names)
-	found = filterDnsRecordsByType(found, recordType)
-	if len(found) != len(names) {
+	return FindDnsRecords(records, names, recordType)
+}
+
+// FindDnsRecords returns the records with the names and type. A name which is a CNAME is
+// followed to the record it points at, as long as that is in one of the managed zones.
+// Wildcard names such as "*.example.com." match only the wildcard record itself.
+// A record with a routing policy is found only if the name selects one of its items.
+// It's an error if the record exists in more than one project.
+func FindDnsRecords(records DnsRecords, names []string, recordType string) (DnsRecords, error) {
+	var found DnsRecords
+	missing := false
+	for _, name := range names {
+		name, selector := SplitRoutingItem(name)
+		record, err := followCnames(records, name, recordType)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			missing = true
+			continue
+		}
+		if err := checkUnique(records, record); err != nil {
+			return nil, err
+		}
+		record, err = selectRoutingItem(record, name, selector)
+		if err != nil {
+			return nil, err
+		}
+		if !containsRecord(found, record) {
+			found = append(found, record)
+		}
+	}
+	if missing {
 		return nil, errors.New(fmt.Sprintf("Expected DNS records <%v> of type <%v>, but only found <%v> of them from the available <%v>",
 			strings.Join(names, ", "),
 			recordType,
@@ -64,28 +153,74 @@ func (this *Client) DnsRecordsByNameAndType(names []string, recordType string) (
 	return found, nil
 }
 
-func filterDnsRecordsByName(records DnsRecords, names []string) DnsRecords {
-	if len(names) == 0 {
-		return DnsRecords{}
+const maxCnameHops = 8
+
+func followCnames(records DnsRecords, name string, recordType string) (*DnsRecord, error) {
+	target := name
+	for hops := 0; hops <= maxCnameHops; hops++ {
+		if record := findDnsRecord(records, target, recordType); record != nil {
+			return record, nil
+		}
+		cname := findDnsRecord(records, target, "CNAME")
+		if cname == nil || len(cname.Rrdatas) == 0 {
+			if hops == 0 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("%v is a CNAME to %v, which has no %v record in the managed zones; "+
+				"configure the name which has the %v record instead", name, target, recordType, recordType)
+		}
+		target = cname.Rrdatas[0]
 	}
-	var results DnsRecords
+	return nil, fmt.Errorf("%v is a CNAME chain longer than %d hops, or a CNAME loop", name, maxCnameHops)
+}
+
+func findDnsRecord(records DnsRecords, name string, recordType string) *DnsRecord {
 	for _, record := range records {
-		if equalsAny(record.Name, names) {
-			results = append(results, record)
+		if record.Type == recordType && sameName(record.Name, name) {
+			return record
 		}
 	}
-	return results
+	return nil
 }
 
-func equalsAny(haystack string, needles []string) bool {
-	for _, needle := range needles {
-		if haystack == needle {
+// checkUnique fails if the record exists in many zones, e.g. in a public and a private zone, or in many projects.
+func checkUnique(records DnsRecords, needle *DnsRecord) error {
+	zones := []string{needle.ZoneKey()}
+	for _, record := range records {
+		if record.Type == needle.Type && sameName(record.Name, needle.Name) && !contains(zones, record.ZoneKey()) {
+			zones = append(zones, record.ZoneKey())
+		}
+	}
+	if len(zones) > 1 {
+		return fmt.Errorf("%v exists in more than one managed zone: %v; choose the zone using the project, "+
+			"zone visibility or managed zones of the record group which has the name",
+			needle.NameAndType(), strings.Join(zones, ", "))
+	}
+	return nil
+}
+
+func containsRecord(records DnsRecords, needle *DnsRecord) bool {
+	for _, record := range records {
+		if record.ResourceRecordSet == needle.ResourceRecordSet && record.Item == needle.Item {
 			return true
 		}
 	}
 	return false
 }
 
+// sameName compares DNS names case-insensitively, and treats the escaped
+// form of the wildcard label "\052" the same as "*".
+func sameName(a string, b string) bool {
+	return strings.EqualFold(unescapeWildcard(a), unescapeWildcard(b))
+}
+
+func unescapeWildcard(name string) string {
+	if rest, found := strings.CutPrefix(name, `\052.`); found {
+		return "*." + rest
+	}
+	return name
+}
+
 func filterDnsRecordsByType(records DnsRecords, recordType string) DnsRecords {
 	var results DnsRecords
 	for _, record := range records {
@@ -96,19 +231,19 @@ func filterDnsRecordsByType(records DnsRecords, recordType string) DnsRecords {
 	return results
 }
 
-func (this *Client) DnsRecords() (DnsRecords, error) {
-	zones, err := this.ManagedZones()
+func (this *Client) DnsRecords(ctx context.Context) (DnsRecords, error) {
+	zones, err := this.ManagedZones(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var records DnsRecords
 	for _, zone := range zones {
-		rrsets, err := this.ResourceRecordSets(zone.Name)
+		rrsets, err := this.ResourceRecordSets(ctx, zone)
 		if err != nil {
 			return nil, err
 		}
 		for _, rrset := range rrsets {
-			record := &DnsRecord{ManagedZone: zone.Name, ResourceRecordSet: rrset}
+			record := &DnsRecord{Project: zone.Project, ManagedZone: zone.Name, Visibility: zone.Visibility, ResourceRecordSet: rrset}
 			records = append(records, record)
 		}
 
@@ -116,21 +251,53 @@ func (this *Client) DnsRecords() (DnsRecords, error) {
 	return records, nil
 }
 
-func (this *Client) ManagedZones() ([]*dns.ManagedZone, error) {
-	var results []*dns.ManagedZone
-	err := this.dnsService.ManagedZones.List(this.project).Pages(this.context, func(page *dns.ManagedZonesListResponse) error {
-		for _, zone := range page.ManagedZones {
-			results = append(results, zone)
+// ManagedZone is a Cloud DNS zone, and the project which it belongs to.
+type ManagedZone struct {
+	Project string
+	*dns.ManagedZone
+}
+
+// Key identifies the zone among the zones of all projects.
+func (zone ManagedZone) Key() string {
+	return ZoneKey(zone.Project, zone.Name)
+}
+
+// ZoneKey returns "<project>/<zone>", or only the zone's name if the project is not known.
+func ZoneKey(project string, managedZone string) string {
+	if project == "" {
+		return managedZone
+	}
+	return project + "/" + managedZone
+}
+
+func (this *Client) splitZoneKey(key string) (string, string) {
+	if project, managedZone, found := strings.Cut(key, "/"); found {
+		return project, managedZone
+	}
+	return this.projects[0], key
+}
+
+// ManagedZones returns the zones of all projects, limited to those which the client searches.
+func (this *Client) ManagedZones(ctx context.Context) ([]*ManagedZone, error) {
+	var results []*ManagedZone
+	for _, project := range this.projects {
+		err := this.dnsService.ManagedZones.List(project).Pages(ctx, func(page *dns.ManagedZonesListResponse) error {
+			for _, zone := range page.ManagedZones {
+				results = append(results, &ManagedZone{Project: project, ManagedZone: zone})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("project %v: %w", project, err)
 		}
-		return nil
-	})
-	return results, err
+	}
+	return this.FilterZones(results), nil
 }
 
-func (this *Client) ResourceRecordSets(managedZone string) ([]*dns.ResourceRecordSet, error) {
+func (this *Client) ResourceRecordSets(ctx context.Context, zone *ManagedZone) ([]*dns.ResourceRecordSet, error) {
 	var results []*dns.ResourceRecordSet
-	req := this.dnsService.ResourceRecordSets.List(this.project, managedZone)
-	err := req.Pages(this.context, func(page *dns.ResourceRecordSetsListResponse) error {
+	req := this.dnsService.ResourceRecordSets.List(zone.Project, zone.Name)
+	err := req.Pages(ctx, func(page *dns.ResourceRecordSetsListResponse) error {
 		for _, rrset := range page.Rrsets {
 			results = append(results, rrset)
 		}
@@ -139,32 +306,120 @@ func (this *Client) ResourceRecordSets(managedZone string) ([]*dns.ResourceRecor
 	return results, err
 }
 
-func (this *Client) UpdateDnsRecords(records DnsRecords, newValues []string) (DnsRecords, error) {
+func (this *Client) UpdateDnsRecords(ctx context.Context, records DnsRecords, newValues []string) (DnsRecords, error) {
+	changes := ChangeSet{}
+	changes.Update(records, newValues)
+	return this.ApplyChanges(ctx, changes)
+}
+
+// ChangeSet collects changes to many records, so that each managed zone is changed in one atomic dns.Change.
+// The changes are keyed by ZoneKey.
+type ChangeSet map[string]*dns.Change
+
+func (changes ChangeSet) change(zoneKey string) *dns.Change {
+	change, ok := changes[zoneKey]
+	if !ok {
+		change = &dns.Change{}
+		changes[zoneKey] = change
+	}
+	return change
+}
+
+// Update replaces the values of the records which are outdated. Records which are
+// different items of the same routing policy are updated with one replacement.
+func (changes ChangeSet) Update(records DnsRecords, newValues []string) {
+	for zoneKey, recordsInZone := range records.GroupByZone() {
+		planned := changesToUpdateDnsRecordValues(recordsInZone, newValues)
+		if planned == nil {
+			continue
+		}
+		change := changes.change(zoneKey)
+		for i, deletion := range planned.Deletions {
+			if j := indexOf(change.Deletions, deletion); j >= 0 {
+				// another item of the same routing policy was already updated
+				change.Additions[j] = mergeItems(deletion, change.Additions[j], planned.Additions[i])
+				continue
+			}
+			change.Deletions = append(change.Deletions, deletion)
+			change.Additions = append(change.Additions, planned.Additions[i])
+		}
+	}
+}
+
+// indexOf finds the record set by name and type, because the records may have been read separately.
+func indexOf(rrsets []*dns.ResourceRecordSet, needle *dns.ResourceRecordSet) int {
+	for i, rrset := range rrsets {
+		if rrset.Name == needle.Name && rrset.Type == needle.Type {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add adds the deletions and additions of the change to the zone's change.
+func (changes ChangeSet) Add(zoneKey string, change *dns.Change) {
+	zoneChange := changes.change(zoneKey)
+	zoneChange.Deletions = append(zoneChange.Deletions, change.Deletions...)
+	zoneChange.Additions = append(zoneChange.Additions, change.Additions...)
+}
+
+// Set creates the record set, or replaces the existing record if it's not nil.
+func (changes ChangeSet) Set(zoneKey string, existing *DnsRecord, rrset *dns.ResourceRecordSet) {
+	change := changes.change(zoneKey)
+	if existing != nil {
+		change.Deletions = append(change.Deletions, existing.ResourceRecordSet)
+	}
+	change.Additions = append(change.Additions, rrset)
+}
+
+// ApplyChanges makes the changes, one managed zone at a time.
+func (this *Client) ApplyChanges(ctx context.Context, changes ChangeSet) (DnsRecords, error) {
+	var zones []string
+	for zoneKey := range changes {
+		zones = append(zones, zoneKey)
+	}
+	sort.Strings(zones)
 	var updated DnsRecords
-	for managedZone, recordsInZone := range records.GroupByZone() {
-		plannedChanges := changesToUpdateDnsRecordValues(recordsInZone, newValues)
-		if plannedChanges == nil {
+	for _, zoneKey := range zones {
+		change := changes[zoneKey]
+		if len(change.Additions) == 0 && len(change.Deletions) == 0 {
 			continue
 		}
-		doneChanges, err := this.dnsService.Changes.Create(this.project, managedZone, plannedChanges).Context(this.context).Do()
+		done, err := this.ApplyChange(ctx, zoneKey, change)
 		if err != nil {
 			return nil, err
 		}
-		updated = append(updated, ToDnsRecords(managedZone, doneChanges)...)
+		updated = append(updated, done...)
 	}
 	return updated, nil
 }
 
+// ApplyChange makes a change to the records of a managed zone, identified by its ZoneKey. A deletion
+// which doesn't match the current record exactly, or an addition which already exists, makes it fail.
+func (this *Client) ApplyChange(ctx context.Context, zoneKey string, change *dns.Change) (DnsRecords, error) {
+	project, managedZone := this.splitZoneKey(zoneKey)
+	doneChange, err := this.dnsService.Changes.Create(project, managedZone, change).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	results := ToDnsRecords(managedZone, doneChange)
+	for _, record := range results {
+		record.Project = project
+	}
+	return results, nil
+}
+
 func changesToUpdateDnsRecordValues(records DnsRecords, newValues []string) *dns.Change {
 	changes := &dns.Change{}
-	for _, record := range records {
-		if reflect.DeepEqual(record.Rrdatas, newValues) {
+	replaced := make(map[*dns.ResourceRecordSet]int)
+	for _, record := range records.Outdated(newValues) {
+		if i, ok := replaced[record.ResourceRecordSet]; ok {
+			changes.Additions[i] = withItemValues(changes.Additions[i], record.Item, newValues)
 			continue
 		}
+		replaced[record.ResourceRecordSet] = len(changes.Additions)
 		changes.Deletions = append(changes.Deletions, record.ResourceRecordSet)
-		addition := *record.ResourceRecordSet
-		addition.Rrdatas = newValues
-		changes.Additions = append(changes.Additions, &addition)
+		changes.Additions = append(changes.Additions, withItemValues(record.ResourceRecordSet, record.Item, newValues))
 	}
 	if len(changes.Additions) == 0 {
 		return nil
@@ -173,8 +428,13 @@ func changesToUpdateDnsRecordValues(records DnsRecords, newValues []string) *dns
 }
 
 type DnsRecord struct {
+	Project     string
 	ManagedZone string
-	OldRrdatas  []string
+	// Visibility is the visibility of the zone, "public" or "private"
+	Visibility string
+	OldRrdatas []string
+	// Item is the selected item of the routing policy, e.g. "geo=europe-west1", or empty if there is no routing policy
+	Item string
 	*dns.ResourceRecordSet
 }
 
@@ -182,6 +442,41 @@ func (record DnsRecord) NameAndType() string {
 	return fmt.Sprintf("%v %v", record.Name, record.Type)
 }
 
+// ZoneKey identifies the record's zone among the zones of all projects.
+func (record DnsRecord) ZoneKey() string {
+	return ZoneKey(record.Project, record.ManagedZone)
+}
+
+// ItemName is the name of the record, followed by the selected item of the routing policy, if any.
+func (record DnsRecord) ItemName() string {
+	if record.Item == "" {
+		return record.Name
+	}
+	return record.Name + "@" + record.Item
+}
+
+// Key identifies the record, or the selected item of its routing policy, among the records of all
+// zones, when a name may exist both in a public and a private zone. Names in public zones are
+// their own keys.
+func (record DnsRecord) Key() string {
+	if record.Visibility == "private" {
+		return "private:" + record.ItemName()
+	}
+	return record.ItemName()
+}
+
+// Values returns the values of the record, or of the selected item of its routing policy.
+func (record DnsRecord) Values() []string {
+	if record.Item == "" {
+		return record.Rrdatas
+	}
+	item, err := findPolicyItem(record.ResourceRecordSet, record.Item)
+	if err != nil {
+		return nil
+	}
+	return *item.rrdatas
+}
+
 type DnsRecords []*DnsRecord
 
 func ToDnsRecords(managedZone string, change *dns.Change) DnsRecords {
@@ -189,8 +484,11 @@ func ToDnsRecords(managedZone string, change *dns.Change) DnsRecords {
 	for _, addition := range change.Additions {
 		result := &DnsRecord{ManagedZone: managedZone, ResourceRecordSet: addition}
 		for _, deletion := range change.Deletions {
-			if deletion.Name == addition.Name {
+			if deletion.Name == addition.Name && deletion.Type == addition.Type {
 				result.OldRrdatas = deletion.Rrdatas
+				if addition.RoutingPolicy != nil {
+					result.Item, result.OldRrdatas = changedItem(deletion, addition)
+				}
 			}
 		}
 		results = append(results, result)
@@ -198,14 +496,71 @@ func ToDnsRecords(managedZone string, change *dns.Change) DnsRecords {
 	return results
 }
 
+// GroupByZone groups the records by their ZoneKey.
 func (records DnsRecords) GroupByZone() map[string]DnsRecords {
 	byZone := make(map[string]DnsRecords)
 	for _, record := range records {
-		byZone[record.ManagedZone] = append(byZone[record.ManagedZone], record)
+		byZone[record.ZoneKey()] = append(byZone[record.ZoneKey()], record)
 	}
 	return byZone
 }
 
+// Outdated returns the records whose values differ from the new values. The order of the values doesn't matter.
+func (records DnsRecords) Outdated(newValues []string) DnsRecords {
+	var results DnsRecords
+	for _, record := range records {
+		if !reflect.DeepEqual(sorted(record.Values()), sorted(newValues)) {
+			results = append(results, record)
+		}
+	}
+	return results
+}
+
+// MergeValues replaces the values which were published previously with the new values,
+// but keeps the other values of the record, e.g. a static failover address.
+func MergeValues(current []string, previous []string, newValues []string) []string {
+	var results []string
+	for _, value := range current {
+		if !contains(previous, value) || contains(newValues, value) {
+			results = append(results, value)
+		}
+	}
+	for _, value := range newValues {
+		if !contains(results, value) {
+			results = append(results, value)
+		}
+	}
+	return results
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func sorted(values []string) []string {
+	results := append([]string{}, values...)
+	sort.Strings(results)
+	return results
+}
+
+// OfType returns the records of the type.
+func (records DnsRecords) OfType(recordType string) DnsRecords {
+	return filterDnsRecordsByType(records, recordType)
+}
+
+func (records DnsRecords) Names() []string {
+	names := make([]string, len(records))
+	for i, record := range records {
+		names[i] = record.Name
+	}
+	return names
+}
+
 func (records DnsRecords) NamesAndTypes() []string {
 	names := make([]string, len(records))
 	for i, record := range records {
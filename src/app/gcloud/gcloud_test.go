@@ -11,39 +11,17 @@ import (
 )
 
 func TestGCloud(t *testing.T) {
-	Convey("FilterDnsRecordsByNameSpec", t, FilterDnsRecordsByNameSpec)
 	Convey("FilterDnsRecordsByTypeSpec", t, FilterDnsRecordsByTypeSpec)
 	Convey("GroupDnsRecordsByZoneSpec", t, GroupDnsRecordsByZoneSpec)
+	Convey("OutdatedDnsRecordsSpec", t, OutdatedDnsRecordsSpec)
+	Convey("MergeValuesSpec", t, MergeValuesSpec)
 	Convey("UpdateDnsRecordValuesSpec", t, UpdateDnsRecordValuesSpec)
-}
-
-func FilterDnsRecordsByNameSpec() {
-	records := []*DnsRecord{
-		{ManagedZone: "example", ResourceRecordSet: &dns.ResourceRecordSet{Name: "foo.example.com."}},
-		{ManagedZone: "example", ResourceRecordSet: &dns.ResourceRecordSet{Name: "bar.example.com."}},
-		{ManagedZone: "example", ResourceRecordSet: &dns.ResourceRecordSet{Name: "baz.example.com."}},
-	}
-
-	Convey("Empty search", func() {
-		records = filterDnsRecordsByName(records, []string{})
-
-		So(records, ShouldHaveLength, 0)
-	})
-
-	Convey("One match", func() {
-		records = filterDnsRecordsByName(records, []string{"foo.example.com."})
-
-		So(records, ShouldHaveLength, 1)
-		So(records[0].Name, ShouldEqual, "foo.example.com.")
-	})
-
-	Convey("Many matches", func() {
-		records = filterDnsRecordsByName(records, []string{"bar.example.com.", "baz.example.com."})
-
-		So(records, ShouldHaveLength, 2)
-		So(records[0].Name, ShouldEqual, "bar.example.com.")
-		So(records[1].Name, ShouldEqual, "baz.example.com.")
-	})
+	Convey("ChangeSetSpec", t, ChangeSetSpec)
+	Convey("FindDnsRecordsSpec", t, FindDnsRecordsSpec)
+	Convey("RoutingPolicySpec", t, RoutingPolicySpec)
+	Convey("FilterZonesSpec", t, FilterZonesSpec)
+	Convey("ZoneForNameSpec", t, ZoneForNameSpec)
+	Convey("CredentialsSpec", t, CredentialsSpec)
 }
 
 func FilterDnsRecordsByTypeSpec() {
@@ -78,6 +56,50 @@ func GroupDnsRecordsByZoneSpec() {
 	})
 }
 
+func OutdatedDnsRecordsSpec() {
+	records := DnsRecords{
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Rrdatas: []string{"2.2.2.2"}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.zone1.com.", Rrdatas: []string{"1.1.1.1"}}},
+	}
+
+	outdated := records.Outdated([]string{"2.2.2.2"})
+
+	So(outdated.Names(), ShouldResemble, []string{"www.zone1.com."})
+
+	Convey("the order of multiple values doesn't matter", func() {
+		records := DnsRecords{
+			{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Rrdatas: []string{"2.2.2.2", "1.1.1.1"}}},
+			{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.zone1.com.", Rrdatas: []string{"1.1.1.1"}}},
+		}
+
+		outdated := records.Outdated([]string{"1.1.1.1", "2.2.2.2"})
+
+		So(outdated.Names(), ShouldResemble, []string{"www.zone1.com."})
+	})
+}
+
+func MergeValuesSpec() {
+	Convey("replaces the previously published value", func() {
+		So(MergeValues([]string{"1.1.1.1", "9.9.9.9"}, []string{"1.1.1.1"}, []string{"2.2.2.2"}),
+			ShouldResemble, []string{"9.9.9.9", "2.2.2.2"})
+	})
+
+	Convey("keeps a value which is still published", func() {
+		So(MergeValues([]string{"1.1.1.1", "9.9.9.9"}, []string{"1.1.1.1", "3.3.3.3"}, []string{"1.1.1.1"}),
+			ShouldResemble, []string{"1.1.1.1", "9.9.9.9"})
+	})
+
+	Convey("without history, only adds the new value", func() {
+		So(MergeValues([]string{"9.9.9.9"}, nil, []string{"2.2.2.2"}),
+			ShouldResemble, []string{"9.9.9.9", "2.2.2.2"})
+	})
+
+	Convey("nothing changes when the new value is already there", func() {
+		So(MergeValues([]string{"9.9.9.9", "2.2.2.2"}, []string{"2.2.2.2"}, []string{"2.2.2.2"}),
+			ShouldResemble, []string{"9.9.9.9", "2.2.2.2"})
+	})
+}
+
 func UpdateDnsRecordValuesSpec() {
 	Convey("one record, one value", func() {
 		records := DnsRecords{
@@ -176,3 +198,203 @@ func UpdateDnsRecordValuesSpec() {
 		So(changes, ShouldBeNil)
 	})
 }
+
+func ChangeSetSpec() {
+	changes := ChangeSet{}
+	records := DnsRecords{
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}}},
+		{ManagedZone: "zone2", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone2.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}}},
+		{ManagedZone: "zone2", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.zone2.com.", Type: "A", Rrdatas: []string{"2.2.2.2"}}},
+	}
+	heartbeat := &DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "_hb.zone1.com.", Type: "TXT", Rrdatas: []string{`"old"`}}}
+
+	changes.Update(records, []string{"2.2.2.2"})
+	changes.Set("zone1", heartbeat, &dns.ResourceRecordSet{Name: "_hb.zone1.com.", Type: "TXT", Rrdatas: []string{`"new"`}})
+	changes.Set("zone3", nil, &dns.ResourceRecordSet{Name: "_hb.zone3.com.", Type: "TXT", Rrdatas: []string{`"new"`}})
+
+	Convey("zones of different projects are changed separately", func() {
+		changes := ChangeSet{}
+		changes.Update(DnsRecords{
+			{Project: "project1", ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Type: "A"}},
+			{Project: "project2", ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Type: "A"}},
+		}, []string{"2.2.2.2"})
+
+		So(changes, ShouldHaveLength, 2)
+		So(changes["project1/zone1"].Additions, ShouldHaveLength, 1)
+		So(changes["project2/zone1"].Additions, ShouldHaveLength, 1)
+	})
+
+	So(changes, ShouldResemble, ChangeSet{
+		"zone1": {
+			Deletions: []*dns.ResourceRecordSet{
+				{Name: "zone1.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}},
+				{Name: "_hb.zone1.com.", Type: "TXT", Rrdatas: []string{`"old"`}},
+			},
+			Additions: []*dns.ResourceRecordSet{
+				{Name: "zone1.com.", Type: "A", Rrdatas: []string{"2.2.2.2"}},
+				{Name: "_hb.zone1.com.", Type: "TXT", Rrdatas: []string{`"new"`}},
+			},
+		},
+		"zone2": {
+			Deletions: []*dns.ResourceRecordSet{
+				{Name: "zone2.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}},
+			},
+			Additions: []*dns.ResourceRecordSet{
+				{Name: "zone2.com.", Type: "A", Rrdatas: []string{"2.2.2.2"}},
+			},
+		},
+		"zone3": {
+			Additions: []*dns.ResourceRecordSet{
+				{Name: "_hb.zone3.com.", Type: "TXT", Rrdatas: []string{`"new"`}},
+			},
+		},
+	})
+}
+
+func FindDnsRecordsSpec() {
+	home := &DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}}}
+	wildcard := &DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "*.home.example.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}}}
+	records := DnsRecords{
+		home,
+		wildcard,
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "nas.example.com.", Type: "CNAME", Rrdatas: []string{"home.example.com."}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.example.com.", Type: "CNAME", Rrdatas: []string{"nas.example.com."}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "blog.example.com.", Type: "CNAME", Rrdatas: []string{"example.github.io."}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "loop1.example.com.", Type: "CNAME", Rrdatas: []string{"loop2.example.com."}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "loop2.example.com.", Type: "CNAME", Rrdatas: []string{"loop1.example.com."}}},
+	}
+
+	Convey("empty search", func() {
+		found, err := FindDnsRecords(records, []string{}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldHaveLength, 0)
+	})
+
+	Convey("returns the records with the names, in the order of the names", func() {
+		found, err := FindDnsRecords(records, []string{"*.home.example.com.", "home.example.com."}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldResemble, DnsRecords{wildcard, home})
+	})
+
+	Convey("wildcard names match the wildcard record", func() {
+		found, err := FindDnsRecords(records, []string{"*.home.example.com."}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldResemble, DnsRecords{wildcard})
+	})
+
+	Convey("the escaped form of wildcard names is the same", func() {
+		found, err := FindDnsRecords(records, []string{`\052.home.example.com.`}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldResemble, DnsRecords{wildcard})
+	})
+
+	Convey("CNAMEs are followed to the A record", func() {
+		found, err := FindDnsRecords(records, []string{"www.example.com."}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldResemble, DnsRecords{home})
+	})
+
+	Convey("a record is returned only once, even if many names lead to it", func() {
+		found, err := FindDnsRecords(records, []string{"home.example.com.", "nas.example.com.", "www.example.com."}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldResemble, DnsRecords{home})
+	})
+
+	Convey("error: CNAME to outside the managed zones", func() {
+		_, err := FindDnsRecords(records, []string{"blog.example.com."}, "A")
+
+		So(err, ShouldBeError, "blog.example.com. is a CNAME to example.github.io., which has no A record in the managed zones; "+
+			"configure the name which has the A record instead")
+	})
+
+	Convey("error: CNAME loop", func() {
+		_, err := FindDnsRecords(records, []string{"loop1.example.com."}, "A")
+
+		So(err, ShouldBeError, "loop1.example.com. is a CNAME chain longer than 8 hops, or a CNAME loop")
+	})
+
+	Convey("error: the same name in many projects", func() {
+		records := DnsRecords{
+			{Project: "project1", ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A"}},
+			{Project: "project2", ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A"}},
+		}
+
+		_, err := FindDnsRecords(records, []string{"home.example.com."}, "A")
+
+		So(err, ShouldBeError, "home.example.com. A exists in more than one managed zone: project1/zone1, project2/zone1; "+
+			"choose the zone using the project, zone visibility or managed zones of the record group which has the name")
+	})
+
+	Convey("error: the same name in a public and a private zone", func() {
+		records := DnsRecords{
+			{Project: "project1", ManagedZone: "public", Visibility: "public", ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A"}},
+			{Project: "project1", ManagedZone: "private", Visibility: "private", ResourceRecordSet: &dns.ResourceRecordSet{Name: "home.example.com.", Type: "A"}},
+		}
+
+		_, err := FindDnsRecords(records, []string{"home.example.com."}, "A")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "home.example.com. A exists in more than one managed zone: project1/public, project1/private;")
+	})
+
+	Convey("error: missing record", func() {
+		_, err := FindDnsRecords(records, []string{"home.example.com.", "missing.example.com."}, "A")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "Expected DNS records <home.example.com., missing.example.com.> of type <A>, but only found <home.example.com. A> of them")
+	})
+}
+
+func FilterZonesSpec() {
+	public := &ManagedZone{Project: "project1", ManagedZone: &dns.ManagedZone{Name: "home-public", Visibility: "public"}}
+	private := &ManagedZone{Project: "project1", ManagedZone: &dns.ManagedZone{Name: "home-private", Visibility: "private"}}
+	other := &ManagedZone{Project: "project2", ManagedZone: &dns.ManagedZone{Name: "home-public", Visibility: "public"}}
+	zones := []*ManagedZone{public, private, other}
+	client := &Client{projects: []string{"project1", "project2"}}
+
+	Convey("all zones by default", func() {
+		So(client.FilterZones(zones), ShouldResemble, zones)
+		So(client.InZones("both", nil).FilterZones(zones), ShouldResemble, zones)
+	})
+
+	Convey("zones of one project", func() {
+		So(client.ForProject("project2").FilterZones(zones), ShouldResemble, []*ManagedZone{other})
+	})
+
+	Convey("zones of one visibility", func() {
+		So(client.InZones("public", nil).FilterZones(zones), ShouldResemble, []*ManagedZone{public, other})
+		So(client.InZones("private", nil).FilterZones(zones), ShouldResemble, []*ManagedZone{private})
+	})
+
+	Convey("zones pinned by name or by project and name", func() {
+		So(client.InZones("both", []string{"home-public"}).FilterZones(zones), ShouldResemble, []*ManagedZone{public, other})
+		So(client.InZones("both", []string{"project2/home-public"}).FilterZones(zones), ShouldResemble, []*ManagedZone{other})
+	})
+}
+
+func ZoneForNameSpec() {
+	zones := []*ManagedZone{
+		{Project: "project1", ManagedZone: &dns.ManagedZone{Name: "example", DnsName: "example.com."}},
+		{Project: "project2", ManagedZone: &dns.ManagedZone{Name: "home", DnsName: "home.example.com."}},
+		{Project: "project1", ManagedZone: &dns.ManagedZone{Name: "other", DnsName: "ample.com."}},
+	}
+
+	Convey("zone apex", func() {
+		So(ZoneForName(zones, "example.com.").Name, ShouldEqual, "example")
+	})
+	Convey("subdomain", func() {
+		So(ZoneForName(zones, "www.example.com.").Name, ShouldEqual, "example")
+	})
+	Convey("the most specific zone wins", func() {
+		So(ZoneForName(zones, "nas.home.example.com.").Name, ShouldEqual, "home")
+	})
+	Convey("no matching zone", func() {
+		So(ZoneForName(zones, "example.org."), ShouldBeNil)
+	})
+}
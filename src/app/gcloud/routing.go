@@ -0,0 +1,209 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package gcloud
+
+import (
+	"fmt"
+	"google.golang.org/api/dns/v1"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A record set with a routing policy has no values of its own. Instead, one item of
+// the policy is selected by appending it to the DNS name, for example:
+//
+//	www.example.com.@geo=europe-west1     the item for a location in a geolocation policy
+//	www.example.com.@wrr=1                the item with a weight in a weighted round robin policy
+//	www.example.com.@backup=europe-west1  the backup item for a location in a failover policy
+//
+// Only the values of the selected item are updated; the other items are left as they are.
+
+// SplitRoutingItem splits the DNS name into the name and the selected routing policy item, if any.
+func SplitRoutingItem(name string) (string, string) {
+	name, item, _ := strings.Cut(name, "@")
+	return name, item
+}
+
+type policyItem struct {
+	selector string
+	rrdatas  *[]string
+	// healthChecked items route to internal load balancers instead of having values
+	healthChecked bool
+}
+
+func policyItems(rrset *dns.ResourceRecordSet) []policyItem {
+	var results []policyItem
+	policy := rrset.RoutingPolicy
+	if policy == nil {
+		return results
+	}
+	if policy.Geo != nil {
+		results = append(results, geoItems("geo", policy.Geo)...)
+	}
+	if policy.Wrr != nil {
+		for _, item := range policy.Wrr.Items {
+			results = append(results, policyItem{
+				selector:      "wrr=" + formatWeight(item.Weight),
+				rrdatas:       &item.Rrdatas,
+				healthChecked: item.HealthCheckedTargets != nil,
+			})
+		}
+	}
+	if policy.PrimaryBackup != nil && policy.PrimaryBackup.BackupGeoTargets != nil {
+		results = append(results, geoItems("backup", policy.PrimaryBackup.BackupGeoTargets)...)
+	}
+	return results
+}
+
+func geoItems(kind string, policy *dns.RRSetRoutingPolicyGeoPolicy) []policyItem {
+	var results []policyItem
+	for _, item := range policy.Items {
+		results = append(results, policyItem{
+			selector:      kind + "=" + item.Location,
+			rrdatas:       &item.Rrdatas,
+			healthChecked: item.HealthCheckedTargets != nil,
+		})
+	}
+	return results
+}
+
+func formatWeight(weight float64) string {
+	return strconv.FormatFloat(weight, 'f', -1, 64)
+}
+
+// normalizeSelector makes "wrr=1.0" the same as "wrr=1".
+func normalizeSelector(selector string) string {
+	kind, key, _ := strings.Cut(selector, "=")
+	if kind == "wrr" {
+		if weight, err := strconv.ParseFloat(key, 64); err == nil {
+			return kind + "=" + formatWeight(weight)
+		}
+	}
+	return selector
+}
+
+func findPolicyItem(rrset *dns.ResourceRecordSet, selector string) (*policyItem, error) {
+	if rrset.RoutingPolicy == nil {
+		return nil, fmt.Errorf("%v has no routing policy, so it has no %v item", rrset.Name, selector)
+	}
+	items := policyItems(rrset)
+	var found *policyItem
+	var selectors []string
+	for i, item := range items {
+		selectors = append(selectors, item.selector)
+		if item.selector != normalizeSelector(selector) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%v has many %v items; give each item a different weight or location", rrset.Name, selector)
+		}
+		found = &items[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%v has no %v item; its items are: %v", rrset.Name, selector, strings.Join(selectors, ", "))
+	}
+	if found.healthChecked {
+		return nil, fmt.Errorf("the %v item of %v routes to health-checked load balancers; "+
+			"only items with IP addresses can be updated", selector, rrset.Name)
+	}
+	return found, nil
+}
+
+// selectRoutingItem returns the record for the selected item of its routing policy.
+// A record with a routing policy must always have an item selected.
+func selectRoutingItem(record *DnsRecord, name string, selector string) (*DnsRecord, error) {
+	if selector == "" {
+		if record.RoutingPolicy != nil {
+			return nil, fmt.Errorf("%v has a routing policy; select the item to update by appending it to the name, "+
+				"e.g. %v@geo=<location> or %v@wrr=<weight>", record.Name, name, name)
+		}
+		return record, nil
+	}
+	if _, err := findPolicyItem(record.ResourceRecordSet, selector); err != nil {
+		return nil, err
+	}
+	return &DnsRecord{Project: record.Project, ManagedZone: record.ManagedZone, Visibility: record.Visibility, ResourceRecordSet: record.ResourceRecordSet, Item: normalizeSelector(selector)}, nil
+}
+
+// withItemValues returns a copy of the record set, with the values of the selected item
+// replaced. Without a selected item, the values of the record set itself are replaced.
+func withItemValues(rrset *dns.ResourceRecordSet, selector string, newValues []string) *dns.ResourceRecordSet {
+	result := copyRecordSet(rrset)
+	if selector == "" {
+		result.Rrdatas = newValues
+		return result
+	}
+	if item, err := findPolicyItem(result, selector); err == nil {
+		*item.rrdatas = newValues
+	}
+	return result
+}
+
+// copyRecordSet copies the record set deep enough that the values of its routing policy items can be replaced.
+func copyRecordSet(rrset *dns.ResourceRecordSet) *dns.ResourceRecordSet {
+	result := *rrset
+	if rrset.RoutingPolicy == nil {
+		return &result
+	}
+	policy := *rrset.RoutingPolicy
+	policy.Geo = copyGeoPolicy(policy.Geo)
+	if policy.Wrr != nil {
+		wrr := *policy.Wrr
+		wrr.Items = make([]*dns.RRSetRoutingPolicyWrrPolicyWrrPolicyItem, len(policy.Wrr.Items))
+		for i, item := range policy.Wrr.Items {
+			copied := *item
+			wrr.Items[i] = &copied
+		}
+		policy.Wrr = &wrr
+	}
+	if policy.PrimaryBackup != nil {
+		primaryBackup := *policy.PrimaryBackup
+		primaryBackup.BackupGeoTargets = copyGeoPolicy(primaryBackup.BackupGeoTargets)
+		policy.PrimaryBackup = &primaryBackup
+	}
+	result.RoutingPolicy = &policy
+	return &result
+}
+
+func copyGeoPolicy(policy *dns.RRSetRoutingPolicyGeoPolicy) *dns.RRSetRoutingPolicyGeoPolicy {
+	if policy == nil {
+		return nil
+	}
+	geo := *policy
+	geo.Items = make([]*dns.RRSetRoutingPolicyGeoPolicyGeoPolicyItem, len(policy.Items))
+	for i, item := range policy.Items {
+		copied := *item
+		geo.Items[i] = &copied
+	}
+	return &geo
+}
+
+// changedItem returns the first routing policy item whose values differ between the record sets.
+func changedItem(before *dns.ResourceRecordSet, after *dns.ResourceRecordSet) (string, []string) {
+	oldItems := policyItems(before)
+	for _, item := range policyItems(after) {
+		for _, old := range oldItems {
+			if old.selector == item.selector && !reflect.DeepEqual(sorted(*old.rrdatas), sorted(*item.rrdatas)) {
+				return item.selector, *old.rrdatas
+			}
+		}
+	}
+	return "", nil
+}
+
+// mergeItems returns a copy of the updated record set, with also the changes
+// which the other update made to the items of the original record set.
+func mergeItems(original *dns.ResourceRecordSet, updated *dns.ResourceRecordSet, other *dns.ResourceRecordSet) *dns.ResourceRecordSet {
+	result := copyRecordSet(updated)
+	originalItems := policyItems(original)
+	resultItems := policyItems(result)
+	for i, item := range policyItems(other) {
+		if i < len(originalItems) && !reflect.DeepEqual(*originalItems[i].rrdatas, *item.rrdatas) {
+			*resultItems[i].rrdatas = *item.rrdatas
+		}
+	}
+	return result
+}
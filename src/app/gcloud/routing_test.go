@@ -0,0 +1,127 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package gcloud
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+)
+
+func RoutingPolicySpec() {
+	geo := func() *dns.ResourceRecordSet {
+		return &dns.ResourceRecordSet{Name: "geo.example.com.", Type: "A", RoutingPolicy: &dns.RRSetRoutingPolicy{
+			Geo: &dns.RRSetRoutingPolicyGeoPolicy{Items: []*dns.RRSetRoutingPolicyGeoPolicyGeoPolicyItem{
+				{Location: "europe-west1", Rrdatas: []string{"1.1.1.1"}},
+				{Location: "us-east1", Rrdatas: []string{"2.2.2.2"}},
+				{Location: "asia-east1", HealthCheckedTargets: &dns.RRSetRoutingPolicyHealthCheckTargets{}},
+			}},
+		}}
+	}
+	wrr := &dns.ResourceRecordSet{Name: "wrr.example.com.", Type: "A", RoutingPolicy: &dns.RRSetRoutingPolicy{
+		Wrr: &dns.RRSetRoutingPolicyWrrPolicy{Items: []*dns.RRSetRoutingPolicyWrrPolicyWrrPolicyItem{
+			{Weight: 1, Rrdatas: []string{"1.1.1.1"}},
+			{Weight: 2.5, Rrdatas: []string{"2.2.2.2"}},
+		}},
+	}}
+	failover := &dns.ResourceRecordSet{Name: "failover.example.com.", Type: "A", RoutingPolicy: &dns.RRSetRoutingPolicy{
+		PrimaryBackup: &dns.RRSetRoutingPolicyPrimaryBackupPolicy{
+			PrimaryTargets: &dns.RRSetRoutingPolicyHealthCheckTargets{},
+			BackupGeoTargets: &dns.RRSetRoutingPolicyGeoPolicy{Items: []*dns.RRSetRoutingPolicyGeoPolicyGeoPolicyItem{
+				{Location: "europe-west1", Rrdatas: []string{"1.1.1.1"}},
+			}},
+		},
+	}}
+	records := DnsRecords{
+		{ManagedZone: "zone1", ResourceRecordSet: geo()},
+		{ManagedZone: "zone1", ResourceRecordSet: wrr},
+		{ManagedZone: "zone1", ResourceRecordSet: failover},
+	}
+
+	Convey("the DNS name selects an item of the routing policy", func() {
+		found, err := FindDnsRecords(records, []string{"geo.example.com.@geo=us-east1", "wrr.example.com.@wrr=2.50", "failover.example.com.@backup=europe-west1"}, "A")
+
+		So(err, ShouldBeNil)
+		So(found, ShouldHaveLength, 3)
+		So(found[0].ItemName(), ShouldEqual, "geo.example.com.@geo=us-east1")
+		So(found[0].Values(), ShouldResemble, []string{"2.2.2.2"})
+		So(found[1].ItemName(), ShouldEqual, "wrr.example.com.@wrr=2.5")
+		So(found[1].Values(), ShouldResemble, []string{"2.2.2.2"})
+		So(found[2].ItemName(), ShouldEqual, "failover.example.com.@backup=europe-west1")
+		So(found[2].Values(), ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("updating an item doesn't change the other items", func() {
+		found, _ := FindDnsRecords(records, []string{"geo.example.com.@geo=us-east1"}, "A")
+
+		change := changesToUpdateDnsRecordValues(found, []string{"3.3.3.3"})
+
+		expected := geo()
+		expected.RoutingPolicy.Geo.Items[1].Rrdatas = []string{"3.3.3.3"}
+		So(change.Deletions, ShouldResemble, []*dns.ResourceRecordSet{geo()})
+		So(change.Additions, ShouldResemble, []*dns.ResourceRecordSet{expected})
+		So(records[0].RoutingPolicy.Geo.Items[1].Rrdatas, ShouldResemble, []string{"2.2.2.2"})
+
+		updated := ToDnsRecords("zone1", change)
+		So(updated[0].ItemName(), ShouldEqual, "geo.example.com.@geo=us-east1")
+		So(updated[0].OldRrdatas, ShouldResemble, []string{"2.2.2.2"})
+		So(updated[0].Values(), ShouldResemble, []string{"3.3.3.3"})
+	})
+
+	Convey("an item which is up to date is not updated", func() {
+		found, _ := FindDnsRecords(records, []string{"geo.example.com.@geo=us-east1"}, "A")
+
+		So(changesToUpdateDnsRecordValues(found, []string{"2.2.2.2"}), ShouldBeNil)
+	})
+
+	Convey("many items of the same record set are replaced together", func() {
+		europe, _ := FindDnsRecords(records, []string{"geo.example.com.@geo=europe-west1"}, "A")
+		us, _ := FindDnsRecords(records, []string{"geo.example.com.@geo=us-east1"}, "A")
+		changes := ChangeSet{}
+
+		changes.Update(europe, []string{"3.3.3.3"})
+		changes.Update(us, []string{"4.4.4.4"})
+
+		expected := geo()
+		expected.RoutingPolicy.Geo.Items[0].Rrdatas = []string{"3.3.3.3"}
+		expected.RoutingPolicy.Geo.Items[1].Rrdatas = []string{"4.4.4.4"}
+		So(changes["zone1"].Deletions, ShouldResemble, []*dns.ResourceRecordSet{geo()})
+		So(changes["zone1"].Additions, ShouldResemble, []*dns.ResourceRecordSet{expected})
+	})
+
+	Convey("many items of the same record set are replaced together, even if they were read separately", func() {
+		europe, _ := FindDnsRecords(DnsRecords{{ManagedZone: "zone1", ResourceRecordSet: geo()}}, []string{"geo.example.com.@geo=europe-west1"}, "A")
+		us, _ := FindDnsRecords(DnsRecords{{ManagedZone: "zone1", ResourceRecordSet: geo()}}, []string{"geo.example.com.@geo=us-east1"}, "A")
+		changes := ChangeSet{}
+
+		changes.Update(europe, []string{"3.3.3.3"})
+		changes.Update(us, []string{"4.4.4.4"})
+
+		expected := geo()
+		expected.RoutingPolicy.Geo.Items[0].Rrdatas = []string{"3.3.3.3"}
+		expected.RoutingPolicy.Geo.Items[1].Rrdatas = []string{"4.4.4.4"}
+		So(changes["zone1"].Deletions, ShouldResemble, []*dns.ResourceRecordSet{geo()})
+		So(changes["zone1"].Additions, ShouldResemble, []*dns.ResourceRecordSet{expected})
+	})
+
+	Convey("error: no item selected", func() {
+		_, err := FindDnsRecords(records, []string{"geo.example.com."}, "A")
+
+		So(err, ShouldBeError, "geo.example.com. has a routing policy; select the item to update by appending it to the name, "+
+			"e.g. geo.example.com.@geo=<location> or geo.example.com.@wrr=<weight>")
+	})
+
+	Convey("error: no such item", func() {
+		_, err := FindDnsRecords(records, []string{"geo.example.com.@geo=europe-north1"}, "A")
+
+		So(err, ShouldBeError, "geo.example.com. has no geo=europe-north1 item; its items are: geo=europe-west1, geo=us-east1, geo=asia-east1")
+	})
+
+	Convey("error: health-checked items have no IP addresses", func() {
+		_, err := FindDnsRecords(records, []string{"geo.example.com.@geo=asia-east1"}, "A")
+
+		So(err, ShouldBeError, "the geo=asia-east1 item of geo.example.com. routes to health-checked load balancers; "+
+			"only items with IP addresses can be updated")
+	})
+}
@@ -1,4 +1,4 @@
-module app
+module github.com/luontola/gcp-dynamic-dns/src/app
 
 go 1.20
 
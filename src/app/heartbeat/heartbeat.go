@@ -0,0 +1,135 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package heartbeat writes a TXT record which tells when a site last checked in,
+// so that it can be seen from DNS even when the IP address hasn't changed.
+package heartbeat
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"google.golang.org/api/dns/v1"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Version is written to the heartbeat. It can be set when building, with -ldflags "-X github.com/luontola/gcp-dynamic-dns/src/app/heartbeat.Version=1.6"
+var Version = "dev"
+
+const ttl = 300
+
+type Heartbeat struct {
+	Time    time.Time
+	IPs     []string
+	Version string
+}
+
+func New(now time.Time, ips []string) Heartbeat {
+	return Heartbeat{Time: now.UTC().Truncate(time.Second), IPs: ips, Version: Version}
+}
+
+// Value returns the TXT record value, e.g. "ts=2023-01-01T12:00:00Z; ip=203.0.113.1; version=1.6"
+func (hb Heartbeat) Value() string {
+	return fmt.Sprintf("\"ts=%v; ip=%v; version=%v\"", hb.Time.Format(time.RFC3339), strings.Join(hb.IPs, ","), hb.Version)
+}
+
+// RecordSet returns the TXT record for the heartbeat.
+func (hb Heartbeat) RecordSet(name string) *dns.ResourceRecordSet {
+	return &dns.ResourceRecordSet{
+		Name:    name,
+		Type:    "TXT",
+		Ttl:     ttl,
+		Rrdatas: []string{hb.Value()},
+	}
+}
+
+// Parse reads the heartbeat from the TXT record values.
+func Parse(rrdatas []string) (Heartbeat, error) {
+	for _, rrdata := range rrdatas {
+		var hb Heartbeat
+		found := false
+		for _, field := range strings.Split(strings.Trim(rrdata, "\""), ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "ts":
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return Heartbeat{}, fmt.Errorf("invalid heartbeat timestamp: %w", err)
+				}
+				hb.Time = t
+				found = true
+			case "ip":
+				if value != "" {
+					hb.IPs = strings.Split(value, ",")
+				}
+			case "version":
+				hb.Version = value
+			}
+		}
+		if found {
+			return hb, nil
+		}
+	}
+	return Heartbeat{}, errors.New("not a heartbeat")
+}
+
+// Site is the latest heartbeat of one site.
+type Site struct {
+	Name string
+	Heartbeat
+}
+
+// Sites finds the heartbeats from among all the DNS records, sorted by name.
+func Sites(records gcloud.DnsRecords) []Site {
+	var sites []Site
+	for _, record := range records.OfType("TXT") {
+		hb, err := Parse(record.Rrdatas)
+		if err != nil {
+			continue
+		}
+		sites = append(sites, Site{Name: record.Name, Heartbeat: hb})
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name < sites[j].Name
+	})
+	return sites
+}
+
+func (site Site) Stale(now time.Time, maxAge time.Duration) bool {
+	return now.Sub(site.Time) > maxAge
+}
+
+// PrintSites writes a table of the sites, and returns how many of them are stale.
+func PrintSites(out io.Writer, sites []Site, now time.Time, maxAge time.Duration) int {
+	stale := 0
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLAST SEEN\tAGE\tIP\tVERSION\tSTATUS")
+	for _, site := range sites {
+		status := "ok"
+		if site.Stale(now, maxAge) {
+			status = "STALE"
+			stale++
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			site.Name,
+			site.Time.Format(time.RFC3339),
+			now.Sub(site.Time).Truncate(time.Second),
+			strings.Join(site.IPs, " "),
+			site.Version,
+			status)
+	}
+	_ = w.Flush()
+	if len(sites) == 0 {
+		fmt.Fprintln(out, "\nNo heartbeats found")
+	} else if stale > 0 {
+		fmt.Fprintf(out, "\n%d of %d sites are stale (not seen within %v)\n", stale, len(sites), maxAge)
+	} else {
+		fmt.Fprintf(out, "\nAll %d sites have been seen within %v\n", len(sites), maxAge)
+	}
+	return stale
+}
@@ -0,0 +1,88 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package heartbeat
+
+import (
+	"bytes"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	Convey("HeartbeatSpec", t, HeartbeatSpec)
+	Convey("SitesSpec", t, SitesSpec)
+}
+
+func HeartbeatSpec() {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	Convey("formats the TXT record", func() {
+		hb := Heartbeat{Time: t0, IPs: []string{"1.1.1.1", "2.2.2.2"}, Version: "1.6"}
+
+		So(hb.RecordSet("_dyndns.site1.example.com."), ShouldResemble, &dns.ResourceRecordSet{
+			Name:    "_dyndns.site1.example.com.",
+			Type:    "TXT",
+			Ttl:     300,
+			Rrdatas: []string{`"ts=2023-01-01T12:00:00Z; ip=1.1.1.1,2.2.2.2; version=1.6"`},
+		})
+	})
+
+	Convey("timestamps are in UTC with second precision", func() {
+		hb := New(time.Date(2023, 1, 1, 14, 0, 0, 123, time.FixedZone("EET", 2*60*60)), []string{"1.1.1.1"})
+
+		So(hb.Time, ShouldEqual, t0)
+		So(hb.Version, ShouldEqual, Version)
+	})
+
+	Convey("parses the TXT record", func() {
+		hb, err := Parse([]string{`"ts=2023-01-01T12:00:00Z; ip=1.1.1.1,2.2.2.2; version=1.6"`})
+
+		So(err, ShouldBeNil)
+		So(hb, ShouldResemble, Heartbeat{Time: t0, IPs: []string{"1.1.1.1", "2.2.2.2"}, Version: "1.6"})
+	})
+
+	Convey("error: not a heartbeat", func() {
+		_, err := Parse([]string{`"v=spf1 -all"`})
+
+		So(err, ShouldBeError, "not a heartbeat")
+	})
+}
+
+func SitesSpec() {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := gcloud.DnsRecords{
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "site2.example.com.", Type: "A", Rrdatas: []string{"2.2.2.2"}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "_dyndns.site2.example.com.", Type: "TXT",
+			Rrdatas: []string{`"ts=2023-01-01T08:00:00Z; ip=2.2.2.2; version=1.5"`}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "_dyndns.site1.example.com.", Type: "TXT",
+			Rrdatas: []string{`"ts=2023-01-01T11:55:00Z; ip=1.1.1.1; version=1.6"`}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "example.com.", Type: "TXT", Rrdatas: []string{`"v=spf1 -all"`}}},
+	}
+
+	sites := Sites(records)
+
+	Convey("finds the heartbeat records", func() {
+		So(len(sites), ShouldEqual, 2)
+		So(sites[0].Name, ShouldEqual, "_dyndns.site1.example.com.")
+		So(sites[1].Name, ShouldEqual, "_dyndns.site2.example.com.")
+	})
+
+	Convey("flags stale sites", func() {
+		var out bytes.Buffer
+
+		stale := PrintSites(&out, sites, t0, time.Hour)
+
+		So(stale, ShouldEqual, 1)
+		So(out.String(), ShouldEqual, ""+
+			"NAME                        LAST SEEN             AGE     IP       VERSION  STATUS\n"+
+			"_dyndns.site1.example.com.  2023-01-01T11:55:00Z  5m0s    1.1.1.1  1.6      ok\n"+
+			"_dyndns.site2.example.com.  2023-01-01T08:00:00Z  4h0m0s  2.2.2.2  1.5      STALE\n"+
+			"\n"+
+			"1 of 2 sites are stale (not seen within 1h0m0s)\n")
+	})
+}
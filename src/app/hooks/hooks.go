@@ -0,0 +1,88 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// waitDelay is how long to wait for the output of a cancelled command, in case some
+// process which the command started in the background still keeps the output open
+const waitDelay = time.Second
+
+type Hook struct {
+	Name    string
+	Command []string
+	Timeout time.Duration
+}
+
+type Event struct {
+	OldIP    string
+	NewIP    string
+	DnsNames []string
+}
+
+func (event Event) Environ() []string {
+	return []string{
+		"OLD_IP=" + event.OldIP,
+		"NEW_IP=" + event.NewIP,
+		"DNS_NAMES=" + strings.Join(event.DnsNames, " "),
+	}
+}
+
+func (hook *Hook) Enabled() bool {
+	return len(hook.Command) > 0
+}
+
+// Run executes the hook command and logs its output. Returns an error if the
+// command could not be started, exited with a non-zero status, timed out or was cancelled.
+func (hook *Hook) Run(ctx context.Context, event Event) error {
+	if !hook.Enabled() {
+		return nil
+	}
+	if hook.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hook.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), event.Environ()...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	killProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+
+	log.Printf("Running %v: %v\n", hook.Name, strings.Join(hook.Command, " "))
+	err := cmd.Run()
+	logOutput(hook.Name, &output)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%v timed out after %v", hook.Name, hook.Timeout)
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("%v was cancelled", hook.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("%v failed: %w", hook.Name, err)
+	}
+	return nil
+}
+
+func logOutput(name string, output *bytes.Buffer) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		log.Printf("    [%v] %v\n", name, scanner.Text())
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	Convey("HookSpec", t, HookSpec)
+}
+
+func HookSpec() {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	event := Event{OldIP: "1.1.1.1", NewIP: "2.2.2.2", DnsNames: []string{"foo.example.com.", "bar.example.com."}}
+
+	Convey("does nothing when no command is configured", func() {
+		hook := &Hook{Name: "pre-hook"}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldEqual, "")
+	})
+
+	Convey("passes the IP change to the command as environment variables", func() {
+		hook := &Hook{Name: "post-hook", Command: []string{"sh", "-c", `echo "$OLD_IP -> $NEW_IP ($DNS_NAMES)"`}}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldContainSubstring, "[post-hook] 1.1.1.1 -> 2.2.2.2 (foo.example.com. bar.example.com.)")
+	})
+
+	Convey("logs also the error output", func() {
+		hook := &Hook{Name: "post-hook", Command: []string{"sh", "-c", "echo oops >&2"}}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldContainSubstring, "[post-hook] oops")
+	})
+
+	Convey("error: non-zero exit code", func() {
+		hook := &Hook{Name: "pre-hook", Command: []string{"sh", "-c", "exit 3"}}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeError, "pre-hook failed: exit status 3")
+	})
+
+	Convey("error: command not found", func() {
+		hook := &Hook{Name: "pre-hook", Command: []string{"/no/such/command"}}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("error: timeout", func() {
+		hook := &Hook{Name: "pre-hook", Command: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond}
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeError, "pre-hook timed out after 100ms")
+	})
+
+	Convey("error: timeout kills also the child processes of the command", func() {
+		hook := &Hook{Name: "pre-hook", Command: []string{"sh", "-c", "sleep 10; echo done"}, Timeout: 100 * time.Millisecond}
+		start := time.Now()
+
+		err := hook.Run(context.Background(), event)
+
+		So(err, ShouldBeError, "pre-hook timed out after 100ms")
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		So(logs.String(), ShouldNotContainSubstring, "[pre-hook] done")
+	})
+
+	Convey("error: cancelled", func() {
+		hook := &Hook{Name: "pre-hook", Command: []string{"sleep", "10"}, Timeout: 10 * time.Second}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		err := hook.Run(ctx, event)
+
+		So(err, ShouldBeError, "pre-hook was cancelled")
+	})
+}
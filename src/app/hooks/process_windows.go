@@ -0,0 +1,13 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build windows
+
+package hooks
+
+import "os/exec"
+
+// killProcessGroup does nothing, because Windows has no process groups; only the command itself is killed
+func killProcessGroup(cmd *exec.Cmd) {
+}
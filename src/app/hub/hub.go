@@ -0,0 +1,242 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package hub lets lightweight agents report their IP address to a central hub,
+// which alone holds the Cloud DNS credentials and updates the DNS records.
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const ReportPath = "/api/v1/report"
+
+type DnsUpdater interface {
+	DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error)
+	UpdateDnsRecords(ctx context.Context, records gcloud.DnsRecords, newValues []string) (gcloud.DnsRecords, error)
+}
+
+type Agent struct {
+	Name     string
+	Token    string
+	DnsNames []string
+}
+
+type ReportRequest struct {
+	IP string `json:"ip"`
+}
+
+type ReportResponse struct {
+	Agent   string   `json:"agent"`
+	IP      string   `json:"ip"`
+	Updated []string `json:"updated"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// server
+
+type Server struct {
+	updater DnsUpdater
+	agents  []Agent
+	// IPPolicy decides which addresses may be published, unless the DNS name has its own in NamePolicies
+	IPPolicy     *ip.Policy
+	NamePolicies map[string]*ip.Policy
+	mutex        sync.Mutex
+	nameLocks    map[string]*sync.Mutex
+}
+
+func NewServer(updater DnsUpdater, agents []Agent) *Server {
+	return &Server{
+		updater:   updater,
+		agents:    agents,
+		IPPolicy:  &ip.Policy{},
+		nameLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+func (this *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ReportPath, this.handleReport)
+	return mux
+}
+
+func (this *Server) authenticate(r *http.Request) (*Agent, bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil, false
+	}
+	for i := range this.agents {
+		agent := &this.agents[i]
+		if subtle.ConstantTimeCompare([]byte(token), []byte(agent.Token)) == 1 {
+			return agent, true
+		}
+	}
+	return nil, false
+}
+
+func (this *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResponse(w, http.StatusMethodNotAllowed, &ReportResponse{Error: "method not allowed"})
+		return
+	}
+	agent, ok := this.authenticate(r)
+	if !ok {
+		log.Printf("hub: bad token from %v\n", r.RemoteAddr)
+		writeResponse(w, http.StatusUnauthorized, &ReportResponse{Error: "bad token"})
+		return
+	}
+	var request ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeResponse(w, http.StatusBadRequest, &ReportResponse{Agent: agent.Name, Error: err.Error()})
+		return
+	}
+	address := net.ParseIP(request.IP).To4()
+	if address == nil {
+		writeResponse(w, http.StatusBadRequest, &ReportResponse{Agent: agent.Name, Error: fmt.Sprintf("not an IPv4 address: %q", request.IP)})
+		return
+	}
+	if err := this.checkPolicies(agent, address.String()); err != nil {
+		log.Printf("hub: refusing to publish the IP of agent %v: %v\n", agent.Name, err)
+		writeResponse(w, http.StatusBadRequest, &ReportResponse{Agent: agent.Name, Error: err.Error()})
+		return
+	}
+
+	response := &ReportResponse{Agent: agent.Name, IP: address.String(), Updated: []string{}}
+	updated, err := this.update(r.Context(), agent, response.IP)
+	if err != nil {
+		log.Printf("hub: failed to update DNS records of agent %v: %v\n", agent.Name, err)
+		response.Error = err.Error()
+		writeResponse(w, http.StatusBadGateway, response)
+		return
+	}
+	for _, record := range updated {
+		log.Printf("hub: agent %v updated %v  %v -> %v\n", agent.Name, record.Name, record.OldRrdatas, record.Rrdatas)
+		response.Updated = append(response.Updated, record.Name)
+	}
+	writeResponse(w, http.StatusOK, response)
+}
+
+func (this *Server) checkPolicies(agent *Agent, address string) error {
+	for _, name := range agent.DnsNames {
+		policy, found := this.NamePolicies[name]
+		if !found {
+			policy = this.IPPolicy
+		}
+		if err := policy.Check(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Server) update(ctx context.Context, agent *Agent, ip string) (gcloud.DnsRecords, error) {
+	defer this.lockNames(agent.DnsNames)()
+	newValues := []string{ip}
+	records, err := this.updater.DnsRecordsByNameAndType(ctx, agent.DnsNames, "A")
+	if err != nil {
+		return nil, err
+	}
+	outdated := records.Outdated(newValues)
+	if len(outdated) == 0 {
+		return nil, nil
+	}
+	return this.updater.UpdateDnsRecords(ctx, outdated, newValues)
+}
+
+// lockNames serializes the updates of each DNS name, so that concurrent reports don't overwrite
+// each other's changes, yet a slow update doesn't hold up the agents which have other names.
+// The names are locked in sorted order, so that agents which share names can't deadlock.
+func (this *Server) lockNames(names []string) (unlock func()) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	var locks []*sync.Mutex
+	this.mutex.Lock()
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+		lock, found := this.nameLocks[name]
+		if !found {
+			lock = &sync.Mutex{}
+			this.nameLocks[name] = lock
+		}
+		locks = append(locks, lock)
+	}
+	this.mutex.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, response *ReportResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// client
+
+type Client struct {
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(hubUrl string, token string, httpClient *http.Client) (*Client, error) {
+	if !strings.HasPrefix(hubUrl, "https://") {
+		return nil, fmt.Errorf("the hub URL must use HTTPS, but was: %v", hubUrl)
+	}
+	if token == "" {
+		return nil, errors.New("the agent token is missing")
+	}
+	return &Client{
+		url:        strings.TrimSuffix(hubUrl, "/") + ReportPath,
+		token:      token,
+		httpClient: httpClient,
+	}, nil
+}
+
+func (this *Client) Report(ctx context.Context, ip string) (*ReportResponse, error) {
+	body, err := json.Marshal(&ReportRequest{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+this.token)
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var response ReportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("the hub returned status %v", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the hub returned status %v: %v", resp.Status, response.Error)
+	}
+	return &response, nil
+}
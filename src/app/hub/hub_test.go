@@ -0,0 +1,202 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package hub
+
+import (
+	"context"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	Convey("ReportSpec", t, ReportSpec)
+	Convey("ClientSpec", t, ClientSpec)
+}
+
+type fakeUpdater struct {
+	records map[string][]string
+	// blocked makes reading the records wait until it's closed, after signaling reading
+	blocked chan struct{}
+	reading chan struct{}
+}
+
+func (this *fakeUpdater) DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error) {
+	if this.blocked != nil && names[0] == "site2.example.com." {
+		this.reading <- struct{}{}
+		<-this.blocked
+	}
+	var results gcloud.DnsRecords
+	for _, name := range names {
+		values, found := this.records[name]
+		if !found {
+			return nil, fmt.Errorf("no such record: %v", name)
+		}
+		results = append(results, &gcloud.DnsRecord{
+			ManagedZone:       "zone1",
+			ResourceRecordSet: &dns.ResourceRecordSet{Name: name, Type: recordType, Rrdatas: values}})
+	}
+	return results, nil
+}
+
+func (this *fakeUpdater) UpdateDnsRecords(ctx context.Context, records gcloud.DnsRecords, newValues []string) (gcloud.DnsRecords, error) {
+	var updated gcloud.DnsRecords
+	for _, record := range records {
+		updated = append(updated, &gcloud.DnsRecord{
+			ManagedZone:       record.ManagedZone,
+			OldRrdatas:        this.records[record.Name],
+			ResourceRecordSet: &dns.ResourceRecordSet{Name: record.Name, Type: record.Type, Rrdatas: newValues}})
+		this.records[record.Name] = newValues
+	}
+	return updated, nil
+}
+
+func ReportSpec() {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	updater := &fakeUpdater{records: map[string][]string{
+		"site1.example.com.":     {"1.1.1.1"},
+		"vpn.site1.example.com.": {"2.2.2.2"},
+		"site2.example.com.":     {"3.3.3.3"},
+	}}
+	server := NewServer(updater, []Agent{
+		{Name: "site1", Token: "token1", DnsNames: []string{"site1.example.com.", "vpn.site1.example.com."}},
+		{Name: "site2", Token: "token2", DnsNames: []string{"site2.example.com.", "missing.example.com."}},
+	})
+	hub := httptest.NewTLSServer(server.Handler())
+	defer hub.Close()
+
+	Convey("updates the agent's outdated DNS records", func() {
+		client, err := NewClient(hub.URL, "token1", hub.Client())
+		So(err, ShouldBeNil)
+
+		response, err := client.Report(context.Background(), "2.2.2.2")
+
+		So(err, ShouldBeNil)
+		So(response, ShouldResemble, &ReportResponse{Agent: "site1", IP: "2.2.2.2", Updated: []string{"site1.example.com."}})
+		So(updater.records["site1.example.com."], ShouldResemble, []string{"2.2.2.2"})
+		So(updater.records["site2.example.com."], ShouldResemble, []string{"3.3.3.3"})
+	})
+
+	Convey("nothing to update", func() {
+		client, _ := NewClient(hub.URL, "token1", hub.Client())
+		_, _ = client.Report(context.Background(), "2.2.2.2")
+
+		response, err := client.Report(context.Background(), "2.2.2.2")
+
+		So(err, ShouldBeNil)
+		So(response.Updated, ShouldBeEmpty)
+	})
+
+	Convey("a slow update doesn't hold up the other agents", func() {
+		updater.blocked = make(chan struct{})
+		updater.reading = make(chan struct{})
+		done := make(chan error)
+		go func() {
+			client, _ := NewClient(hub.URL, "token2", hub.Client())
+			_, err := client.Report(context.Background(), "4.4.4.4")
+			done <- err
+		}()
+		<-updater.reading
+
+		client, _ := NewClient(hub.URL, "token1", hub.Client())
+		response, err := client.Report(context.Background(), "2.2.2.2")
+		close(updater.blocked)
+
+		So(err, ShouldBeNil)
+		So(response.Updated, ShouldResemble, []string{"site1.example.com."})
+		So(<-done, ShouldNotBeNil) // missing.example.com. doesn't exist
+	})
+
+	Convey("error: bad token", func() {
+		client, _ := NewClient(hub.URL, "wrong", hub.Client())
+
+		_, err := client.Report(context.Background(), "2.2.2.2")
+
+		So(err, ShouldBeError, "the hub returned status 401 Unauthorized: bad token")
+		So(updater.records["site1.example.com."], ShouldResemble, []string{"1.1.1.1"})
+	})
+
+	Convey("error: not an IPv4 address", func() {
+		client, _ := NewClient(hub.URL, "token1", hub.Client())
+
+		_, err := client.Report(context.Background(), "::1")
+
+		So(err, ShouldBeError, `the hub returned status 400 Bad Request: not an IPv4 address: "::1"`)
+	})
+
+	Convey("error: not a public address", func() {
+		client, _ := NewClient(hub.URL, "token1", hub.Client())
+
+		_, err := client.Report(context.Background(), "10.0.0.1")
+
+		So(err, ShouldBeError, "the hub returned status 400 Bad Request: 10.0.0.1 is a private address (RFC 1918) in the range 10.0.0.0/8, which is not reachable from the internet")
+	})
+
+	Convey("the DNS names' own policies decide which addresses may be published to them", func() {
+		lan, err := ip.NewPolicy([]string{"10.0.0.0/8"}, nil)
+		So(err, ShouldBeNil)
+		server.NamePolicies = map[string]*ip.Policy{"site1.example.com.": lan, "vpn.site1.example.com.": lan}
+		client, _ := NewClient(hub.URL, "token1", hub.Client())
+
+		response, err := client.Report(context.Background(), "10.0.0.1")
+
+		So(err, ShouldBeNil)
+		So(response.Updated, ShouldResemble, []string{"site1.example.com.", "vpn.site1.example.com."})
+	})
+
+	Convey("error: DNS update failed", func() {
+		client, _ := NewClient(hub.URL, "token2", hub.Client())
+
+		_, err := client.Report(context.Background(), "4.4.4.4")
+
+		So(err, ShouldBeError, "the hub returned status 502 Bad Gateway: no such record: missing.example.com.")
+	})
+
+	Convey("error: only POST requests are accepted", func() {
+		resp, err := hub.Client().Get(hub.URL + ReportPath)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+
+		So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func ClientSpec() {
+	Convey("requires HTTPS", func() {
+		_, err := NewClient("http://hub.example.com", "token", http.DefaultClient)
+
+		So(err, ShouldBeError, "the hub URL must use HTTPS, but was: http://hub.example.com")
+	})
+
+	Convey("requires a token", func() {
+		_, err := NewClient("https://hub.example.com", "", http.DefaultClient)
+
+		So(err, ShouldBeError, "the agent token is missing")
+	})
+
+	Convey("error: the hub is not the hub", func() {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.Copy(w, strings.NewReader("<html>Not Found</html>"))
+		}))
+		defer server.Close()
+		client, _ := NewClient(server.URL, "token", server.Client())
+
+		_, err := client.Report(context.Background(), "1.1.1.1")
+
+		So(err, ShouldBeError, "the hub returned status 404 Not Found")
+	})
+}
@@ -0,0 +1,30 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func bindToDeviceSupported() error {
+	return nil
+}
+
+func bindToDevice(name string) func(string, string, syscall.RawConn) error {
+	return func(_ string, _ string, conn syscall.RawConn) error {
+		var bindErr error
+		err := conn.Control(func(fd uintptr) {
+			bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("binding to network interface %v: %w", name, bindErr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build !linux
+
+package ip
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDeviceSupported() error {
+	return errors.New("binding to a network interface is supported only on Linux; use a local address instead")
+}
+
+func bindToDevice(name string) func(string, string, syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return bindToDeviceSupported()
+	}
+}
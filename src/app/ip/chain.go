@@ -0,0 +1,238 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/metrics"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+func init() {
+	metrics.Describe("gcp_dynamic_dns_ip_source_attempts_total", "counter",
+		"Number of times an IP source was tried, by result (success, failure, invalid).")
+	metrics.Describe("gcp_dynamic_dns_ip_source_selected_total", "counter",
+		"Number of times an IP source provided the current IP address.")
+	metrics.Describe("gcp_dynamic_dns_ip_source_cooldown", "gauge",
+		"Whether an IP source is being skipped because it kept failing.")
+}
+
+// DefaultPollInterval is how often the sources without an Interval are polled, when NextPoll decides it.
+const DefaultPollInterval = time.Minute
+
+// Source is one method of detecting the current IP address.
+type Source struct {
+	Name    string
+	Timeout time.Duration
+	// Interval is how often the source may be polled. Until then, its previous result is reused.
+	// Zero means that the source is polled every time.
+	Interval time.Duration
+	Detector Detector
+
+	failures  int
+	skipUntil time.Time
+	polled    bool
+	nextPoll  time.Time
+	address   string
+	err       error
+}
+
+// Chain tries the sources in order, until one of them returns a valid address.
+// A source which keeps failing is skipped for a cool-down period.
+type Chain struct {
+	Sources []*Source
+	// Validate decides whether an address is good enough, or if the next source should be tried
+	Validate func(address string) error
+	// FailureThreshold is how many consecutive failures put a source into cool-down
+	FailureThreshold int
+	Cooldown         time.Duration
+	// Jitter is the most that a source may be polled earlier or later than its Interval
+	Jitter time.Duration
+	now    func() time.Time
+}
+
+func NewChain(sources ...*Source) *Chain {
+	return &Chain{
+		Sources:          sources,
+		Validate:         func(string) error { return nil },
+		FailureThreshold: 3,
+		Cooldown:         5 * time.Minute,
+		now:              time.Now,
+	}
+}
+
+// Names returns the names of the sources, separated by space.
+func (chain *Chain) Names() string {
+	var names []string
+	for _, source := range chain.Sources {
+		names = append(names, source.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// Detect returns the first valid address and the name of the source which returned it.
+// If no source returned a valid address, the first invalid one is returned, so that
+// the caller can explain why it won't be used.
+func (chain *Chain) Detect(ctx context.Context) (string, string, error) {
+	var errs []string
+	var invalidAddress, invalidSource string
+	attempted := false
+	now := chain.now()
+	for i, source := range chain.Sources {
+		// when all sources are in cool-down, the last one is tried anyway, so that there is some chance of success
+		last := i == len(chain.Sources)-1
+		if now.Before(source.skipUntil) && !(last && !attempted) {
+			errs = append(errs, fmt.Sprintf("%v: skipped until %v", source.Name, source.skipUntil.Format(time.RFC3339)))
+			continue
+		}
+		attempted = true
+		if now.Before(source.nextPoll) {
+			// the source was polled less than its interval ago
+			address, err := source.address, source.err
+			if err == nil {
+				err = chain.Validate(address)
+			}
+			if err == nil {
+				return address, source.Name, nil
+			}
+			if source.err == nil && invalidAddress == "" {
+				invalidAddress, invalidSource = address, source.Name
+			}
+			errs = append(errs, fmt.Sprintf("%v: %v", source.Name, err))
+			continue
+		}
+		address, err := runWithTimeout(ctx, source.Detector, source.Timeout)
+		if ctx.Err() != nil {
+			// the caller gave up, so the source is not at fault
+			return "", "", ctx.Err()
+		}
+		chain.remember(source, address, err, now)
+		if err == nil {
+			if err = chain.Validate(address); err != nil {
+				metrics.Inc("gcp_dynamic_dns_ip_source_attempts_total", "source", source.Name, "result", "invalid")
+				if invalidAddress == "" {
+					invalidAddress, invalidSource = address, source.Name
+				}
+			}
+		} else {
+			metrics.Inc("gcp_dynamic_dns_ip_source_attempts_total", "source", source.Name, "result", "failure")
+		}
+		if err != nil {
+			chain.recordFailure(source, now)
+			if len(chain.Sources) > 1 {
+				log.Printf("WARN: IP source %v failed: %v\n", source.Name, err)
+			}
+			errs = append(errs, fmt.Sprintf("%v: %v", source.Name, err))
+			continue
+		}
+		metrics.Inc("gcp_dynamic_dns_ip_source_attempts_total", "source", source.Name, "result", "success")
+		metrics.Inc("gcp_dynamic_dns_ip_source_selected_total", "source", source.Name)
+		chain.recordSuccess(source)
+		return address, source.Name, nil
+	}
+	if invalidAddress != "" {
+		metrics.Inc("gcp_dynamic_dns_ip_source_selected_total", "source", invalidSource)
+		return invalidAddress, invalidSource, nil
+	}
+	if len(chain.Sources) == 1 {
+		// keep the error message the same as before there were multiple sources
+		_, msg, _ := strings.Cut(errs[0], ": ")
+		return "", "", errors.New(msg)
+	}
+	return "", "", fmt.Errorf("all IP sources failed: %v", strings.Join(errs, "; "))
+}
+
+func (chain *Chain) remember(source *Source, address string, err error, now time.Time) {
+	source.polled = true
+	source.address, source.err = address, err
+	if source.Interval > 0 {
+		interval := source.Interval
+		if chain.Jitter > 0 {
+			interval += time.Duration(rand.Int63n(int64(2*chain.Jitter)+1)) - chain.Jitter
+		}
+		source.nextPoll = now.Add(interval)
+	}
+}
+
+// NextPoll returns when Detect will poll some source, instead of reusing their previous results.
+// The sources after the first one which works are not polled, so their intervals don't matter.
+func (chain *Chain) NextPoll() time.Time {
+	var next time.Time
+	for _, source := range chain.Sources {
+		if !source.polled {
+			return chain.now()
+		}
+		due := source.nextPoll
+		if source.Interval <= 0 {
+			due = chain.now().Add(DefaultPollInterval)
+		}
+		if due.Before(source.skipUntil) {
+			due = source.skipUntil
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+		if source.err == nil && chain.Validate(source.address) == nil {
+			break
+		}
+	}
+	return next
+}
+
+// PollNow makes the next Detect poll the sources, even if they were polled less than their interval ago.
+func (chain *Chain) PollNow() {
+	for _, source := range chain.Sources {
+		source.nextPoll = time.Time{}
+	}
+}
+
+func (chain *Chain) recordFailure(source *Source, now time.Time) {
+	source.failures++
+	if chain.FailureThreshold > 0 && source.failures >= chain.FailureThreshold && len(chain.Sources) > 1 {
+		source.skipUntil = now.Add(chain.Cooldown)
+		source.failures = 0
+		metrics.Set("gcp_dynamic_dns_ip_source_cooldown", 1, "source", source.Name)
+		log.Printf("WARN: IP source %v failed %d times in a row; skipping it for %v\n", source.Name, chain.FailureThreshold, chain.Cooldown)
+	}
+}
+
+func (chain *Chain) recordSuccess(source *Source) {
+	source.failures = 0
+	source.skipUntil = time.Time{}
+	metrics.Set("gcp_dynamic_dns_ip_source_cooldown", 0, "source", source.Name)
+}
+
+// runWithTimeout cancels the detector's context after the timeout, and doesn't wait for
+// the detectors which ignore the context.
+func runWithTimeout(ctx context.Context, detector Detector, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return detector.DetectIP(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		address string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		address, err := detector.DetectIP(ctx)
+		done <- result{address, err}
+	}()
+	select {
+	case r := <-done:
+		return r.address, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("timed out after %v", timeout)
+	}
+}
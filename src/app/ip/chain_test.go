@@ -0,0 +1,220 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	Convey("ChainSpec", t, ChainSpec)
+}
+
+type fakeSource struct {
+	address string
+	err     error
+	delay   time.Duration
+	calls   int
+}
+
+func (this *fakeSource) DetectIP(context.Context) (string, error) {
+	this.calls++
+	time.Sleep(this.delay)
+	return this.address, this.err
+}
+
+func ChainSpec() {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	upnp := &fakeSource{address: "1.1.1.1"}
+	stun := &fakeSource{address: "2.2.2.2"}
+	service := &fakeSource{address: "3.3.3.3"}
+	chain := NewChain(
+		&Source{Name: "upnp", Detector: upnp},
+		&Source{Name: "stun", Detector: stun},
+		&Source{Name: "service", Detector: service},
+	)
+	chain.now = func() time.Time { return now }
+
+	Convey("the first source which works wins", func() {
+		address, source, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "1.1.1.1")
+		So(source, ShouldEqual, "upnp")
+		So(stun.calls, ShouldEqual, 0)
+	})
+
+	Convey("falls back to the next source on failure", func() {
+		upnp.err = errors.New("no UPnP services found")
+
+		address, source, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "2.2.2.2")
+		So(source, ShouldEqual, "stun")
+	})
+
+	Convey("falls back to the next source if the address is not valid", func() {
+		upnp.address = "192.168.1.1"
+		chain.Validate = (&Policy{}).Check
+
+		address, source, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "2.2.2.2")
+		So(source, ShouldEqual, "stun")
+	})
+
+	Convey("if no source returns a valid address, returns the first invalid address", func() {
+		upnp.address = "192.168.1.1"
+		stun.address = "100.64.0.1"
+		service.err = errors.New("boom")
+		chain.Validate = (&Policy{}).Check
+
+		address, source, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "192.168.1.1")
+		So(source, ShouldEqual, "upnp")
+	})
+
+	Convey("falls back to the next source on timeout", func() {
+		chain.Sources[0].Timeout = 10 * time.Millisecond
+		upnp.delay = time.Second
+
+		address, _, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "2.2.2.2")
+	})
+
+	Convey("error: all sources failed", func() {
+		upnp.err = errors.New("e1")
+		stun.err = errors.New("e2")
+		service.err = errors.New("e3")
+
+		_, _, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeError, "all IP sources failed: upnp: e1; stun: e2; service: e3")
+	})
+
+	Convey("error: a single source returns its own error", func() {
+		chain := NewChain(&Source{Name: "upnp", Detector: upnp})
+		upnp.err = errors.New("no UPnP services found")
+
+		_, _, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeError, "no UPnP services found")
+	})
+
+	Convey("stops when the context is cancelled, without counting it as a failure of the source", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := chain.Detect(ctx)
+
+		So(err, ShouldEqual, context.Canceled)
+		So(stun.calls, ShouldEqual, 0)
+		So(chain.Sources[0].failures, ShouldEqual, 0)
+	})
+
+	Convey("a source which keeps failing is skipped for a cool-down period", func() {
+		upnp.err = errors.New("no UPnP services found")
+		for i := 0; i < chain.FailureThreshold; i++ {
+			_, _, _ = chain.Detect(context.Background())
+		}
+		So(upnp.calls, ShouldEqual, chain.FailureThreshold)
+
+		_, source, _ := chain.Detect(context.Background())
+		So(source, ShouldEqual, "stun")
+		So(upnp.calls, ShouldEqual, chain.FailureThreshold)
+
+		now = now.Add(chain.Cooldown)
+		upnp.err = nil
+		_, source, _ = chain.Detect(context.Background())
+		So(source, ShouldEqual, "upnp")
+	})
+
+	Convey("when all sources are in cool-down, the last one is tried anyway", func() {
+		upnp.err = errors.New("e1")
+		stun.err = errors.New("e2")
+		service.err = errors.New("e3")
+		for i := 0; i < chain.FailureThreshold; i++ {
+			_, _, _ = chain.Detect(context.Background())
+		}
+		service.err = nil
+
+		address, source, err := chain.Detect(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "3.3.3.3")
+		So(source, ShouldEqual, "service")
+		So(upnp.calls, ShouldEqual, chain.FailureThreshold)
+	})
+
+	Convey("each source is polled at its own interval", func() {
+		chain = NewChain(
+			&Source{Name: "upnp", Interval: time.Minute, Detector: upnp},
+			&Source{Name: "service", Interval: 5 * time.Minute, Detector: service},
+		)
+		chain.now = func() time.Time { return now }
+		start := now
+
+		Convey("a fallback is polled at its own interval, while the sources before it fail", func() {
+			upnp.err = errors.New("no UPnP services found")
+			address, _, _ := chain.Detect(context.Background())
+			So(address, ShouldEqual, "3.3.3.3")
+			So(chain.NextPoll(), ShouldEqual, start.Add(time.Minute))
+
+			now = start.Add(time.Minute)
+			service.address = "4.4.4.4"
+			address, source, err := chain.Detect(context.Background())
+			So(err, ShouldBeNil)
+			So(address, ShouldEqual, "3.3.3.3")
+			So(source, ShouldEqual, "service")
+			So(upnp.calls, ShouldEqual, 2)
+			So(service.calls, ShouldEqual, 1)
+
+			now = start.Add(5 * time.Minute)
+			address, _, _ = chain.Detect(context.Background())
+			So(address, ShouldEqual, "4.4.4.4")
+			So(upnp.calls, ShouldEqual, 3)
+			So(service.calls, ShouldEqual, 2)
+		})
+
+		Convey("the fallbacks don't affect the next poll, while the first source works", func() {
+			_, _, _ = chain.Detect(context.Background())
+			So(chain.NextPoll(), ShouldEqual, start.Add(time.Minute))
+
+			now = start.Add(30 * time.Second)
+			upnp.address = "5.5.5.5"
+			address, _, _ := chain.Detect(context.Background())
+			So(address, ShouldEqual, "1.1.1.1")
+			So(upnp.calls, ShouldEqual, 1)
+			So(service.calls, ShouldEqual, 0)
+		})
+
+		Convey("PollNow polls the sources before their interval has passed", func() {
+			_, _, _ = chain.Detect(context.Background())
+			upnp.address = "5.5.5.5"
+
+			chain.PollNow()
+			address, _, _ := chain.Detect(context.Background())
+
+			So(address, ShouldEqual, "5.5.5.5")
+			So(upnp.calls, ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Detector is one method of detecting the current IP address.
+type Detector interface {
+	DetectIP(ctx context.Context) (string, error)
+}
+
+// DetectorFunc lets an ordinary function be used as a Detector.
+type DetectorFunc func(ctx context.Context) (string, error)
+
+func (detect DetectorFunc) DetectIP(ctx context.Context) (string, error) {
+	return detect(ctx)
+}
+
+// Settings are the settings of a WAN link which the detectors may need.
+type Settings struct {
+	Network *Network
+	// ServiceUrl returns the external service to use next
+	ServiceUrl    func() string
+	InterfaceName string
+	StunServers   []string
+}
+
+// Factory creates a detector for a WAN link. Each link gets its own detector, so that the detector may keep state.
+type Factory func(settings Settings) Detector
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a detection method available as a MODE. Registering the same mode again replaces it.
+func Register(mode string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[mode] = factory
+}
+
+// Modes returns the registered modes in alphabetical order.
+func Modes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var modes []string
+	for mode := range factories {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// NewDetector creates a detector for the mode.
+func NewDetector(mode string, settings Settings) (Detector, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[mode]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %q; the available modes are: %v", mode, strings.Join(Modes(), ", "))
+	}
+	if settings.Network == nil {
+		settings.Network = &Network{}
+	}
+	return factory(settings), nil
+}
+
+func init() {
+	Register("service", newServiceDetector)
+	Register("interface", newInterfaceDetector)
+	Register("upnp", func(Settings) Detector { return NewUpnpRouter() })
+	Register("stun", newStunDetector)
+}
+
+func newServiceDetector(settings Settings) Detector {
+	return DetectorFunc(func(ctx context.Context) (string, error) {
+		url := settings.ServiceUrl()
+		currentIP, err := settings.Network.ExternalServiceIPContext(ctx, url)
+		if err != nil {
+			err = fmt.Errorf("failure using external service %v: %w", RedactServiceUrl(url), err)
+		}
+		return currentIP, err
+	})
+}
+
+func newInterfaceDetector(settings Settings) Detector {
+	// the CGNAT warning is logged once per address, instead of on every poll
+	var warnedCGNAT string
+	return DetectorFunc(func(ctx context.Context) (string, error) {
+		var currentIP string
+		var err error
+		if name := settings.InterfaceName; name != "" {
+			currentIP, err = InterfaceIP(name)
+		} else {
+			currentIP, err = settings.Network.OutgoingIP()
+		}
+		if err == nil && IsCGNAT(currentIP) && currentIP != warnedCGNAT {
+			warnedCGNAT = currentIP
+			log.Printf("WARN: The network interface has a CGNAT address %v, so your ISP is sharing one public IP "+
+				"between many customers, and this address cannot be reached from the internet. "+
+				"Ask your ISP for a public IP address, or use MODE=service to detect the shared public IP.\n", currentIP)
+		}
+		return currentIP, err
+	})
+}
+
+func newStunDetector(settings Settings) Detector {
+	return DetectorFunc(func(ctx context.Context) (string, error) {
+		var errs []string
+		for _, server := range settings.StunServers {
+			currentIP, err := settings.Network.StunIPContext(ctx, server)
+			if err == nil {
+				return currentIP, nil
+			}
+			errs = append(errs, fmt.Sprintf("failure using STUN server %v: %v", server, err))
+		}
+		return "", errors.New(strings.Join(errs, "; "))
+	})
+}
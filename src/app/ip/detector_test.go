@@ -0,0 +1,90 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDetector(t *testing.T) {
+	Convey("DetectorSpec", t, DetectorSpec)
+}
+
+func DetectorSpec() {
+	Convey("the built-in modes are registered", func() {
+		So(Modes(), ShouldResemble, []string{"interface", "service", "stun", "upnp"})
+	})
+
+	Convey("new modes can be registered", func() {
+		Register("fixed", func(Settings) Detector {
+			return DetectorFunc(func(context.Context) (string, error) {
+				return "192.0.2.1", nil
+			})
+		})
+		defer func() {
+			factoriesMu.Lock()
+			delete(factories, "fixed")
+			factoriesMu.Unlock()
+		}()
+
+		detector, err := NewDetector("fixed", Settings{})
+		So(err, ShouldBeNil)
+		address, err := detector.DetectIP(context.Background())
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "192.0.2.1")
+	})
+
+	Convey("each WAN link gets its own detector", func() {
+		a, err := NewDetector("upnp", Settings{})
+		So(err, ShouldBeNil)
+		b, err := NewDetector("upnp", Settings{})
+		So(err, ShouldBeNil)
+
+		So(a, ShouldNotPointTo, b)
+	})
+
+	Convey("the service mode uses the link's next service URL", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("192.0.2.2"))
+		}))
+		defer server.Close()
+		detector, err := NewDetector("service", Settings{ServiceUrl: func() string { return server.URL }})
+		So(err, ShouldBeNil)
+
+		address, err := detector.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(address, ShouldEqual, "192.0.2.2")
+	})
+
+	Convey("the detector's context is cancelled on timeout", func() {
+		cancelled := make(chan struct{})
+		detector := DetectorFunc(func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return "", ctx.Err()
+		})
+
+		_, err := runWithTimeout(context.Background(), detector, 10*time.Millisecond)
+
+		So(err, ShouldBeError, "timed out after 10ms")
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			So("context was not cancelled", ShouldBeEmpty)
+		}
+	})
+
+	Convey("error: unknown mode", func() {
+		_, err := NewDetector("carrier-pigeon", Settings{})
+
+		So(err, ShouldBeError, `unknown mode "carrier-pigeon"; the available modes are: interface, service, stun, upnp`)
+	})
+}
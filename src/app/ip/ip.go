@@ -8,43 +8,83 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/huin/goupnp"
 	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/httpu"
+	"github.com/huin/goupnp/ssdp"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"net"
 	"net/http"
-	"regexp"
+	"net/url"
+	"sync"
 	"time"
 )
 
-func ExternalServiceIP(url string) (string, error) {
-	client := &http.Client{
-		Timeout: time.Minute,
+func ExternalServiceIP(serviceUrl string) (string, error) {
+	return (&Network{}).ExternalServiceIP(serviceUrl)
+}
+
+// DefaultServiceTimeout is how long ExternalServiceIP waits for the service to respond.
+const DefaultServiceTimeout = time.Minute
+
+func (network *Network) ExternalServiceIP(serviceUrl string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultServiceTimeout)
+	defer cancel()
+	return network.ExternalServiceIPContext(ctx, serviceUrl)
+}
+
+// ExternalServiceIPContext is like ExternalServiceIP, but instead of a fixed timeout,
+// it gives up when the context is done.
+func (network *Network) ExternalServiceIPContext(ctx context.Context, serviceUrl string) (string, error) {
+	service, err := ParseService(serviceUrl)
+	if err != nil {
+		return "", err
 	}
-	response, err := client.Get(url)
+	client, err := network.HTTPClient(0)
 	if err != nil {
 		return "", err
 	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, service.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range service.RequestHeaders {
+		request.Header[name] = values
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactServiceUrl(urlErr.URL)
+		}
+		return "", err
+	}
 	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		return "", fmt.Errorf("the server returned status %v", response.Status)
 	}
+	if err := service.checkContentType(response); err != nil {
+		return "", err
+	}
 	bodyBytes, err := io.ReadAll(response.Body)
 	if err != nil {
 		return "", err
 	}
-	body := string(bodyBytes)
-
-	ipAddressPattern := regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
-	found := ipAddressPattern.FindString(body)
-	if found != "" && net.ParseIP(found) != nil {
-		return found, nil
-	}
-	return "", fmt.Errorf("the response did not contain an IP address: %v", body)
+	return service.Parse(response, string(bodyBytes))
 }
 
 func OutgoingIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	return (&Network{}).OutgoingIP()
+}
+
+// OutgoingIP returns the local address which is used for connecting to the internet.
+// No packets are sent.
+func (network *Network) OutgoingIP() (string, error) {
+	if err := network.Validate(); err != nil {
+		return "", err
+	}
+	conn, err := network.dialer("udp", false).Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		return "", err
 	}
@@ -79,27 +119,32 @@ type RouterClient interface {
 		NewExternalIPAddress string,
 		err error,
 	)
+	GetExternalIPAddressCtx(ctx context.Context) (
+		NewExternalIPAddress string,
+		err error,
+	)
 }
 
-func detectRouterClients(ctx context.Context) ([]RouterClient, error) {
-	tasks, _ := errgroup.WithContext(ctx)
+// DetectRouterClients discovers all UPnP internet gateway services in the local network.
+func DetectRouterClients(ctx context.Context) ([]RouterClient, error) {
+	tasks, ctx := errgroup.WithContext(ctx)
 	// request each type of client in parallel
 	var ip1Clients []*internetgateway2.WANIPConnection1
 	tasks.Go(func() error {
 		var err error
-		ip1Clients, _, err = internetgateway2.NewWANIPConnection1Clients()
+		ip1Clients, _, err = internetgateway2.NewWANIPConnection1ClientsCtx(ctx)
 		return err
 	})
 	var ip2Clients []*internetgateway2.WANIPConnection2
 	tasks.Go(func() error {
 		var err error
-		ip2Clients, _, err = internetgateway2.NewWANIPConnection2Clients()
+		ip2Clients, _, err = internetgateway2.NewWANIPConnection2ClientsCtx(ctx)
 		return err
 	})
 	var ppp1Clients []*internetgateway2.WANPPPConnection1
 	tasks.Go(func() error {
 		var err error
-		ppp1Clients, _, err = internetgateway2.NewWANPPPConnection1Clients()
+		ppp1Clients, _, err = internetgateway2.NewWANPPPConnection1ClientsCtx(ctx)
 		return err
 	})
 
@@ -107,6 +152,12 @@ func detectRouterClients(ctx context.Context) ([]RouterClient, error) {
 		return nil, err
 	}
 
+	return routerClientList(ip2Clients, ip1Clients, ppp1Clients)
+}
+
+// routerClientList orders the clients by preference: WANIPConnection2 is the newest
+// version of the service, and WANPPPConnection1 is the least common.
+func routerClientList(ip2Clients []*internetgateway2.WANIPConnection2, ip1Clients []*internetgateway2.WANIPConnection1, ppp1Clients []*internetgateway2.WANPPPConnection1) ([]RouterClient, error) {
 	var clients []RouterClient
 	for _, client := range ip2Clients {
 		clients = append(clients, client)
@@ -123,26 +174,96 @@ func detectRouterClients(ctx context.Context) ([]RouterClient, error) {
 	return clients, nil
 }
 
-var routerClients []RouterClient
+// RouterClientsByURL returns the internet gateway services of the device whose description is at the location.
+func RouterClientsByURL(ctx context.Context, location *url.URL) ([]RouterClient, error) {
+	root, err := goupnp.DeviceByURLCtx(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	// the device doesn't need to have all types of services, so the errors about missing services are ignored
+	ip2Clients, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(root, location)
+	ip1Clients, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(root, location)
+	ppp1Clients, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(root, location)
+	return routerClientList(ip2Clients, ip1Clients, ppp1Clients)
+}
+
+// DetectRouterClientsAt discovers the UPnP internet gateway services by sending the SSDP search
+// to the address, instead of multicasting it to the local network.
+func DetectRouterClientsAt(ctx context.Context, ssdpAddress string) ([]RouterClient, error) {
+	client, err := httpu.NewHTTPUClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	request := (&http.Request{
+		Method: "M-SEARCH",
+		Host:   ssdpAddress,
+		URL:    &url.URL{Opaque: "*"},
+		Header: http.Header{
+			"HOST": []string{ssdpAddress},
+			"MX":   []string{"1"},
+			"MAN":  []string{`"ssdp:discover"`},
+			"ST":   []string{ssdp.UPNPRootDevice},
+		},
+	}).WithContext(ctx)
+	responses, err := client.Do(request, time.Second, 1)
+	if err != nil {
+		return nil, err
+	}
+	var clients []RouterClient
+	for _, response := range responses {
+		location, err := response.Location()
+		if err != nil {
+			continue
+		}
+		found, err := RouterClientsByURL(ctx, location)
+		if err == nil {
+			clients = append(clients, found...)
+		}
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no UPnP services found at %v", ssdpAddress)
+	}
+	return clients, nil
+}
+
+// UpnpRouter asks the router for the current IP address using UPnP. It detects the internet
+// gateway only once, and then keeps using the gateway's service which worked.
+type UpnpRouter struct {
+	// Discover finds the internet gateway services
+	Discover func(ctx context.Context) ([]RouterClient, error)
+	mu       sync.Mutex
+	clients  []RouterClient
+}
+
+func NewUpnpRouter() *UpnpRouter {
+	return &UpnpRouter{Discover: DetectRouterClients}
+}
 
 func UpnpRouterIP() (string, error) {
+	return NewUpnpRouter().DetectIP(context.Background())
+}
+
+func (router *UpnpRouter) DetectIP(ctx context.Context) (string, error) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
 	var err error
-	if routerClients == nil { // detect the internet gateway only once
-		routerClients, err = detectRouterClients(context.Background())
+	if router.clients == nil { // detect the internet gateway only once
+		router.clients, err = router.Discover(ctx)
 		if err != nil {
 			return "", err
 		}
 	}
 	// if multiple clients were found, try them all until one which works was found
-	for _, routerClient := range routerClients {
+	for _, routerClient := range router.clients {
 		var ip string
-		ip, err = routerClient.GetExternalIPAddress()
+		ip, err = routerClient.GetExternalIPAddressCtx(ctx)
 		if err == nil && ip != "" { // sometimes the IP is an empty string even though there is no error
-			routerClients = []RouterClient{routerClient} // remember the client which worked and keep using only it
+			router.clients = []RouterClient{routerClient} // remember the client which worked and keep using only it
 			return ip, nil
 		}
 	}
 	// none of the clients worked
-	routerClients = nil // re-detect the internet gateway to improve resiliency
+	router.clients = nil // re-detect the internet gateway to improve resiliency
 	return "", fmt.Errorf("could not get the external IP address through UPnP: %w", err)
 }
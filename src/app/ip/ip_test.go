@@ -5,8 +5,13 @@
 package ip
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/luontola/gcp-dynamic-dns/src/app/fakeupnp"
 	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
 	"regexp"
 	"testing"
 )
@@ -18,6 +23,11 @@ func TestIP(t *testing.T) {
 	Convey("UpnpRouterIPSpec", t, UpnpRouterIPSpec)
 }
 
+// TestUpnp uses a fake gateway on localhost, so unlike TestIP it doesn't need the internet.
+func TestUpnp(t *testing.T) {
+	Convey("UpnpRouterClientsSpec", t, UpnpRouterClientsSpec)
+}
+
 func ExternalServiceIPSpec() {
 	Convey("automatically detects the IP address by calling an external service", func() {
 		Convey("response body contains only the IP address", func() {
@@ -82,6 +92,122 @@ func UpnpRouterIPSpec() {
 	})
 }
 
+func UpnpRouterClientsSpec() {
+	gateway := fakeupnp.New(fakeupnp.WANIPConnection1, fakeupnp.WANIPConnection2, fakeupnp.WANPPPConnection1)
+	So(gateway.Listen(), ShouldBeNil)
+	Reset(gateway.Close)
+	gateway.SetAnswer(fakeupnp.WANIPConnection1, fakeupnp.Answer{IP: "192.0.2.1"})
+	gateway.SetAnswer(fakeupnp.WANIPConnection2, fakeupnp.Answer{IP: "192.0.2.2"})
+	gateway.SetAnswer(fakeupnp.WANPPPConnection1, fakeupnp.Answer{IP: "192.0.2.3"})
+
+	location, err := url.Parse(gateway.Location())
+	So(err, ShouldBeNil)
+	discoveries := 0
+	router := &UpnpRouter{Discover: func(ctx context.Context) ([]RouterClient, error) {
+		discoveries++
+		return RouterClientsByURL(ctx, location)
+	}}
+
+	Convey("discovers the gateway with SSDP", func() {
+		clients, err := DetectRouterClientsAt(context.Background(), gateway.SSDPAddress())
+
+		So(err, ShouldBeNil)
+		So(gateway.Searches(), ShouldEqual, 1)
+		So(clients, ShouldHaveLength, 3)
+		So(clients[0], ShouldHaveSameTypeAs, &internetgateway2.WANIPConnection2{})
+		So(clients[1], ShouldHaveSameTypeAs, &internetgateway2.WANIPConnection1{})
+		So(clients[2], ShouldHaveSameTypeAs, &internetgateway2.WANPPPConnection1{})
+	})
+
+	Convey("a device without internet gateway services is not a router", func() {
+		empty := fakeupnp.New()
+		So(empty.Listen(), ShouldBeNil)
+		defer empty.Close()
+
+		_, err := DetectRouterClientsAt(context.Background(), empty.SSDPAddress())
+
+		So(err, ShouldBeError, "no UPnP services found at "+empty.SSDPAddress())
+	})
+
+	Convey("prefers the WANIPConnection2 service", func() {
+		ip, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "192.0.2.2")
+		So(gateway.Calls(fakeupnp.WANIPConnection1), ShouldEqual, 0)
+	})
+
+	Convey("tries the next service if one fails", func() {
+		gateway.SetAnswer(fakeupnp.WANIPConnection2, fakeupnp.Answer{Fault: "Action Failed"})
+
+		ip, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "192.0.2.1")
+	})
+
+	Convey("tries the next service if one returns an empty IP without an error", func() {
+		gateway.SetAnswer(fakeupnp.WANIPConnection2, fakeupnp.Answer{IP: ""})
+		gateway.SetAnswer(fakeupnp.WANIPConnection1, fakeupnp.Answer{IP: ""})
+
+		ip, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "192.0.2.3")
+	})
+
+	Convey("keeps using the service which worked, without detecting the gateway again", func() {
+		gateway.SetAnswer(fakeupnp.WANIPConnection2, fakeupnp.Answer{Fault: "Action Failed"})
+		_, err := router.DetectIP(context.Background())
+		So(err, ShouldBeNil)
+
+		ip, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "192.0.2.1")
+		So(discoveries, ShouldEqual, 1)
+		So(gateway.Calls(fakeupnp.WANIPConnection2), ShouldEqual, 1)
+		So(gateway.Calls(fakeupnp.WANIPConnection1), ShouldEqual, 2)
+	})
+
+	Convey("each router detects the gateway by itself", func() {
+		_, err := router.DetectIP(context.Background())
+		So(err, ShouldBeNil)
+		other := &UpnpRouter{Discover: router.Discover}
+
+		_, err = other.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(discoveries, ShouldEqual, 2)
+	})
+
+	Convey("detects the gateway again if none of the services work", func() {
+		for _, service := range []string{fakeupnp.WANIPConnection1, fakeupnp.WANIPConnection2, fakeupnp.WANPPPConnection1} {
+			gateway.SetAnswer(service, fakeupnp.Answer{Fault: "Action Failed"})
+		}
+		_, err := router.DetectIP(context.Background())
+		So(err.Error(), ShouldStartWith, "could not get the external IP address through UPnP: ")
+		So(err.Error(), ShouldContainSubstring, "Action Failed")
+
+		gateway.SetAnswer(fakeupnp.WANIPConnection1, fakeupnp.Answer{IP: "192.0.2.1"})
+		ip, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "192.0.2.1")
+		So(discoveries, ShouldEqual, 2)
+	})
+
+	Convey("error: the gateway is not found", func() {
+		router.Discover = func(ctx context.Context) ([]RouterClient, error) {
+			return nil, errors.New("no UPnP services found")
+		}
+
+		_, err := router.DetectIP(context.Background())
+
+		So(err, ShouldBeError, "no UPnP services found")
+	})
+}
+
 const IpAddress = `^\d+\.\d+\.\d+.\d+$`
 
 func ShouldMatchPattern(actual interface{}, expected ...interface{}) string {
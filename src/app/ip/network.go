@@ -0,0 +1,157 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Network decides how the IP detection connects to the internet.
+// On a multi-homed host, it can be used to choose which uplink to detect.
+// The zero value uses the operating system's defaults.
+type Network struct {
+	// LocalAddress is the source address of outgoing connections
+	LocalAddress string
+	// Interface is the network device which outgoing connections are bound to (SO_BINDTODEVICE, only on Linux)
+	Interface string
+	// Proxy is an http://, https:// or socks5:// URL. It's used only for HTTP requests, not for STUN.
+	Proxy string
+	// Resolver is the host:port of the DNS server which is used for resolving host names
+	Resolver string
+}
+
+// Validate checks the settings without connecting anywhere.
+func (network *Network) Validate() error {
+	if network.LocalAddress != "" && net.ParseIP(network.LocalAddress) == nil {
+		return fmt.Errorf("invalid local address: %q", network.LocalAddress)
+	}
+	if network.Interface != "" {
+		if err := bindToDeviceSupported(); err != nil {
+			return err
+		}
+	}
+	if network.Proxy != "" {
+		u, err := url.Parse(network.Proxy)
+		if err != nil {
+			// the *url.Error would contain the whole URL, including the password
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported proxy URL %v; the scheme must be http, https or socks5", u.Redacted())
+		}
+	}
+	if network.Resolver != "" {
+		if _, _, err := net.SplitHostPort(network.Resolver); err != nil {
+			return fmt.Errorf("invalid DNS resolver %q: %w", network.Resolver, err)
+		}
+	}
+	return nil
+}
+
+func (network *Network) String() string {
+	s := ""
+	if network.LocalAddress != "" {
+		s += " from " + network.LocalAddress
+	}
+	if network.Interface != "" {
+		s += " on " + network.Interface
+	}
+	if network.Proxy != "" {
+		s += " via " + network.redactedProxy()
+	}
+	if network.Resolver != "" {
+		s += " resolving with " + network.Resolver
+	}
+	if s == "" {
+		return "default network"
+	}
+	return s[1:]
+}
+
+// redactedProxy returns the proxy URL with its password replaced by "xxxxx", so that it can be logged.
+func (network *Network) redactedProxy() string {
+	u, err := url.Parse(network.Proxy)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+// DialContext connects like net.Dialer.DialContext, but using the network settings.
+func (network *Network) DialContext(ctx context.Context, protocol string, address string) (net.Conn, error) {
+	return network.dialer(protocol, true).DialContext(ctx, protocol, address)
+}
+
+// Dial is needed for using the network as the forward dialer of a SOCKS proxy.
+func (network *Network) Dial(protocol string, address string) (net.Conn, error) {
+	return network.DialContext(context.Background(), protocol, address)
+}
+
+func (network *Network) dialer(protocol string, customResolver bool) *net.Dialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if network.LocalAddress != "" {
+		localIP := net.ParseIP(network.LocalAddress)
+		switch protocol {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+		case "tcp", "tcp4", "tcp6":
+			dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		}
+	}
+	if network.Interface != "" {
+		dialer.Control = bindToDevice(network.Interface)
+	}
+	if customResolver && network.Resolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, protocol string, _ string) (net.Conn, error) {
+				// the queries to the DNS server go through the same uplink as everything else
+				return network.dialer(protocol, false).DialContext(ctx, protocol, network.Resolver)
+			},
+		}
+	}
+	return dialer
+}
+
+// HTTPClient returns a client which makes its requests using the network settings.
+func (network *Network) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	if err := network.Validate(); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = network.DialContext
+	if network.Proxy != "" {
+		proxyUrl, _ := url.Parse(network.Proxy)
+		switch proxyUrl.Scheme {
+		case "http", "https":
+			transport.Proxy = http.ProxyURL(proxyUrl)
+		default:
+			dialer, err := proxy.FromURL(proxyUrl, network)
+			if err != nil {
+				return nil, err
+			}
+			contextDialer, ok := dialer.(proxy.ContextDialer)
+			if !ok {
+				return nil, errors.New("the SOCKS proxy does not support contexts")
+			}
+			transport.Proxy = nil
+			transport.DialContext = contextDialer.DialContext
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
@@ -0,0 +1,202 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Service describes how to ask an external service for the IP address.
+//
+// The options are given in the URL fragment (which is never sent to the server),
+// using the query string syntax, for example:
+//
+//	https://api.ipify.org/?format=json#json=ip&content-type=application/json
+//
+// Options:
+//
+//	text                  the whole response body must be the IP address (surrounding whitespace is ignored)
+//	json=<path>           read the IP address from a dot separated path in the JSON response, e.g. "data.ip"
+//	regex=<pattern>       read the IP address from the first capture group of the regular expression
+//	header=<name>         read the IP address from an HTTP response header
+//	request-header=<n:v>  send an HTTP request header; may be repeated
+//	content-type=<type>   fail unless the response has this media type
+//
+// Without any options, the first IPv4 address in the response body is used.
+type Service struct {
+	URL            string
+	Parse          func(response *http.Response, body string) (string, error)
+	RequestHeaders http.Header
+	ContentType    string
+}
+
+var ipAddressPattern = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+
+// RedactServiceUrl returns only the scheme, host and path of the service URL, for logging.
+// The options may contain secrets, e.g. an Authorization request header.
+func RedactServiceUrl(serviceUrl string) string {
+	u, err := url.Parse(serviceUrl)
+	if err != nil {
+		base, _, _ := strings.Cut(serviceUrl, "#")
+		base, _, _ = strings.Cut(base, "?")
+		return base
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+func ParseService(serviceUrl string) (*Service, error) {
+	base, fragment, _ := strings.Cut(serviceUrl, "#")
+	service := &Service{
+		URL:            base,
+		Parse:          findIP,
+		RequestHeaders: http.Header{},
+	}
+	options, err := url.ParseQuery(fragment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options in %v: %w", RedactServiceUrl(serviceUrl), err)
+	}
+	parsers := 0
+	for key, values := range options {
+		value := values[0]
+		switch key {
+		case "text":
+			service.Parse = strictText
+			parsers++
+		case "json":
+			service.Parse = jsonPath(value)
+			parsers++
+		case "regex":
+			pattern, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex option in %v: %w", RedactServiceUrl(serviceUrl), err)
+			}
+			if pattern.NumSubexp() < 1 {
+				return nil, fmt.Errorf("the regex option in %v must have a capture group", RedactServiceUrl(serviceUrl))
+			}
+			service.Parse = regexGroup(pattern)
+			parsers++
+		case "header":
+			service.Parse = responseHeader(value)
+			parsers++
+		case "request-header":
+			for _, header := range values {
+				name, value, found := strings.Cut(header, ":")
+				if !found {
+					return nil, fmt.Errorf("the request-header option in %v must be in the format name:value", RedactServiceUrl(serviceUrl))
+				}
+				service.RequestHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		case "content-type":
+			service.ContentType = value
+		default:
+			return nil, fmt.Errorf("unknown option %q in %v", key, RedactServiceUrl(serviceUrl))
+		}
+	}
+	if parsers > 1 {
+		return nil, fmt.Errorf("only one of text, json, regex and header options may be used in %v", RedactServiceUrl(serviceUrl))
+	}
+	return service, nil
+}
+
+func (service *Service) checkContentType(response *http.Response) error {
+	if service.ContentType == "" {
+		return nil
+	}
+	actual := response.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(actual)
+	if err != nil || !strings.EqualFold(mediaType, service.ContentType) {
+		return fmt.Errorf("expected content type %v, but was %q", service.ContentType, actual)
+	}
+	return nil
+}
+
+func validIPv4(s string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSpace(s)).To4()
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+func findIP(_ *http.Response, body string) (string, error) {
+	found := ipAddressPattern.FindString(body)
+	if found != "" && net.ParseIP(found) != nil {
+		return found, nil
+	}
+	return "", fmt.Errorf("the response did not contain an IP address: %v", body)
+}
+
+func strictText(_ *http.Response, body string) (string, error) {
+	if ip, ok := validIPv4(body); ok {
+		return ip, nil
+	}
+	return "", fmt.Errorf("the response was not an IP address: %v", body)
+}
+
+func jsonPath(path string) func(*http.Response, string) (string, error) {
+	return func(_ *http.Response, body string) (string, error) {
+		var value interface{}
+		if err := json.Unmarshal([]byte(body), &value); err != nil {
+			return "", fmt.Errorf("the response was not JSON: %w", err)
+		}
+		for _, key := range strings.Split(path, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				value = v[key]
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(v) {
+					return "", fmt.Errorf("the response had no JSON value at %v", path)
+				}
+				value = v[i]
+			default:
+				return "", fmt.Errorf("the response had no JSON value at %v", path)
+			}
+		}
+		s, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("the response had no JSON string at %v", path)
+		}
+		if ip, ok := validIPv4(s); ok {
+			return ip, nil
+		}
+		return "", fmt.Errorf("the JSON value at %v was not an IP address: %v", path, s)
+	}
+}
+
+func regexGroup(pattern *regexp.Regexp) func(*http.Response, string) (string, error) {
+	return func(_ *http.Response, body string) (string, error) {
+		match := pattern.FindStringSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("the response did not match %v: %v", pattern, body)
+		}
+		if ip, ok := validIPv4(match[1]); ok {
+			return ip, nil
+		}
+		return "", fmt.Errorf("the captured value was not an IP address: %v", match[1])
+	}
+}
+
+func responseHeader(name string) func(*http.Response, string) (string, error) {
+	return func(response *http.Response, _ string) (string, error) {
+		value := response.Header.Get(name)
+		if value == "" {
+			return "", errors.New("the response had no header " + name)
+		}
+		if ip, ok := validIPv4(value); ok {
+			return ip, nil
+		}
+		return "", fmt.Errorf("the header %v was not an IP address: %v", name, value)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// STUN message format as specified in RFC 5389
+const (
+	stunBindingRequest    = 0x0001
+	stunBindingSuccess    = 0x0101
+	stunMagicCookie       = 0x2112A442
+	stunHeaderSize        = 20
+	stunMappedAddress     = 0x0001
+	stunXorMappedAddress  = 0x0020
+	stunAddressFamilyIPv4 = 0x01
+)
+
+// DefaultStunTimeout is how long StunIP waits for the STUN server to respond.
+const DefaultStunTimeout = 5 * time.Second
+
+// StunIP asks a STUN server for the public address which our UDP packets appear to come from.
+func StunIP(server string) (string, error) {
+	return (&Network{}).StunIP(server)
+}
+
+// StunIP is like the package level StunIP, but the proxy setting is ignored,
+// because STUN uses UDP.
+func (network *Network) StunIP(server string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStunTimeout)
+	defer cancel()
+	return network.StunIPContext(ctx, server)
+}
+
+// StunIPContext is like StunIP, but instead of a fixed timeout,
+// it gives up when the context is done.
+func (network *Network) StunIPContext(ctx context.Context, server string) (string, error) {
+	if err := network.Validate(); err != nil {
+		return "", err
+	}
+	conn, err := network.DialContext(ctx, "udp", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(request[2:4], 0) // message length
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	transactionID := request[8:20]
+	if _, err := rand.Read(transactionID); err != nil {
+		return "", err
+	}
+
+	defer closeWhenDone(ctx, conn)()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return "", contextErr(ctx, err)
+	}
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return "", contextErr(ctx, err)
+	}
+	return parseStunResponse(response[:n], transactionID)
+}
+
+// closeWhenDone interrupts the reads of the connection when the context is cancelled.
+func closeWhenDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextErr tells that the context was done, instead of the error of the interrupted read.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func parseStunResponse(response []byte, transactionID []byte) (string, error) {
+	if len(response) < stunHeaderSize {
+		return "", errors.New("STUN response is too short")
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != stunBindingSuccess {
+		return "", fmt.Errorf("STUN response was not a binding success, but message type 0x%04x", binary.BigEndian.Uint16(response[0:2]))
+	}
+	if binary.BigEndian.Uint32(response[4:8]) != stunMagicCookie || !bytes.Equal(response[8:20], transactionID) {
+		return "", errors.New("STUN response did not match the request")
+	}
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if stunHeaderSize+length > len(response) {
+		return "", errors.New("STUN response is truncated")
+	}
+
+	var mapped net.IP
+	attributes := response[stunHeaderSize : stunHeaderSize+length]
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:2])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attrLength > len(attributes) {
+			break
+		}
+		value := attributes[4 : 4+attrLength]
+		// the value is: reserved (1 byte), family (1 byte), port (2 bytes), address (4 bytes for IPv4)
+		if len(value) >= 8 && value[1] == stunAddressFamilyIPv4 {
+			switch attrType {
+			case stunXorMappedAddress:
+				var cookie [4]byte
+				binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+				ip := make(net.IP, 4)
+				for i := 0; i < 4; i++ {
+					ip[i] = value[4+i] ^ cookie[i]
+				}
+				return ip.String(), nil
+			case stunMappedAddress:
+				mapped = net.IPv4(value[4], value[5], value[6], value[7])
+			}
+		}
+		// attributes are padded to a multiple of 4 bytes
+		next := 4 + (attrLength+3)/4*4
+		if next > len(attributes) {
+			break
+		}
+		attributes = attributes[next:]
+	}
+	if mapped != nil {
+		return mapped.String(), nil
+	}
+	return "", errors.New("STUN response did not contain an IPv4 address")
+}
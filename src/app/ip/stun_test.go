@@ -0,0 +1,111 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"context"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStun(t *testing.T) {
+	Convey("StunIPSpec", t, StunIPSpec)
+}
+
+// fakeStunServer replies to binding requests with the given attribute type and address
+func fakeStunServer(attrType uint16, address net.IP) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < stunHeaderSize {
+				continue
+			}
+			value := make([]byte, 8)
+			value[1] = stunAddressFamilyIPv4
+			binary.BigEndian.PutUint16(value[2:4], 12345)
+			copy(value[4:8], address.To4())
+			if attrType == stunXorMappedAddress {
+				var cookie [4]byte
+				binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+				for i := 0; i < 4; i++ {
+					value[4+i] ^= cookie[i]
+				}
+			}
+			response := make([]byte, stunHeaderSize)
+			binary.BigEndian.PutUint16(response[0:2], stunBindingSuccess)
+			copy(response[4:20], buf[4:20]) // magic cookie and transaction ID
+			// an unrelated SOFTWARE attribute with padding, which should be skipped
+			response = append(response, 0x80, 0x22, 0x00, 0x03, 'f', 'o', 'o', 0x00)
+			response = binary.BigEndian.AppendUint16(response, attrType)
+			response = binary.BigEndian.AppendUint16(response, uint16(len(value)))
+			response = append(response, value...)
+			binary.BigEndian.PutUint16(response[2:4], uint16(len(response)-stunHeaderSize))
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { _ = conn.Close() }
+}
+
+func StunIPSpec() {
+	Convey("reads the XOR-MAPPED-ADDRESS", func() {
+		server, stop := fakeStunServer(stunXorMappedAddress, net.ParseIP("203.0.113.7"))
+		defer stop()
+
+		ip, err := StunIP(server)
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "203.0.113.7")
+	})
+
+	Convey("reads the MAPPED-ADDRESS of old servers", func() {
+		server, stop := fakeStunServer(stunMappedAddress, net.ParseIP("198.51.100.7"))
+		defer stop()
+
+		ip, err := StunIP(server)
+
+		So(err, ShouldBeNil)
+		So(ip, ShouldEqual, "198.51.100.7")
+	})
+
+	Convey("error: gives up when the context is cancelled", func() {
+		silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer silent.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		_, err = (&Network{}).StunIPContext(ctx, silent.LocalAddr().String())
+
+		So(err, ShouldEqual, context.Canceled)
+	})
+
+	Convey("error: response is not a STUN message", func() {
+		_, err := parseStunResponse([]byte("garbage"), make([]byte, 12))
+
+		So(err, ShouldBeError, "STUN response is too short")
+	})
+
+	Convey("error: response is for another transaction", func() {
+		response := make([]byte, stunHeaderSize)
+		binary.BigEndian.PutUint16(response[0:2], stunBindingSuccess)
+		binary.BigEndian.PutUint32(response[4:8], stunMagicCookie)
+		response[8] = 1
+
+		_, err := parseStunResponse(response, make([]byte, 12))
+
+		So(err, ShouldBeError, "STUN response did not match the request")
+	})
+}
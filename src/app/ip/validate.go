@@ -0,0 +1,106 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	"fmt"
+	"net"
+)
+
+type reservedRange struct {
+	network *net.IPNet
+	reason  string
+}
+
+// reservedRanges are not reachable from the internet, so they should not be published in public DNS
+var reservedRanges = []reservedRange{
+	{mustParseCIDR("0.0.0.0/8"), "an unspecified address (RFC 1122)"},
+	{mustParseCIDR("10.0.0.0/8"), "a private address (RFC 1918)"},
+	{mustParseCIDR("100.64.0.0/10"), "a CGNAT shared address (RFC 6598)"},
+	{mustParseCIDR("127.0.0.0/8"), "a loopback address (RFC 1122)"},
+	{mustParseCIDR("169.254.0.0/16"), "a link-local address (RFC 3927)"},
+	{mustParseCIDR("172.16.0.0/12"), "a private address (RFC 1918)"},
+	{mustParseCIDR("192.0.0.0/24"), "an IETF protocol assignment (RFC 6890)"},
+	{mustParseCIDR("192.0.2.0/24"), "a documentation address (RFC 5737)"},
+	{mustParseCIDR("192.168.0.0/16"), "a private address (RFC 1918)"},
+	{mustParseCIDR("198.18.0.0/15"), "a benchmarking address (RFC 2544)"},
+	{mustParseCIDR("198.51.100.0/24"), "a documentation address (RFC 5737)"},
+	{mustParseCIDR("203.0.113.0/24"), "a documentation address (RFC 5737)"},
+	{mustParseCIDR("224.0.0.0/4"), "a multicast address (RFC 5771)"},
+	{mustParseCIDR("240.0.0.0/4"), "a reserved or broadcast address (RFC 1112)"},
+}
+
+var cgnatRange = mustParseCIDR("100.64.0.0/10")
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// Policy decides which addresses may be published. By default, all reserved
+// addresses are rejected. The Allow list overrides that, and the Deny list
+// overrides everything.
+type Policy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+func NewPolicy(allow []string, deny []string) (*Policy, error) {
+	policy := &Policy{}
+	var err error
+	if policy.Allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if policy.Deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var results []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, network)
+	}
+	return results, nil
+}
+
+// Check returns an error which explains why the address may not be published, or nil if it may.
+func (policy *Policy) Check(address string) error {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return fmt.Errorf("%q is not a valid IPv4 address", address)
+	}
+	for _, network := range policy.Deny {
+		if network.Contains(ip) {
+			return fmt.Errorf("%v is in the denied range %v", ip, network)
+		}
+	}
+	for _, network := range policy.Allow {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, reserved := range reservedRanges {
+		if reserved.network.Contains(ip) {
+			return fmt.Errorf("%v is %v in the range %v, which is not reachable from the internet", ip, reserved.reason, reserved.network)
+		}
+	}
+	return nil
+}
+
+// IsCGNAT tells whether the address is in the carrier-grade NAT shared address space,
+// meaning that the ISP is sharing one public IP address between many customers.
+func IsCGNAT(address string) bool {
+	ip := net.ParseIP(address).To4()
+	return ip != nil && cgnatRange.Contains(ip)
+}
@@ -0,0 +1,82 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ip
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	Convey("PolicySpec", t, PolicySpec)
+	Convey("IsCGNATSpec", t, IsCGNATSpec)
+}
+
+func PolicySpec() {
+	Convey("by default", func() {
+		policy := &Policy{}
+
+		Convey("accepts public addresses", func() {
+			So(policy.Check("8.8.8.8"), ShouldBeNil)
+			So(policy.Check("100.128.0.1"), ShouldBeNil)
+		})
+		Convey("rejects private addresses", func() {
+			So(policy.Check("10.1.2.3"), ShouldBeError, "10.1.2.3 is a private address (RFC 1918) in the range 10.0.0.0/8, which is not reachable from the internet")
+			So(policy.Check("172.16.0.1"), ShouldNotBeNil)
+			So(policy.Check("192.168.1.1"), ShouldNotBeNil)
+		})
+		Convey("rejects CGNAT addresses", func() {
+			So(policy.Check("100.64.0.1"), ShouldBeError, "100.64.0.1 is a CGNAT shared address (RFC 6598) in the range 100.64.0.0/10, which is not reachable from the internet")
+		})
+		Convey("rejects loopback, link-local, multicast and documentation addresses", func() {
+			So(policy.Check("127.0.0.1"), ShouldNotBeNil)
+			So(policy.Check("169.254.1.1"), ShouldNotBeNil)
+			So(policy.Check("224.0.0.1"), ShouldNotBeNil)
+			So(policy.Check("192.0.2.1"), ShouldNotBeNil)
+			So(policy.Check("198.51.100.1"), ShouldNotBeNil)
+			So(policy.Check("203.0.113.1"), ShouldNotBeNil)
+		})
+		Convey("rejects unspecified and broadcast addresses", func() {
+			So(policy.Check("0.0.0.0"), ShouldNotBeNil)
+			So(policy.Check("255.255.255.255"), ShouldNotBeNil)
+		})
+		Convey("rejects garbage", func() {
+			So(policy.Check("999.1.1.1"), ShouldBeError, `"999.1.1.1" is not a valid IPv4 address`)
+			So(policy.Check(""), ShouldBeError, `"" is not a valid IPv4 address`)
+			So(policy.Check("::1"), ShouldBeError, `"::1" is not a valid IPv4 address`)
+		})
+	})
+
+	Convey("allowed ranges override the reserved ranges", func() {
+		policy, err := NewPolicy([]string{"192.168.0.0/16"}, nil)
+		So(err, ShouldBeNil)
+
+		So(policy.Check("192.168.1.1"), ShouldBeNil)
+		So(policy.Check("10.1.2.3"), ShouldNotBeNil)
+	})
+
+	Convey("denied ranges override everything", func() {
+		policy, err := NewPolicy([]string{"192.168.0.0/16"}, []string{"192.168.66.0/24", "8.8.8.0/24"})
+		So(err, ShouldBeNil)
+
+		So(policy.Check("192.168.66.1"), ShouldBeError, "192.168.66.1 is in the denied range 192.168.66.0/24")
+		So(policy.Check("8.8.8.8"), ShouldBeError, "8.8.8.8 is in the denied range 8.8.8.0/24")
+		So(policy.Check("8.8.4.4"), ShouldBeNil)
+	})
+
+	Convey("error: invalid CIDR", func() {
+		_, err := NewPolicy([]string{"192.168.0.0"}, nil)
+
+		So(err, ShouldBeError, "invalid CIDR address: 192.168.0.0")
+	})
+}
+
+func IsCGNATSpec() {
+	So(IsCGNAT("100.64.0.1"), ShouldBeTrue)
+	So(IsCGNAT("100.127.255.254"), ShouldBeTrue)
+	So(IsCGNAT("100.128.0.1"), ShouldBeFalse)
+	So(IsCGNAT("10.0.0.1"), ShouldBeFalse)
+	So(IsCGNAT("garbage"), ShouldBeFalse)
+}
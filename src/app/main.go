@@ -5,13 +5,29 @@
 package main
 
 import (
-	"app/config"
-	"app/gcloud"
-	"app/ip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/doctor"
+	"github.com/luontola/gcp-dynamic-dns/src/app/dyndns"
+	"github.com/luontola/gcp-dynamic-dns/src/app/fakedns"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/heartbeat"
+	"github.com/luontola/gcp-dynamic-dns/src/app/hub"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"github.com/luontola/gcp-dynamic-dns/src/app/metrics"
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	"github.com/luontola/gcp-dynamic-dns/src/app/status"
+	"github.com/luontola/gcp-dynamic-dns/src/app/updater"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -21,15 +37,32 @@ func main() {
 		command = os.Args[1]
 	}
 	conf := config.FromEnv()
+	stopping, work := handleSignals(conf.ShutdownTimeout)
 	switch command {
 	case "sync":
-		sync(conf)
+		sync(stopping, conf)
 	case "sync-once":
-		syncOnce(conf)
+		syncOnce(work, conf)
 	case "list-ip":
-		listIP(conf)
+		listIP(work, conf)
 	case "list-dns":
-		listDns(conf)
+		listDns(work, conf)
+	case "status":
+		printStatus(work, conf)
+	case "takeover":
+		takeover(work, conf)
+	case "list-heartbeats":
+		listHeartbeats(work, conf)
+	case "doctor":
+		runDoctor(work, conf)
+	case "serve":
+		serve(stopping, conf)
+	case "hub":
+		runHub(stopping, conf)
+	case "agent":
+		runAgent(stopping, conf)
+	case "fake-dns":
+		fakeDns(stopping, conf)
 	default:
 		printHelp()
 		os.Exit(1)
@@ -40,116 +73,473 @@ func main() {
 func printHelp() {
 	fmt.Printf("%v <command>\n", os.Args[0])
 	println("Available commands:")
-	println("  sync        Update DNS records continuously")
-	println("  sync-once   Update DNS records once")
-	println("  list-ip     Print current IP address")
-	println("  list-dns    Print current DNS records")
-	println("  help        Print this help")
+	println("  sync             Update DNS records continuously")
+	println("  sync-once        Update DNS records once")
+	println("  list-ip          Print current IP address")
+	println("  list-dns         Print current DNS records")
+	println("  list-heartbeats  Print when each site last checked in; exit code 2 if some are stale")
+	println("  status           Compare current IP address with DNS records; exit code 2 if out of sync")
+	println("  takeover         Take over the ownership of DNS records from another instance")
+	println("  doctor           Diagnose setup problems")
+	println("  serve            Accept dyndns2 protocol updates from routers")
+	println("  hub              Accept IP reports from agents and update their DNS records")
+	println("  agent            Report current IP address to the hub continuously")
+	println("  fake-dns         Serve an in-memory fake of the Cloud DNS API, for local testing")
+	println("  help             Print this help")
 }
 
 // commands
 
-func sync(conf *config.Config) {
-	client := gcloud.Configure(conf.GoogleProject)
+// sync stops between the updates as soon as stopping is done, and an update in
+// progress is cancelled SHUTDOWN_TIMEOUT later.
+func sync(stopping context.Context, conf *config.Config) {
+	u := newUpdater(conf, syncNow)
+	startAdminServer(conf)
+	exitIfFailed(u.Run(stopping))
+	log.Println("Stopped")
+}
 
-	var previousIP string
-	for {
-		currentIP, err := readCurrentIP(conf)
+func syncOnce(ctx context.Context, conf *config.Config) {
+	u := newUpdater(conf, nil)
+	err := u.RunOnce(ctx)
+	if errors.Is(err, updater.ErrDeferred) {
+		os.Exit(1)
+	}
+	exitIfFailed(err)
+}
 
-		if err != nil {
-			log.Println("WARN: Failed to read the current IP:", err)
-		} else if currentIP != previousIP {
-			handleChangedIP(currentIP, conf.DnsNames, client)
-			previousIP = currentIP
-		}
-		if conf.Mode == "service" {
-			time.Sleep(time.Minute * 5)
+func newUpdater(conf *config.Config, syncNow <-chan struct{}) *updater.Updater {
+	conf.RequireCloudDns()
+	client := gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...)
+	options := updater.FromConfig(conf)
+	options.Provider = updater.CloudDns(client)
+	options.SyncNow = syncNow
+	u, err := updater.New(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return u
+}
+
+// exitIfFailed exits the program if the update failed. If the shutdown cancelled it,
+// the DNS records were not changed, and the program stops normally.
+func exitIfFailed(err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Println("Stopped before the DNS records were changed")
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listHeartbeats(ctx context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	client := gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...)
+	ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+	defer cancel()
+	records, err := client.DnsRecords(ctx)
+	if err != nil {
+		log.Fatal("Failed to read DNS records: ", err)
+	}
+	if heartbeat.PrintSites(os.Stdout, heartbeat.Sites(records), time.Now(), conf.HeartbeatMaxAge) > 0 {
+		os.Exit(2)
+	}
+}
+
+func listIP(ctx context.Context, conf *config.Config) {
+	links, err := updater.NewLinks(conf, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current, err := links.Detect(ctx)
+	if err != nil {
+		log.Fatal("Failed to read the current IP: ", err)
+	}
+	if len(current.Links) == 1 {
+		println(current.String())
+		return
+	}
+	for _, name := range current.Links {
+		if detected, ok := current.IPs[name]; ok {
+			println(name, detected.IP)
 		} else {
-			time.Sleep(time.Minute)
+			println(name, "down")
 		}
 	}
 }
 
-func syncOnce(conf *config.Config) {
-	client := gcloud.Configure(conf.GoogleProject)
+func listDns(ctx context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	provider := updater.CloudDns(gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...))
+	ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+	defer cancel()
+	records := readAllDnsRecords(ctx, provider, conf)
+	for _, record := range records {
+		println(record.ItemName(), record.Type, record.Ttl, " ", strings.Join(record.Values(), " "))
+	}
+}
 
-	currentIP, err := readCurrentIP(conf)
+func printStatus(ctx context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	provider := updater.CloudDns(gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...))
+	links, err := updater.NewLinks(conf, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current, err := links.Detect(ctx)
 	if err != nil {
 		log.Fatal("Failed to read the current IP: ", err)
 	}
-	handleChangedIP(currentIP, conf.DnsNames, client)
+	ctx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+	defer cancel()
+	records := readAllDnsRecords(ctx, provider, conf)
+	zones, err := provider.ManagedZones(ctx)
+	if err != nil {
+		log.Fatal("Failed to read managed zones: ", err)
+	}
+	nameServers := make(map[string][]string)
+	for _, zone := range zones {
+		if zone.Visibility != "private" {
+			// private zones can't be queried from outside their VPC networks
+			nameServers[zone.Key()] = zone.NameServers
+		}
+	}
+	st, err := state.Load(conf.StateFile)
+	if err != nil {
+		log.Fatal("Failed to read STATE_FILE: ", err)
+	}
+	report := status.Check(ctx, current.String(), records, nameServers, status.QueryA)
+	if len(current.Links) > 1 || conf.MergesValues() {
+		report.Expected = make(map[string][]string)
+		for _, group := range conf.RecordGroups {
+			values, _, _ := current.Values(group)
+			groupRecords := readDnsRecords(ctx, updater.ForGroup(provider, group), group.DnsNames)
+			for _, record := range groupRecords {
+				if group.MergeValues {
+					report.Expected[record.Key()] = gcloud.MergeValues(record.Values(), st.Published[record.Key()], values)
+				} else {
+					report.Expected[record.Key()] = values
+				}
+			}
+		}
+	}
+	report.Print(os.Stdout)
+	if conf.StateFile != "" {
+		fmt.Println()
+		status.PrintHistory(os.Stdout, st, conf.MaxChangesPerHour, time.Now())
+	}
+	if !report.InSync() {
+		os.Exit(2)
+	}
+}
+
+func takeover(ctx context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	if conf.OwnerID == "" {
+		log.Fatal("Environment variable OWNER_ID was not set")
+	}
+	provider := updater.CloudDns(gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...))
+	readCtx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+	defer cancel()
+	registry, err := updater.ReadOwnership(readCtx, provider, conf)
+	if err != nil {
+		log.Fatal("Failed to read DNS records: ", err)
+	}
+	writeCtx, cancel := updater.WriteContext(conf.DnsApiTimeout)
+	defer cancel()
+	failed := false
+	for _, record := range readAllDnsRecords(readCtx, provider, conf) {
+		previous := registry.OwnerOf(record)
+		if previous == conf.OwnerID {
+			log.Printf("%v is already owned by %v\n", record.Name, conf.OwnerID)
+			continue
+		}
+		exitIfFailed(updater.Cancelled(ctx))
+		if _, err := provider.ApplyChanges(writeCtx, gcloud.ChangeSet{record.ZoneKey(): registry.Takeover(record)}); err != nil {
+			log.Printf("WARN: Failed to take over %v in zone %v: %v\n", record.Name, record.ZoneKey(), err)
+			failed = true
+			continue
+		}
+		if previous == "" {
+			log.Printf("Claimed the ownership of %v as %v\n", record.Name, conf.OwnerID)
+		} else {
+			log.Printf("Took over %v from %v as %v\n", record.Name, previous, conf.OwnerID)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runDoctor(ctx context.Context, conf *config.Config) {
+	if !doctor.Run(ctx, conf, os.Stdout) {
+		os.Exit(1)
+	}
 }
 
-func handleChangedIP(currentIP string, dnsNames []string, client *gcloud.Client) {
-	log.Printf("Updating IP %v to DNS records %v\n", currentIP, dnsNames)
-	records := readDnsRecords(client, dnsNames)
-	updated := updateDnsRecords(client, records, []string{currentIP})
+func serve(stopping context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	if len(conf.ServeUsers) == 0 {
+		log.Fatal("Environment variable SERVE_USERS was not set")
+	}
+	users := make(map[string]dyndns.User)
+	for _, user := range conf.ServeUsers {
+		for _, name := range user.DnsNames {
+			if !contains(conf.AllDnsNames(), name) {
+				log.Fatalf("SERVE_USERS: user %v has DNS name %v which is not listed in the DNS names of any record group", user.Username, name)
+			}
+		}
+		users[user.Username] = dyndns.User{Password: user.Password, DnsNames: user.DnsNames}
+	}
+	client := gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...)
+	server := dyndns.NewServer(updater.NewGroupUpdater(conf, updater.CloudDns(client)), users)
+	server.IPPolicy = ipPolicy(conf.AllowCidrs, conf.DenyCidrs)
+	server.NamePolicies = namePolicies(conf)
+	httpServer := &http.Server{Addr: conf.ServeAddress, Handler: server.Handler()}
+	if conf.ServeTLSCert == "" || conf.ServeTLSKey == "" {
+		if !conf.ServeInsecureHttp {
+			log.Fatal("SERVE_TLS_CERT and SERVE_TLS_KEY are not set; the users' passwords must not be sent over plain HTTP. " +
+				"If the server is behind a TLS-terminating reverse proxy, or the routers are in the same trusted network " +
+				"and don't support HTTPS, set SERVE_INSECURE_HTTP=true")
+		}
+		log.Println("WARN: SERVE_INSECURE_HTTP is set; serving plain HTTP, " +
+			"so the users' passwords are sent in cleartext unless a TLS-terminating reverse proxy is in front of the server")
+		log.Printf("Listening for dyndns2 updates on %v\n", conf.ServeAddress)
+		runServer(stopping, conf, httpServer, httpServer.ListenAndServe)
+		return
+	}
+	log.Printf("Listening for dyndns2 updates on %v (HTTPS)\n", conf.ServeAddress)
+	runServer(stopping, conf, httpServer, func() error {
+		return httpServer.ListenAndServeTLS(conf.ServeTLSCert, conf.ServeTLSKey)
+	})
+}
 
-	if len(updated) == 0 {
-		log.Println("Nothing to update")
-	} else {
-		log.Printf("Updated %d DNS records:\n", len(updated))
-		for _, record := range updated {
-			log.Printf("    %v  %v -> %v\n", record.Name, record.OldRrdatas, record.Rrdatas)
+func runHub(stopping context.Context, conf *config.Config) {
+	conf.RequireCloudDns()
+	if len(conf.HubAgents) == 0 {
+		log.Fatal("Environment variable HUB_AGENTS was not set")
+	}
+	var agents []hub.Agent
+	for _, agent := range conf.HubAgents {
+		for _, name := range agent.DnsNames {
+			if !contains(conf.AllDnsNames(), name) {
+				log.Fatalf("HUB_AGENTS: agent %v has DNS name %v which is not listed in the DNS names of any record group", agent.Username, name)
+			}
 		}
+		agents = append(agents, hub.Agent{Name: agent.Username, Token: agent.Password, DnsNames: agent.DnsNames})
 	}
+	client := gcloud.Configure(updater.GoogleAuth(conf), conf.Projects()...)
+	server := hub.NewServer(updater.NewGroupUpdater(conf, updater.CloudDns(client)), agents)
+	server.IPPolicy = ipPolicy(conf.AllowCidrs, conf.DenyCidrs)
+	server.NamePolicies = namePolicies(conf)
+	httpServer := &http.Server{Addr: conf.HubAddress, Handler: server.Handler()}
+	if conf.HubTLSCert == "" || conf.HubTLSKey == "" {
+		if !conf.HubInsecureHttp {
+			log.Fatal("HUB_TLS_CERT and HUB_TLS_KEY are not set; the agents' tokens must not be sent over plain HTTP. " +
+				"If the hub is behind a TLS-terminating reverse proxy, set HUB_INSECURE_HTTP=true")
+		}
+		log.Println("WARN: HUB_INSECURE_HTTP is set; serving plain HTTP, " +
+			"so make sure that a TLS-terminating reverse proxy is in front of the hub")
+		log.Printf("Listening for agent reports on %v\n", conf.HubAddress)
+		runServer(stopping, conf, httpServer, httpServer.ListenAndServe)
+		return
+	}
+	log.Printf("Listening for agent reports on %v (HTTPS)\n", conf.HubAddress)
+	runServer(stopping, conf, httpServer, func() error {
+		return httpServer.ListenAndServeTLS(conf.HubTLSCert, conf.HubTLSKey)
+	})
 }
 
-func listIP(conf *config.Config) {
-	currentIP, err := readCurrentIP(conf)
+func runAgent(stopping context.Context, conf *config.Config) {
+	client, err := hub.NewClient(conf.HubUrl, conf.HubToken, hubHttpClient(conf))
 	if err != nil {
-		log.Fatal("Failed to read the current IP: ", err)
+		log.Fatal("Invalid HUB_URL or HUB_TOKEN: ", err)
+	}
+	// agents report only the default link; run one agent per WAN link to report more
+	chain, err := updater.NewChain(conf, &conf.Link, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	agent, err := updater.NewAgent(updater.AgentOptions{
+		Hub:             client,
+		Chain:           chain,
+		ReportInterval:  conf.HubReportInterval,
+		ShutdownTimeout: conf.ShutdownTimeout,
+		SyncNow:         syncNow,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	println(currentIP)
+	startAdminServer(conf)
+	exitIfFailed(agent.Run(stopping))
+	log.Println("Stopped")
 }
 
-func listDns(conf *config.Config) {
-	client := gcloud.Configure(conf.GoogleProject)
-	records := readDnsRecords(client, conf.DnsNames)
-	for _, record := range records {
-		println(record.Name, record.Type, record.Ttl, " ", strings.Join(record.Rrdatas, " "))
+func fakeDns(stopping context.Context, conf *config.Config) {
+	server := fakedns.New()
+	projects := conf.Projects()
+	if len(projects) == 0 {
+		projects = []string{"demo"}
+	}
+	for _, project := range projects {
+		server.Seed(project, conf.AllDnsNames())
+	}
+	log.Printf("Serving a fake Cloud DNS API on %v; use DNS_API_ENDPOINT=http://%v/ and GOOGLE_PROJECT=%v\n",
+		conf.FakeDnsAddress, conf.FakeDnsAddress, strings.Join(projects, " "))
+	httpServer := &http.Server{Addr: conf.FakeDnsAddress, Handler: server}
+	runServer(stopping, conf, httpServer, httpServer.ListenAndServe)
+}
+
+func hubHttpClient(conf *config.Config) *http.Client {
+	if conf.HubCACert == "" {
+		return &http.Client{Timeout: conf.HubTimeout}
+	}
+	pem, err := os.ReadFile(conf.HubCACert)
+	if err != nil {
+		log.Fatal("Failed to read HUB_CA_CERT: ", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		log.Fatal("HUB_CA_CERT did not contain any PEM certificates: ", conf.HubCACert)
+	}
+	return &http.Client{
+		Timeout:   conf.HubTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
 	}
 }
 
 // operations
 
-func readCurrentIP(conf *config.Config) (string, error) {
-	var currentIP string
-	var err error
-	mode := conf.Mode
-	switch mode {
-	case "service":
-		url := conf.NextServiceUrl()
-		currentIP, err = ip.ExternalServiceIP(url)
+// handleSignals returns the stopping context, which is done on SIGTERM or SIGINT, so that no new
+// work is started, and the work context, which is done SHUTDOWN_TIMEOUT later, so that the work
+// in progress is cancelled. A second signal stops the program right away.
+func handleSignals(timeout time.Duration) (context.Context, context.Context) {
+	stopping, stop := context.WithCancel(context.Background())
+	work, cancelWork := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	if len(triggerSignals) > 0 {
+		triggers := make(chan os.Signal, 1)
+		signal.Notify(triggers, triggerSignals...)
+		go func() {
+			for sig := range triggers {
+				log.Printf("Received signal %v; checking the IP now\n", sig)
+				triggerSync()
+			}
+		}()
+	}
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received signal %v; stopping within %v\n", sig, timeout)
+		stop()
+		time.AfterFunc(timeout, cancelWork)
+	}()
+	return stopping, work
+}
+
+// syncNow wakes up the sync and agent commands, so that the IP is checked right away instead of at the next poll.
+var syncNow = make(chan struct{}, 1)
+
+// triggerSync requests an IP check. Requests made while one is already pending are merged into it.
+func triggerSync() {
+	select {
+	case syncNow <- struct{}{}:
+	default:
+	}
+}
+
+// runServer serves until stopping is done, and then lets the requests in progress finish within SHUTDOWN_TIMEOUT.
+func runServer(stopping context.Context, conf *config.Config, server *http.Server, listen func() error) {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stopping.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("WARN: Requests in progress were interrupted:", err)
+		}
+	}()
+	if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Stopped")
+}
+
+func startAdminServer(conf *config.Config) {
+	if conf.AdminAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/sync", handleSyncRequest)
+	go func() {
+		log.Printf("Serving metrics on %v\n", conf.AdminAddress)
+		log.Fatal(http.ListenAndServe(conf.AdminAddress, mux))
+	}()
+}
+
+// handleSyncRequest triggers an IP check, e.g. from a router's hook script when its WAN link reconnects.
+func handleSyncRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Printf("Received a sync request from %v; checking the IP now\n", r.RemoteAddr)
+	triggerSync()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func ipPolicy(allowCidrs []string, denyCidrs []string) *ip.Policy {
+	policy, err := ip.NewPolicy(allowCidrs, denyCidrs)
+	if err != nil {
+		log.Fatal("Invalid ALLOW_CIDRS or DENY_CIDRS: ", err)
+	}
+	return policy
+}
+
+// namePolicies returns the address policy of each DNS name, which is that of the first record group listing it.
+func namePolicies(conf *config.Config) map[string]*ip.Policy {
+	policies := make(map[string]*ip.Policy)
+	for _, group := range conf.RecordGroups {
+		policy, err := ip.NewPolicy(group.AllowCidrs, group.DenyCidrs)
 		if err != nil {
-			err = fmt.Errorf("failure using external service %v: %w", url, err)
+			log.Fatalf("Invalid ALLOW_CIDRS or DENY_CIDRS of record group %v: %v", group.Name, err)
 		}
-	case "interface":
-		if name := conf.InterfaceName; name != "" {
-			currentIP, err = ip.InterfaceIP(name)
-		} else {
-			currentIP, err = ip.OutgoingIP()
+		for _, name := range group.DnsNames {
+			if _, found := policies[name]; !found {
+				policies[name] = policy
+			}
 		}
-	case "upnp":
-		currentIP, err = ip.UpnpRouterIP()
-	default:
-		log.Fatal("Invalid MODE:", mode)
 	}
-	return currentIP, err
+	return policies
 }
 
-func readDnsRecords(client *gcloud.Client, dnsNames []string) gcloud.DnsRecords {
-	records, err := client.DnsRecordsByNameAndType(dnsNames, "A")
+func readAllDnsRecords(ctx context.Context, provider updater.Provider, conf *config.Config) gcloud.DnsRecords {
+	records, err := updater.ReadRecords(ctx, provider, conf)
 	if err != nil {
 		log.Fatal("Failed to read DNS records: ", err)
 	}
 	return records
 }
 
-func updateDnsRecords(client *gcloud.Client, records gcloud.DnsRecords, newValues []string) gcloud.DnsRecords {
-	updated, err := client.UpdateDnsRecords(records, newValues)
+func readDnsRecords(ctx context.Context, provider updater.Provider, dnsNames []string) gcloud.DnsRecords {
+	records, err := provider.DnsRecordsByNameAndType(ctx, dnsNames, "A")
 	if err != nil {
-		log.Fatal("Failed to update DNS records: ", err)
+		log.Fatal("Failed to read DNS records: ", err)
+	}
+	return records
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
 	}
-	return updated
+	return false
 }
@@ -0,0 +1,119 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package metrics keeps simple counters and gauges, and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type metric struct {
+	kind   string
+	help   string
+	values map[string]float64
+}
+
+var (
+	mutex   sync.Mutex
+	metrics = make(map[string]*metric)
+)
+
+// Describe registers a metric. The kind is either "counter" or "gauge".
+func Describe(name string, kind string, help string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, found := metrics[name]; !found {
+		metrics[name] = &metric{kind: kind, help: help, values: make(map[string]float64)}
+	}
+}
+
+// Inc increments a counter. The labels are given as name-value pairs.
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+func Add(name string, delta float64, labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	m := get(name)
+	m.values[formatLabels(labels)] += delta
+}
+
+// Set sets the value of a gauge. The labels are given as name-value pairs.
+func Set(name string, value float64, labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	m := get(name)
+	m.values[formatLabels(labels)] = value
+}
+
+// Get returns the current value of a metric, mainly for tests.
+func Get(name string, labels ...string) float64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return get(name).values[formatLabels(labels)]
+}
+
+func get(name string) *metric {
+	m, found := metrics[name]
+	if !found {
+		m = &metric{kind: "untyped", values: make(map[string]float64)}
+		metrics[name] = m
+	}
+	return m
+}
+
+func formatLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("labels must be name-value pairs, but were: %v", labels))
+	}
+	var pairs []string
+	for i := 0; i < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], value))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func WriteTo(out io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := metrics[name]
+		if m.help != "" {
+			fmt.Fprintf(out, "# HELP %v %v\n", name, m.help)
+		}
+		fmt.Fprintf(out, "# TYPE %v %v\n", name, m.kind)
+		var labels []string
+		for l := range m.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			fmt.Fprintf(out, "%v%v %v\n", name, l, m.values[l])
+		}
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package metrics
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("MetricsSpec", t, MetricsSpec)
+}
+
+func MetricsSpec() {
+	metrics = make(map[string]*metric)
+
+	Convey("counters and gauges are written in Prometheus text format", func() {
+		Describe("test_requests_total", "counter", "Number of requests.")
+		Describe("test_up", "gauge", "Whether the thing is up.")
+		Inc("test_requests_total", "source", "upnp", "result", "success")
+		Inc("test_requests_total", "source", "upnp", "result", "success")
+		Inc("test_requests_total", "source", "stun", "result", "failure")
+		Set("test_up", 1)
+		var out bytes.Buffer
+
+		WriteTo(&out)
+
+		So(out.String(), ShouldEqual, ""+
+			"# HELP test_requests_total Number of requests.\n"+
+			"# TYPE test_requests_total counter\n"+
+			"test_requests_total{source=\"stun\",result=\"failure\"} 1\n"+
+			"test_requests_total{source=\"upnp\",result=\"success\"} 2\n"+
+			"# HELP test_up Whether the thing is up.\n"+
+			"# TYPE test_up gauge\n"+
+			"test_up 1\n")
+	})
+
+	Convey("label values are escaped", func() {
+		Inc("test_total", "url", "http://example.com/\"quoted\"")
+
+		So(Get("test_total", "url", "http://example.com/\"quoted\""), ShouldEqual, 1)
+		var out bytes.Buffer
+		WriteTo(&out)
+		So(out.String(), ShouldContainSubstring, `test_total{url="http://example.com/\"quoted\""} 1`)
+	})
+}
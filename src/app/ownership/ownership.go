@@ -0,0 +1,139 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package ownership marks which instance manages a DNS record, using a TXT record
+// next to it, so that two misconfigured instances won't fight over the same record.
+package ownership
+
+import (
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"google.golang.org/api/dns/v1"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Prefix is prepended to the managed record's name to get the ownership record's name
+	Prefix   = "_gcp-dynamic-dns."
+	heritage = "heritage=gcp-dynamic-dns"
+	ttl      = 300
+	// wildcard replaces the "*" label, because it's allowed only as the leftmost label
+	wildcard = "_wildcard."
+)
+
+var validOwnerID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func ValidateOwnerID(owner string) error {
+	if !validOwnerID.MatchString(owner) {
+		return fmt.Errorf("invalid owner ID %q; it may contain only letters, digits, dots, dashes and underscores", owner)
+	}
+	return nil
+}
+
+func RecordName(name string) string {
+	if rest, found := strings.CutPrefix(name, "*."); found {
+		name = wildcard + rest
+	}
+	return Prefix + name
+}
+
+// ownedName is the reverse of RecordName.
+func ownedName(recordName string) string {
+	name := strings.TrimPrefix(recordName, Prefix)
+	if rest, found := strings.CutPrefix(name, wildcard); found {
+		name = "*." + rest
+	}
+	return name
+}
+
+// Value returns the TXT record value which marks the owner.
+func Value(owner string) string {
+	return fmt.Sprintf("\"%v,owner=%v\"", heritage, owner)
+}
+
+// ParseOwner returns the owner from the TXT record values, or "" if they don't mark an owner.
+func ParseOwner(rrdatas []string) string {
+	for _, rrdata := range rrdatas {
+		fields := strings.Split(strings.Trim(rrdata, "\""), ",")
+		if fields[0] != heritage {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if owner, found := strings.CutPrefix(field, "owner="); found {
+				return owner
+			}
+		}
+	}
+	return ""
+}
+
+type Registry struct {
+	Owner string
+	// records are the ownership TXT records, by the zone and name of the record they own,
+	// because with split-horizon DNS the same name is in many zones
+	records map[string]*gcloud.DnsRecord
+}
+
+// NewRegistry finds the ownership records from among all the DNS records.
+func NewRegistry(owner string, records gcloud.DnsRecords) *Registry {
+	registry := &Registry{Owner: owner, records: make(map[string]*gcloud.DnsRecord)}
+	for _, record := range records {
+		if record.Type == "TXT" && strings.HasPrefix(record.Name, Prefix) {
+			registry.records[key(record.ZoneKey(), ownedName(record.Name))] = record
+		}
+	}
+	return registry
+}
+
+func key(zoneKey string, name string) string {
+	return zoneKey + " " + name
+}
+
+// OwnerOf returns the owner of the record, or "" if it's not owned.
+func (this *Registry) OwnerOf(record *gcloud.DnsRecord) string {
+	marker, ok := this.records[key(record.ZoneKey(), record.Name)]
+	if !ok {
+		return ""
+	}
+	return ParseOwner(marker.Rrdatas)
+}
+
+// Check fails if the record is owned by another instance.
+func (this *Registry) Check(record *gcloud.DnsRecord) error {
+	owner := this.OwnerOf(record)
+	if owner != "" && owner != this.Owner {
+		return fmt.Errorf("%v is owned by %v, not %v; run the takeover command to take it over", record.Name, owner, this.Owner)
+	}
+	return nil
+}
+
+// Claimed tells whether the record is owned by this instance.
+func (this *Registry) Claimed(record *gcloud.DnsRecord) bool {
+	return this.OwnerOf(record) == this.Owner
+}
+
+// Claim returns the change which marks an unowned record as owned by this instance.
+// It only creates the ownership record, so that it will fail if another instance claimed it first.
+func (this *Registry) Claim(record *gcloud.DnsRecord) *dns.Change {
+	return &dns.Change{Additions: []*dns.ResourceRecordSet{this.ownershipRecord(record.Name)}}
+}
+
+// Takeover returns the change which marks the record as owned by this instance, replacing the previous owner.
+func (this *Registry) Takeover(record *gcloud.DnsRecord) *dns.Change {
+	change := this.Claim(record)
+	if existing, ok := this.records[key(record.ZoneKey(), record.Name)]; ok {
+		change.Deletions = []*dns.ResourceRecordSet{existing.ResourceRecordSet}
+	}
+	return change
+}
+
+func (this *Registry) ownershipRecord(name string) *dns.ResourceRecordSet {
+	return &dns.ResourceRecordSet{
+		Name:    RecordName(name),
+		Type:    "TXT",
+		Ttl:     ttl,
+		Rrdatas: []string{Value(this.Owner)},
+	}
+}
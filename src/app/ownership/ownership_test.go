@@ -0,0 +1,98 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package ownership
+
+import (
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"testing"
+)
+
+func TestOwnership(t *testing.T) {
+	Convey("OwnershipSpec", t, OwnershipSpec)
+}
+
+func OwnershipSpec() {
+	mine := &gcloud.DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "mine.example.com.", Type: "A", Rrdatas: []string{"1.1.1.1"}}}
+	theirs := &gcloud.DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "theirs.example.com.", Type: "A", Rrdatas: []string{"2.2.2.2"}}}
+	free := &gcloud.DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "free.example.com.", Type: "A", Rrdatas: []string{"3.3.3.3"}}}
+	theirsTxt := &gcloud.DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{
+		Name: "_gcp-dynamic-dns.theirs.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"heritage=gcp-dynamic-dns,owner=office"`}}}
+	records := gcloud.DnsRecords{
+		mine,
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{
+			Name: "_gcp-dynamic-dns.mine.example.com.", Type: "TXT", Rrdatas: []string{`"heritage=gcp-dynamic-dns,owner=home"`}}},
+		theirs,
+		theirsTxt,
+		free,
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{
+			Name: "free.example.com.", Type: "TXT", Rrdatas: []string{`"v=spf1 -all"`}}},
+	}
+	registry := NewRegistry("home", records)
+
+	Convey("knows the owners of records", func() {
+		So(registry.OwnerOf(mine), ShouldEqual, "home")
+		So(registry.OwnerOf(theirs), ShouldEqual, "office")
+		So(registry.OwnerOf(free), ShouldEqual, "")
+		So(registry.Claimed(mine), ShouldBeTrue)
+		So(registry.Claimed(free), ShouldBeFalse)
+	})
+
+	Convey("refuses records owned by another instance", func() {
+		So(registry.Check(mine), ShouldBeNil)
+		So(registry.Check(free), ShouldBeNil)
+		So(registry.Check(theirs), ShouldBeError,
+			"theirs.example.com. is owned by office, not home; run the takeover command to take it over")
+	})
+
+	Convey("claiming creates the ownership record", func() {
+		change := registry.Claim(free)
+
+		So(change.Deletions, ShouldBeEmpty)
+		So(change.Additions, ShouldResemble, []*dns.ResourceRecordSet{
+			{Name: "_gcp-dynamic-dns.free.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"heritage=gcp-dynamic-dns,owner=home"`}},
+		})
+	})
+
+	Convey("taking over replaces the ownership record", func() {
+		change := registry.Takeover(theirs)
+
+		So(change.Deletions, ShouldResemble, []*dns.ResourceRecordSet{theirsTxt.ResourceRecordSet})
+		So(change.Additions, ShouldResemble, []*dns.ResourceRecordSet{
+			{Name: "_gcp-dynamic-dns.theirs.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"heritage=gcp-dynamic-dns,owner=home"`}},
+		})
+	})
+
+	Convey("wildcard records are owned using a name which has no wildcard label", func() {
+		wildcard := &gcloud.DnsRecord{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "*.home.example.com.", Type: "A"}}
+
+		change := registry.Claim(wildcard)
+
+		So(change.Additions[0].Name, ShouldEqual, "_gcp-dynamic-dns._wildcard.home.example.com.")
+		registry := NewRegistry("home", gcloud.DnsRecords{{ManagedZone: "zone1", ResourceRecordSet: change.Additions[0]}})
+		So(registry.OwnerOf(wildcard), ShouldEqual, "home")
+	})
+
+	Convey("the same name in another zone is owned separately, e.g. with split-horizon DNS", func() {
+		private := &gcloud.DnsRecord{ManagedZone: "zone2", ResourceRecordSet: &dns.ResourceRecordSet{Name: "theirs.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}}}
+
+		So(registry.OwnerOf(private), ShouldEqual, "")
+		So(registry.Claimed(private), ShouldBeFalse)
+		So(registry.Check(private), ShouldBeNil)
+		So(registry.Takeover(private).Deletions, ShouldBeEmpty)
+	})
+
+	Convey("other TXT values are not ownership", func() {
+		So(ParseOwner([]string{`"v=spf1 -all"`, `"heritage=gcp-dynamic-dns,owner=x"`}), ShouldEqual, "x")
+		So(ParseOwner([]string{`"heritage=external-dns,owner=x"`}), ShouldEqual, "")
+	})
+
+	Convey("owner IDs are restricted, so that they can't break the TXT value", func() {
+		So(ValidateOwnerID("site-1.example_2"), ShouldBeNil)
+		So(ValidateOwnerID(`a,owner="b"`), ShouldNotBeNil)
+		So(ValidateOwnerID(""), ShouldNotBeNil)
+	})
+}
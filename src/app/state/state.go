@@ -0,0 +1,76 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package state persists what the updater has seen and done between restarts.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type State struct {
+	// Detections is the recent history of detected IP addresses, oldest first
+	Detections []Detection `json:"detections"`
+	// Changes is when the DNS records were updated, oldest first
+	Changes []time.Time `json:"changes"`
+	// Alerted is when the rate limit alert was last fired
+	Alerted time.Time `json:"alerted"`
+	// Heartbeat is when the heartbeat records were last written
+	Heartbeat time.Time `json:"heartbeat"`
+	// Published are the values which this instance last wrote to each DNS record, by record name
+	Published map[string][]string `json:"published,omitempty"`
+}
+
+type Detection struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+}
+
+// Load reads the state from the file. A missing file or an empty path gives an empty state.
+func Load(path string) (*State, error) {
+	st := &State{}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Save writes the state to the file atomically. An empty path does nothing.
+func (st *State) Save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
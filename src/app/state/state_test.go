@@ -0,0 +1,61 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package state
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	Convey("StateSpec", t, StateSpec)
+}
+
+func StateSpec() {
+	dir, err := os.MkdirTemp("", "state-test")
+	So(err, ShouldBeNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	Convey("missing file gives an empty state", func() {
+		st, err := Load(path)
+
+		So(err, ShouldBeNil)
+		So(st, ShouldResemble, &State{})
+	})
+
+	Convey("empty path gives an empty state and is not saved", func() {
+		st, err := Load("")
+		So(err, ShouldBeNil)
+
+		So(st.Save(""), ShouldBeNil)
+	})
+
+	Convey("saved state can be loaded", func() {
+		t := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+		st := &State{
+			Detections: []Detection{{Time: t, IP: "1.1.1.1"}},
+			Changes:    []time.Time{t},
+			Published:  map[string][]string{"example.com.": {"1.1.1.1"}},
+		}
+
+		So(st.Save(path), ShouldBeNil)
+		loaded, err := Load(path)
+
+		So(err, ShouldBeNil)
+		So(loaded, ShouldResemble, st)
+	})
+
+	Convey("error: corrupted file", func() {
+		So(os.WriteFile(path, []byte("{"), 0600), ShouldBeNil)
+
+		_, err := Load(path)
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// QueryA asks the name server directly (without recursion) for the A records of the name.
+// The name server may be a host name or an IP address, optionally with a port.
+// It waits for the response until the context is done.
+func QueryA(ctx context.Context, nameServer string, name string) ([]string, error) {
+	address := nameServer
+	if _, _, err := net.SplitHostPort(nameServer); err != nil {
+		address = net.JoinHostPort(strings.TrimSuffix(nameServer, "."), "53")
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeWhenDone(ctx, conn)()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if response.ID != id {
+		return nil, errors.New("response ID did not match the query")
+	}
+	if response.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("response code %v", response.RCode)
+	}
+	results := []string{}
+	for _, answer := range response.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			results = append(results, net.IP(a.A[:]).String())
+		}
+	}
+	return results, nil
+}
+
+// closeWhenDone interrupts the reads of the connection when the context is cancelled.
+func closeWhenDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextErr tells that the context was done, instead of the error of the interrupted read.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package status
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	Convey("QueryASpec", t, QueryASpec)
+}
+
+// fakeNameServer answers A queries for example.com. and refuses everything else
+func fakeNameServer() (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			question := query.Questions[0]
+			if question.Name.String() == "example.com." {
+				for _, ip := range [][4]byte{{1, 1, 1, 1}, {2, 2, 2, 2}} {
+					response.Answers = append(response.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+						Body:   &dnsmessage.AResource{A: ip},
+					})
+				}
+			} else {
+				response.RCode = dnsmessage.RCodeRefused
+			}
+			packet, _ := response.Pack()
+			_, _ = conn.WriteTo(packet, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { _ = conn.Close() }
+}
+
+func QueryASpec() {
+	nameServer, stop := fakeNameServer()
+	defer stop()
+
+	Convey("returns the A records", func() {
+		ips, err := QueryA(context.Background(), nameServer, "example.com.")
+
+		So(err, ShouldBeNil)
+		So(ips, ShouldResemble, []string{"1.1.1.1", "2.2.2.2"})
+	})
+
+	Convey("error: the name server refuses", func() {
+		_, err := QueryA(context.Background(), nameServer, "example.org.")
+
+		So(err, ShouldBeError, "response code RCodeRefused")
+	})
+
+	Convey("error: gives up when the context is done", func() {
+		silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer silent.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+
+		_, err = QueryA(ctx, silent.LocalAddr().String(), "example.com.")
+
+		So(err, ShouldEqual, context.DeadlineExceeded)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+	})
+
+	Convey("error: gives up when the context is cancelled", func() {
+		silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer silent.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		_, err = QueryA(ctx, silent.LocalAddr().String(), "example.com.")
+
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
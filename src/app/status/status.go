@@ -0,0 +1,177 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package status compares the current IP address with what the DNS records
+// contain and what the authoritative name servers are serving.
+package status
+
+import (
+	"context"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// LookupFunc returns the A record values which the name server serves for the name.
+type LookupFunc func(ctx context.Context, nameServer string, name string) ([]string, error)
+
+type Served struct {
+	NameServer string
+	Rrdatas    []string
+	Err        error
+}
+
+type RecordStatus struct {
+	Name        string
+	ManagedZone string
+	Ttl         int64
+	Rrdatas     []string
+	Served      []Served
+}
+
+type Report struct {
+	CurrentIP string
+	// Expected are the values of each record, when they are something else than just the CurrentIP
+	Expected map[string][]string
+	Records  []RecordStatus
+}
+
+func Check(ctx context.Context, currentIP string, records gcloud.DnsRecords, nameServers map[string][]string, lookup LookupFunc) *Report {
+	report := &Report{CurrentIP: currentIP}
+	for _, record := range records {
+		status := RecordStatus{
+			Name:        record.Key(),
+			ManagedZone: record.ManagedZone,
+			Ttl:         record.Ttl,
+			Rrdatas:     record.Values(),
+		}
+		if record.Item != "" {
+			// which item the name servers serve depends on the routing policy, so they can't be compared
+			report.Records = append(report.Records, status)
+			continue
+		}
+		for _, nameServer := range nameServers[record.ZoneKey()] {
+			rrdatas, err := lookup(ctx, nameServer, record.Name)
+			status.Served = append(status.Served, Served{NameServer: nameServer, Rrdatas: rrdatas, Err: err})
+		}
+		report.Records = append(report.Records, status)
+	}
+	return report
+}
+
+// RecordMatches tells whether the Cloud DNS record contains exactly the expected IPs.
+func (this *RecordStatus) RecordMatches(expected ...string) bool {
+	return reflect.DeepEqual(sorted(this.Rrdatas), sorted(expected))
+}
+
+// ServedMatches tells whether all authoritative name servers serve exactly the expected IPs.
+func (this *RecordStatus) ServedMatches(expected ...string) bool {
+	for _, served := range this.Served {
+		if served.Err != nil || !reflect.DeepEqual(sorted(served.Rrdatas), sorted(expected)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Report) expected(name string) []string {
+	if values, ok := this.Expected[name]; ok {
+		return values
+	}
+	return []string{this.CurrentIP}
+}
+
+func (this *Report) InSync() bool {
+	for _, record := range this.Records {
+		expected := this.expected(record.Name)
+		if !record.RecordMatches(expected...) || !record.ServedMatches(expected...) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Report) Print(out io.Writer) {
+	fmt.Fprintf(out, "Current IP: %v\n\n", this.CurrentIP)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tZONE\tTTL\tRRDATAS\tMATCH\tAUTHORITATIVE")
+	for _, record := range this.Records {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			record.Name,
+			record.ManagedZone,
+			record.Ttl,
+			strings.Join(record.Rrdatas, " "),
+			yesNo(record.RecordMatches(this.expected(record.Name)...)),
+			formatServed(record.Served))
+	}
+	_ = w.Flush()
+	if this.InSync() {
+		fmt.Fprintln(out, "\nAll DNS records are in sync")
+	} else {
+		fmt.Fprintln(out, "\nSome DNS records are out of sync")
+	}
+}
+
+func formatServed(served []Served) string {
+	var results []string
+	for _, s := range served {
+		if s.Err != nil {
+			results = append(results, fmt.Sprintf("%v=error(%v)", s.NameServer, s.Err))
+		} else {
+			results = append(results, fmt.Sprintf("%v=%v", s.NameServer, strings.Join(s.Rrdatas, ",")))
+		}
+	}
+	return strings.Join(results, " ")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "NO"
+}
+
+func sorted(values []string) []string {
+	results := append([]string{}, values...)
+	sort.Strings(results)
+	return results
+}
+
+// PrintHistory prints the recent detected IP addresses, grouping consecutive identical detections.
+func PrintHistory(out io.Writer, st *state.State, maxChangesPerHour int, now time.Time) {
+	fmt.Fprintln(out, "Detection history:")
+	if len(st.Detections) == 0 {
+		fmt.Fprintln(out, "  (none)")
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i := 0; i < len(st.Detections); {
+		first := st.Detections[i]
+		last := first
+		count := 0
+		for ; i < len(st.Detections) && st.Detections[i].IP == first.IP; i++ {
+			last = st.Detections[i]
+			count++
+		}
+		fmt.Fprintf(w, "  %v\t%v - %v\t(%d times)\n", first.IP, first.Time.Format(time.RFC3339), last.Time.Format(time.RFC3339), count)
+	}
+	_ = w.Flush()
+
+	changes := 0
+	for _, t := range st.Changes {
+		if now.Sub(t) < time.Hour {
+			changes++
+		}
+	}
+	if maxChangesPerHour > 0 {
+		fmt.Fprintf(out, "DNS changes during the past hour: %d (limit %d)\n", changes, maxChangesPerHour)
+	} else {
+		fmt.Fprintf(out, "DNS changes during the past hour: %d\n", changes)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package status
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	Convey("StatusSpec", t, StatusSpec)
+	Convey("HistorySpec", t, HistorySpec)
+}
+
+func StatusSpec() {
+	records := gcloud.DnsRecords{
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Type: "A", Ttl: 300, Rrdatas: []string{"1.1.1.1"}}},
+		{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.zone1.com.", Type: "A", Ttl: 60, Rrdatas: []string{"2.2.2.2"}}},
+	}
+	nameServers := map[string][]string{
+		"zone1": {"ns1.example.", "ns2.example."},
+	}
+	served := map[string]map[string][]string{
+		"ns1.example.": {"zone1.com.": {"1.1.1.1"}, "www.zone1.com.": {"2.2.2.2"}},
+		"ns2.example.": {"zone1.com.": {"1.1.1.1"}, "www.zone1.com.": {"1.1.1.1"}},
+	}
+	lookup := func(ctx context.Context, nameServer string, name string) ([]string, error) {
+		if nameServer == "broken.example." {
+			return nil, errors.New("timeout")
+		}
+		return served[nameServer][name], nil
+	}
+
+	Convey("all in sync", func() {
+		report := Check(context.Background(), "1.1.1.1", records[:1], nameServers, lookup)
+
+		So(report.InSync(), ShouldBeTrue)
+		So(report.Records[0].Served, ShouldResemble, []Served{
+			{NameServer: "ns1.example.", Rrdatas: []string{"1.1.1.1"}},
+			{NameServer: "ns2.example.", Rrdatas: []string{"1.1.1.1"}},
+		})
+	})
+
+	Convey("out of sync: the record has a different IP", func() {
+		report := Check(context.Background(), "1.1.1.1", records, nameServers, lookup)
+
+		So(report.InSync(), ShouldBeFalse)
+		So(report.Records[1].RecordMatches("1.1.1.1"), ShouldBeFalse)
+	})
+
+	Convey("out of sync: the name servers have not yet been updated", func() {
+		records := gcloud.DnsRecords{
+			{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "www.zone1.com.", Type: "A", Ttl: 60, Rrdatas: []string{"1.1.1.1"}}},
+		}
+		report := Check(context.Background(), "1.1.1.1", records, nameServers, lookup)
+
+		So(report.InSync(), ShouldBeFalse)
+		So(report.Records[0].RecordMatches("1.1.1.1"), ShouldBeTrue)
+		So(report.Records[0].ServedMatches("1.1.1.1"), ShouldBeFalse)
+	})
+
+	Convey("out of sync: a name server could not be queried", func() {
+		report := Check(context.Background(), "1.1.1.1", records[:1], map[string][]string{"zone1": {"broken.example."}}, lookup)
+
+		So(report.InSync(), ShouldBeFalse)
+	})
+
+	Convey("records may be expected to have multiple values, in any order", func() {
+		records := gcloud.DnsRecords{
+			{ManagedZone: "zone1", ResourceRecordSet: &dns.ResourceRecordSet{Name: "zone1.com.", Type: "A", Ttl: 300, Rrdatas: []string{"2.2.2.2", "1.1.1.1"}}},
+		}
+		multiLookup := func(ctx context.Context, nameServer string, name string) ([]string, error) {
+			return []string{"1.1.1.1", "2.2.2.2"}, nil
+		}
+		report := Check(context.Background(), "isp-a=1.1.1.1 isp-b=2.2.2.2", records, nameServers, multiLookup)
+		report.Expected = map[string][]string{"zone1.com.": {"1.1.1.1", "2.2.2.2"}}
+
+		So(report.InSync(), ShouldBeTrue)
+
+		report.Expected = map[string][]string{"zone1.com.": {"1.1.1.1"}}
+		So(report.InSync(), ShouldBeFalse)
+	})
+
+	Convey("prints a table", func() {
+		report := Check(context.Background(), "1.1.1.1", records, map[string][]string{"zone1": {"ns1.example.", "broken.example."}}, lookup)
+		var out bytes.Buffer
+
+		report.Print(&out)
+
+		So(out.String(), ShouldEqual, ""+
+			"Current IP: 1.1.1.1\n"+
+			"\n"+
+			"NAME            ZONE   TTL  RRDATAS  MATCH  AUTHORITATIVE\n"+
+			"zone1.com.      zone1  300  1.1.1.1  yes    ns1.example.=1.1.1.1 broken.example.=error(timeout)\n"+
+			"www.zone1.com.  zone1  60   2.2.2.2  NO     ns1.example.=2.2.2.2 broken.example.=error(timeout)\n"+
+			"\n"+
+			"Some DNS records are out of sync\n")
+	})
+}
+
+func HistorySpec() {
+	t0 := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time {
+		return t0.Add(time.Duration(n) * time.Minute)
+	}
+	var out bytes.Buffer
+
+	Convey("groups consecutive detections of the same IP", func() {
+		st := &state.State{
+			Detections: []state.Detection{
+				{Time: minute(0), IP: "1.1.1.1"},
+				{Time: minute(1), IP: "1.1.1.1"},
+				{Time: minute(2), IP: "2.2.2.2"},
+				{Time: minute(3), IP: "1.1.1.1"},
+			},
+			Changes: []time.Time{minute(-70), minute(0), minute(3)},
+		}
+
+		PrintHistory(&out, st, 4, minute(5))
+
+		So(out.String(), ShouldEqual, ""+
+			"Detection history:\n"+
+			"  1.1.1.1  2023-01-01T12:00:00Z - 2023-01-01T12:01:00Z  (2 times)\n"+
+			"  2.2.2.2  2023-01-01T12:02:00Z - 2023-01-01T12:02:00Z  (1 times)\n"+
+			"  1.1.1.1  2023-01-01T12:03:00Z - 2023-01-01T12:03:00Z  (1 times)\n"+
+			"DNS changes during the past hour: 2 (limit 4)\n")
+	})
+
+	Convey("empty history", func() {
+		PrintHistory(&out, &state.State{}, 0, minute(0))
+
+		So(out.String(), ShouldEqual, ""+
+			"Detection history:\n"+
+			"  (none)\n"+
+			"DNS changes during the past hour: 0\n")
+	})
+}
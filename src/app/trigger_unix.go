@@ -0,0 +1,15 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// triggerSignals make the IP be checked right away
+var triggerSignals = []os.Signal{syscall.SIGUSR1}
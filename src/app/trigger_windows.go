@@ -0,0 +1,12 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+//go:build windows
+
+package main
+
+import "os"
+
+// triggerSignals is empty, because Windows has no SIGUSR1; use the admin server's /sync endpoint instead
+var triggerSignals []os.Signal
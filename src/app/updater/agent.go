@@ -0,0 +1,105 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/hub"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"log"
+	"time"
+)
+
+// Reporter is where the agent reports the IP, e.g. a hub.Client.
+type Reporter interface {
+	Report(ctx context.Context, ip string) (*hub.ReportResponse, error)
+}
+
+type AgentOptions struct {
+	// Hub receives the reports
+	Hub Reporter
+	// Chain detects the IP, e.g. from NewChain
+	Chain *ip.Chain
+	// ReportInterval is how often the IP is reported even if it hasn't changed, so that the hub
+	// corrects the DNS records if they were changed by someone else. Defaults to one hour.
+	ReportInterval time.Duration
+	// ShutdownTimeout is how long the report in progress may still run after the context of Run is done
+	ShutdownTimeout time.Duration
+	// SyncNow makes Run check the IP right away, instead of waiting for the next poll.
+	SyncNow <-chan struct{}
+}
+
+// Agent reports the IP to a hub, which updates the DNS records, so that the agent
+// doesn't need the Cloud DNS credentials. It's what the agent command runs.
+type Agent struct {
+	hub             Reporter
+	chain           *ip.Chain
+	reportInterval  time.Duration
+	shutdownTimeout time.Duration
+	syncNow         <-chan struct{}
+	reportedIP      string
+	reported        time.Time
+}
+
+func NewAgent(options AgentOptions) (*Agent, error) {
+	if options.Hub == nil {
+		return nil, errors.New("the hub is missing")
+	}
+	if options.Chain == nil {
+		return nil, errors.New("the IP sources are missing")
+	}
+	reportInterval := options.ReportInterval
+	if reportInterval <= 0 {
+		reportInterval = time.Hour
+	}
+	return &Agent{
+		hub:             options.Hub,
+		chain:           options.Chain,
+		reportInterval:  reportInterval,
+		shutdownTimeout: options.ShutdownTimeout,
+		syncNow:         options.SyncNow,
+	}, nil
+}
+
+// Run checks the IP and reports it to the hub, until ctx is done. The report in progress
+// then has SHUTDOWN_TIMEOUT to finish, after which it's cancelled. Failing to detect
+// or report the IP is only logged. If the report was cancelled, the error is context.Canceled.
+func (this *Agent) Run(ctx context.Context) error {
+	work, cancel := workContext(ctx, this.shutdownTimeout)
+	defer cancel()
+	for {
+		if err := this.RunOnce(work); err != nil {
+			if Cancelled(work) != nil {
+				return work.Err()
+			}
+			log.Println("WARN:", err)
+		}
+		if !sleep(ctx, PollDelay(this.chain.NextPoll()), this.syncNow, this.chain.PollNow) {
+			return nil
+		}
+	}
+}
+
+// RunOnce checks the IP and reports it to the hub if it has changed since the last report,
+// or if the last report was more than ReportInterval ago.
+func (this *Agent) RunOnce(ctx context.Context) error {
+	currentIP, _, err := this.chain.Detect(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read the current IP: %w", err)
+	}
+	if currentIP == this.reportedIP && time.Since(this.reported) < this.reportInterval {
+		return nil
+	}
+	response, err := this.hub.Report(ctx, currentIP)
+	if err != nil {
+		return fmt.Errorf("failed to report the current IP to the hub: %w", err)
+	}
+	log.Printf("Reported IP %v to the hub; updated DNS records %v\n", response.IP, response.Updated)
+	this.reportedIP = currentIP
+	this.reported = time.Now()
+	return nil
+}
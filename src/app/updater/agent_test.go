@@ -0,0 +1,99 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"errors"
+	"github.com/luontola/gcp-dynamic-dns/src/app/hub"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestAgent(t *testing.T) {
+	Convey("AgentSpec", t, AgentSpec)
+}
+
+type fakeHub struct {
+	reports []string
+	err     error
+}
+
+func (this *fakeHub) Report(ctx context.Context, ip string) (*hub.ReportResponse, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	this.reports = append(this.reports, ip)
+	return &hub.ReportResponse{Agent: "home", IP: ip, Updated: []string{}}, nil
+}
+
+func AgentSpec() {
+	ctx := context.Background()
+	currentIP := "93.184.216.1"
+	var detectErr error
+	chain := ip.NewChain(&ip.Source{Name: "fake", Detector: ip.DetectorFunc(func(ctx context.Context) (string, error) {
+		return currentIP, detectErr
+	})})
+	fake := &fakeHub{}
+	agent, err := NewAgent(AgentOptions{Hub: fake, Chain: chain})
+	So(err, ShouldBeNil)
+
+	Convey("reports the current IP to the hub", func() {
+		So(agent.RunOnce(ctx), ShouldBeNil)
+
+		So(fake.reports, ShouldResemble, []string{"93.184.216.1"})
+
+		Convey("and reports it again when it changes", func() {
+			So(agent.RunOnce(ctx), ShouldBeNil)
+			So(fake.reports, ShouldHaveLength, 1)
+
+			currentIP = "93.184.216.2"
+			So(agent.RunOnce(ctx), ShouldBeNil)
+			So(fake.reports, ShouldResemble, []string{"93.184.216.1", "93.184.216.2"})
+		})
+
+		Convey("and reports it again after the report interval, even if it didn't change", func() {
+			agent.reported = time.Now().Add(-2 * time.Hour)
+
+			So(agent.RunOnce(ctx), ShouldBeNil)
+
+			So(fake.reports, ShouldResemble, []string{"93.184.216.1", "93.184.216.1"})
+		})
+	})
+
+	Convey("a failed report is retried on the next run", func() {
+		fake.err = errors.New("boom")
+		So(agent.RunOnce(ctx), ShouldBeError, "failed to report the current IP to the hub: boom")
+
+		fake.err = nil
+		So(agent.RunOnce(ctx), ShouldBeNil)
+
+		So(fake.reports, ShouldResemble, []string{"93.184.216.1"})
+	})
+
+	Convey("error: failed to detect the IP", func() {
+		detectErr = errors.New("boom")
+
+		So(agent.RunOnce(ctx), ShouldBeError, "failed to read the current IP: boom")
+
+		So(fake.reports, ShouldBeEmpty)
+	})
+
+	Convey("Run reports until the context is done", func() {
+		running, stop := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() {
+			done <- agent.Run(running)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		stop()
+
+		So(<-done, ShouldBeNil)
+		So(fake.reports, ShouldResemble, []string{"93.184.216.1"})
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+)
+
+// GroupUpdater updates DNS records for the dyndns and hub servers. Each name is searched
+// from the zones of its record group, so that e.g. split-horizon names are found.
+type GroupUpdater struct {
+	conf     *config.Config
+	provider Provider
+}
+
+func NewGroupUpdater(conf *config.Config, provider Provider) *GroupUpdater {
+	return &GroupUpdater{conf: conf, provider: provider}
+}
+
+func (this *GroupUpdater) DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error) {
+	var records gcloud.DnsRecords
+	for _, group := range this.groupNames(names) {
+		found, err := this.providerOf(group.group).DnsRecordsByNameAndType(ctx, group.names, recordType)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+// UpdateDnsRecords fails if another instance owns some of the records. The records which
+// are not yet owned are claimed in the same change which updates them.
+func (this *GroupUpdater) UpdateDnsRecords(ctx context.Context, records gcloud.DnsRecords, newValues []string) (gcloud.DnsRecords, error) {
+	changes := gcloud.ChangeSet{}
+	changes.Update(records, newValues)
+	registry, err := ReadOwnership(ctx, this.provider, this.conf)
+	if err != nil {
+		return nil, err
+	}
+	if registry != nil {
+		var unclaimed gcloud.DnsRecords
+		for _, record := range records {
+			if err := registry.Check(record); err != nil {
+				return nil, err
+			}
+			if !registry.Claimed(record) {
+				unclaimed = append(unclaimed, record)
+			}
+		}
+		claims, _ := splitClaims(unclaimed, records)
+		for _, record := range claims {
+			changes.Add(record.ZoneKey(), registry.Claim(record))
+		}
+	}
+	updated, err := this.provider.ApplyChanges(ctx, changes)
+	if err != nil {
+		return nil, err
+	}
+	return updated.OfType("A"), nil
+}
+
+type groupNames struct {
+	group *config.RecordGroup
+	names []string
+}
+
+// groupNames splits the names by the first record group which lists them, keeping their order within the group.
+// Names which no group lists are searched from all zones.
+func (this *GroupUpdater) groupNames(names []string) []*groupNames {
+	var results []*groupNames
+	byGroup := make(map[*config.RecordGroup]*groupNames)
+	for _, name := range names {
+		group := this.groupOf(name)
+		found, ok := byGroup[group]
+		if !ok {
+			found = &groupNames{group: group}
+			byGroup[group] = found
+			results = append(results, found)
+		}
+		found.names = append(found.names, name)
+	}
+	return results
+}
+
+func (this *GroupUpdater) groupOf(name string) *config.RecordGroup {
+	for i := range this.conf.RecordGroups {
+		group := &this.conf.RecordGroups[i]
+		if contains(group.DnsNames, name) {
+			return group
+		}
+	}
+	return nil
+}
+
+func (this *GroupUpdater) providerOf(group *config.RecordGroup) Provider {
+	if group == nil {
+		return this.provider
+	}
+	return ForGroup(this.provider, *group)
+}
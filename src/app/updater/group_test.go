@@ -0,0 +1,85 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/fakedns"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestGroupUpdater(t *testing.T) {
+	Convey("GroupUpdaterSpec", t, GroupUpdaterSpec)
+}
+
+func GroupUpdaterSpec() {
+	ctx := context.Background()
+	os.Setenv("GOOGLE_PROJECT", "project1")
+	defer os.Unsetenv("GOOGLE_PROJECT")
+	os.Setenv("DNS_NAMES", "foo.example.com.")
+	defer os.Unsetenv("DNS_NAMES")
+	os.Setenv("ZONE_VISIBILITY", "public")
+	defer os.Unsetenv("ZONE_VISIBILITY")
+	conf := config.FromEnv()
+
+	server := fakedns.New()
+	server.AddZone("project1", &dns.ManagedZone{Name: "example", DnsName: "example.com."})
+	server.AddZone("project1", &dns.ManagedZone{Name: "internal", DnsName: "example.com.", Visibility: "private"})
+	server.AddRecordSets("project1", "example",
+		&dns.ResourceRecordSet{Name: "foo.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"93.184.216.1"}})
+	server.AddRecordSets("project1", "internal",
+		&dns.ResourceRecordSet{Name: "foo.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.0.0.1"}})
+	httpServer := httptest.NewServer(server)
+	Reset(httpServer.Close)
+	client, err := gcloud.New(gcloud.Auth{Endpoint: httpServer.URL + "/"}, "project1")
+	So(err, ShouldBeNil)
+	updater := NewGroupUpdater(conf, CloudDns(client))
+
+	Convey("searches the names from the zones of their record group", func() {
+		records, err := updater.DnsRecordsByNameAndType(ctx, []string{"foo.example.com."}, "A")
+
+		So(err, ShouldBeNil)
+		So(records, ShouldHaveLength, 1)
+		So(records[0].ManagedZone, ShouldEqual, "example")
+
+		updated, err := updater.UpdateDnsRecords(ctx, records, []string{"93.184.216.2"})
+
+		So(err, ShouldBeNil)
+		So(updated.Names(), ShouldResemble, []string{"foo.example.com."})
+		So(server.RecordSets("project1", "example")[0].Rrdatas, ShouldResemble, []string{"93.184.216.2"})
+		So(server.RecordSets("project1", "internal")[0].Rrdatas, ShouldResemble, []string{"10.0.0.1"})
+	})
+
+	Convey("with OWNER_ID", func() {
+		conf.OwnerID = "home"
+		records, err := updater.DnsRecordsByNameAndType(ctx, []string{"foo.example.com."}, "A")
+		So(err, ShouldBeNil)
+
+		Convey("claims the records which are not owned, in the same change which updates them", func() {
+			updated, err := updater.UpdateDnsRecords(ctx, records, []string{"93.184.216.2"})
+
+			So(err, ShouldBeNil)
+			So(updated.Names(), ShouldResemble, []string{"foo.example.com."})
+			So(server.Changes(), ShouldEqual, 1)
+			So(server.RecordSets("project1", "example")[1].Name, ShouldEqual, "_gcp-dynamic-dns.foo.example.com.")
+		})
+
+		Convey("refuses to update records owned by another instance", func() {
+			server.AddRecordSets("project1", "example", &dns.ResourceRecordSet{Name: "_gcp-dynamic-dns.foo.example.com.", Type: "TXT", Ttl: 300,
+				Rrdatas: []string{`"heritage=gcp-dynamic-dns,owner=office"`}})
+
+			_, err := updater.UpdateDnsRecords(ctx, records, []string{"93.184.216.2"})
+
+			So(err, ShouldBeError, "foo.example.com. is owned by office, not home; run the takeover command to take it over")
+			So(server.Changes(), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,236 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"log"
+	"strings"
+	"time"
+)
+
+// LinkIP is the current address of a WAN link, and the IP source which detected it.
+type LinkIP struct {
+	IP     string
+	Source string
+}
+
+// Detection is the current addresses of the WAN links which are up.
+type Detection struct {
+	// Links are the names of all the WAN links, in the order they were detected
+	Links []string
+	// IPs are the addresses of the links which are up, by link name
+	IPs map[string]LinkIP
+}
+
+// String returns the current IP, or with multiple WAN links, the IP of each link,
+// e.g. "isp-a=203.0.113.1 isp-b=down". A change in it means that the DNS records may need updating.
+func (detection *Detection) String() string {
+	if len(detection.Links) == 1 {
+		return detection.IPs[detection.Links[0]].IP
+	}
+	var ips []string
+	for _, name := range detection.Links {
+		address := "down"
+		if detected, ok := detection.IPs[name]; ok {
+			address = detected.IP
+		}
+		ips = append(ips, name+"="+address)
+	}
+	return strings.Join(ips, " ")
+}
+
+// Values returns the addresses of the group's WAN links which are up, and
+// the IP sources which detected them. Addresses which the group may not publish
+// are left out, and the reasons are returned as refusals.
+func (detection *Detection) Values(group config.RecordGroup) ([]string, []string, []error) {
+	policy, err := ip.NewPolicy(group.AllowCidrs, group.DenyCidrs)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	var values, sources []string
+	var refusals []error
+	for _, name := range group.LinkNames() {
+		detected, ok := detection.IPs[name]
+		if !ok {
+			continue
+		}
+		if err := policy.Check(detected.IP); err != nil {
+			refusals = append(refusals, err)
+			continue
+		}
+		values = appendMissing(values, detected.IP)
+		sources = append(sources, detected.Source)
+	}
+	return values, sources, refusals
+}
+
+// Links detects the current addresses of the WAN links.
+type Links struct {
+	detectors []*detector
+}
+
+type detector struct {
+	link  *config.Link
+	chain *ip.Chain
+}
+
+// NewLinks creates the IP sources of the WAN links which the record groups use. By default, the sources
+// are chosen by each link's MODE, but sources may be given by link name to replace them.
+func NewLinks(conf *config.Config, sources map[string][]*ip.Source) (*Links, error) {
+	links := &Links{}
+	for _, link := range conf.UsedLinks() {
+		chain, err := NewChain(conf, link, sources[link.Name])
+		if err != nil {
+			return nil, err
+		}
+		links.detectors = append(links.detectors, &detector{link: link, chain: chain})
+	}
+	return links, nil
+}
+
+// NewChain creates the chain of IP sources of a WAN link. Without sources, they are chosen by the link's MODE.
+func NewChain(conf *config.Config, link *config.Link, sources []*ip.Source) (*ip.Chain, error) {
+	validate, err := publishable(conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		sources, err = modeSources(link)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("invalid MODE: %q", link.Mode)
+	}
+	chain := ip.NewChain(sources...)
+	chain.FailureThreshold = conf.SourceFailures
+	chain.Cooldown = conf.SourceCooldown
+	chain.Jitter = conf.PollJitter
+	chain.Validate = validate
+	return chain, nil
+}
+
+func modeSources(link *config.Link) ([]*ip.Source, error) {
+	network := &ip.Network{
+		LocalAddress: link.BindAddress,
+		Interface:    link.BindInterface,
+		Proxy:        link.ProxyUrl,
+		Resolver:     link.DnsResolver,
+	}
+	if err := network.Validate(); err != nil {
+		return nil, err
+	}
+	settings := ip.Settings{
+		Network:       network,
+		ServiceUrl:    link.NextServiceUrl,
+		InterfaceName: link.InterfaceName,
+		StunServers:   link.StunServers,
+	}
+	var sources []*ip.Source
+	for _, mode := range link.Modes {
+		name := mode
+		if link.Name != config.DefaultLink {
+			name = link.Name + "/" + mode
+		}
+		detector, err := ip.NewDetector(mode, settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MODE: %w", err)
+		}
+		sources = append(sources, &ip.Source{Name: name, Timeout: link.SourceTimeouts[mode], Interval: link.PollIntervals[mode], Detector: detector})
+	}
+	return sources, nil
+}
+
+// publishable accepts the addresses which at least one of the record groups accepts.
+func publishable(conf *config.Config) (func(string) error, error) {
+	policy, err := ip.NewPolicy(conf.AllowCidrs, conf.DenyCidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALLOW_CIDRS or DENY_CIDRS: %w", err)
+	}
+	policies := []*ip.Policy{policy}
+	for _, group := range conf.RecordGroups {
+		policy, err := ip.NewPolicy(group.AllowCidrs, group.DenyCidrs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ALLOW_CIDRS or DENY_CIDRS of record group %v: %w", group.Name, err)
+		}
+		policies = append(policies, policy)
+	}
+	return func(address string) error {
+		var err error
+		for _, policy := range policies {
+			if err = policy.Check(address); err == nil {
+				return nil
+			}
+		}
+		return err
+	}, nil
+}
+
+// Detect returns the addresses of the WAN links which are up. It fails only if all of them are down.
+func (this *Links) Detect(ctx context.Context) (*Detection, error) {
+	detection := &Detection{IPs: make(map[string]LinkIP)}
+	var errs []string
+	for _, detector := range this.detectors {
+		detection.Links = append(detection.Links, detector.link.Name)
+	}
+	for _, detector := range this.detectors {
+		address, source, err := detector.chain.Detect(ctx)
+		if err != nil {
+			if len(this.detectors) == 1 || ctx.Err() != nil {
+				return nil, err
+			}
+			log.Printf("WARN: Failed to read the current IP of WAN link %v: %v\n", detector.link.Name, err)
+			errs = append(errs, fmt.Sprintf("%v: %v", detector.link.Name, err))
+			continue
+		}
+		detection.IPs[detector.link.Name] = LinkIP{IP: address, Source: source}
+	}
+	if len(detection.IPs) == 0 {
+		return nil, fmt.Errorf("all WAN links are down: %v", strings.Join(errs, "; "))
+	}
+	return detection, nil
+}
+
+// NextPoll returns when Detect will poll some IP source, instead of reusing their previous results.
+func (this *Links) NextPoll() time.Time {
+	var next time.Time
+	for _, detector := range this.detectors {
+		if due := detector.chain.NextPoll(); next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// PollNow makes the next Detect poll all IP sources, even if they were polled less than their interval ago.
+func (this *Links) PollNow() {
+	for _, detector := range this.detectors {
+		detector.chain.PollNow()
+	}
+}
+
+// appendMissing appends the values which the slice doesn't yet contain.
+func appendMissing(slice []string, values ...string) []string {
+	for _, value := range values {
+		if !contains(slice, value) {
+			slice = append(slice, value)
+		}
+	}
+	return slice
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	"time"
+)
+
+// Options has the settings of the updater. They correspond to the environment variables of the
+// sync command, but a zero value has the variable's default only where noted; otherwise it turns
+// the feature or its limit off. FromConfig returns the options which the sync command uses.
+type Options struct {
+	// RecordGroups are the DNS records to update, and the rules for updating them
+	RecordGroups []config.RecordGroup
+	// Links are the WAN links whose addresses the record groups publish. Their unset settings
+	// get the defaults of config.Link.WithDefaults. Defaults to one link named config.DefaultLink.
+	Links []*config.Link
+	// AllowCidrs and DenyCidrs limit which addresses the IP sources may detect,
+	// in addition to the addresses which some record group may publish
+	AllowCidrs []string
+	DenyCidrs  []string
+	// SourceFailures is how many consecutive failures put an IP source into cool-down for
+	// SourceCooldown. Zero means that failing IP sources are never skipped.
+	SourceFailures int
+	SourceCooldown time.Duration
+	// PollJitter is the most that an IP source may be polled earlier or later than its interval
+	PollJitter time.Duration
+
+	// Provider is where the DNS records are published. Defaults to Cloud DNS, authenticated
+	// using GoogleAuth and searching the GoogleProjects and the projects of the record groups.
+	Provider       Provider
+	GoogleAuth     gcloud.Auth
+	GoogleProjects []string
+	// Sources replace the IP sources of the WAN links, by link name. The links
+	// which are not listed use the sources chosen by their MODE.
+	Sources map[string][]*ip.Source
+
+	// StateFile is where the detection history and the published values are saved,
+	// or "" to keep them only in memory
+	StateFile         string
+	OwnerID           string
+	StableDetections  int
+	StableDuration    time.Duration
+	MaxChangesPerHour int
+	// PreHook, PostHook and AlertHook are the commands which are run around the updates,
+	// each limited by its timeout
+	PreHook          []string
+	PreHookTimeout   time.Duration
+	PostHook         []string
+	PostHookTimeout  time.Duration
+	AlertHook        []string
+	AlertHookTimeout time.Duration
+	// HeartbeatInterval is how often the heartbeat records are written. Defaults to one hour.
+	HeartbeatInterval time.Duration
+	// ShutdownTimeout is how long the check in progress may still run after the context of Run is done.
+	// Zero means that it's cancelled right away.
+	ShutdownTimeout time.Duration
+	// DnsApiTimeout limits each round of reading or changing DNS records. Defaults to one minute.
+	DnsApiTimeout time.Duration
+
+	// Events receives what the updater does, if not nil. The updater waits for each
+	// event to be received, so the channel should be buffered or read continuously.
+	Events chan<- Event
+	// SyncNow makes Run check the IP right away, instead of waiting for the next poll.
+	SyncNow <-chan struct{}
+}
+
+// FromConfig returns the options of the sync command, e.g. from config.FromEnv.
+func FromConfig(conf *config.Config) Options {
+	return Options{
+		RecordGroups:      conf.RecordGroups,
+		Links:             conf.Links,
+		AllowCidrs:        conf.AllowCidrs,
+		DenyCidrs:         conf.DenyCidrs,
+		SourceFailures:    conf.SourceFailures,
+		SourceCooldown:    conf.SourceCooldown,
+		PollJitter:        conf.PollJitter,
+		GoogleAuth:        GoogleAuth(conf),
+		GoogleProjects:    conf.GoogleProjects,
+		StateFile:         conf.StateFile,
+		OwnerID:           conf.OwnerID,
+		StableDetections:  conf.StableDetections,
+		StableDuration:    conf.StableDuration,
+		MaxChangesPerHour: conf.MaxChangesPerHour,
+		PreHook:           conf.PreHook,
+		PreHookTimeout:    conf.PreHookTimeout,
+		PostHook:          conf.PostHook,
+		PostHookTimeout:   conf.PostHookTimeout,
+		AlertHook:         conf.AlertHook,
+		AlertHookTimeout:  conf.AlertHookTimeout,
+		HeartbeatInterval: conf.HeartbeatInterval,
+		ShutdownTimeout:   conf.ShutdownTimeout,
+		DnsApiTimeout:     conf.DnsApiTimeout,
+	}
+}
+
+// config returns the options as the config which the rest of the updater uses.
+func (options *Options) config() (*config.Config, error) {
+	conf := &config.Config{
+		RecordGroups:      options.RecordGroups,
+		AllowCidrs:        options.AllowCidrs,
+		DenyCidrs:         options.DenyCidrs,
+		SourceFailures:    options.SourceFailures,
+		SourceCooldown:    options.SourceCooldown,
+		PollJitter:        options.PollJitter,
+		GoogleProjects:    options.GoogleProjects,
+		StateFile:         options.StateFile,
+		OwnerID:           options.OwnerID,
+		StableDetections:  options.StableDetections,
+		StableDuration:    options.StableDuration,
+		MaxChangesPerHour: options.MaxChangesPerHour,
+		PreHook:           options.PreHook,
+		PreHookTimeout:    options.PreHookTimeout,
+		PostHook:          options.PostHook,
+		PostHookTimeout:   options.PostHookTimeout,
+		AlertHook:         options.AlertHook,
+		AlertHookTimeout:  options.AlertHookTimeout,
+		HeartbeatInterval: options.HeartbeatInterval,
+		ShutdownTimeout:   options.ShutdownTimeout,
+		DnsApiTimeout:     options.DnsApiTimeout,
+	}
+	if conf.HeartbeatInterval <= 0 {
+		conf.HeartbeatInterval = time.Hour
+	}
+	if conf.DnsApiTimeout <= 0 {
+		conf.DnsApiTimeout = time.Minute
+	}
+	links := options.Links
+	if len(links) == 0 {
+		links = []*config.Link{{Name: config.DefaultLink}}
+	}
+	for _, link := range links {
+		conf.Links = append(conf.Links, link.WithDefaults())
+	}
+	for _, group := range conf.RecordGroups {
+		for _, name := range group.LinkNames() {
+			if conf.LinkByName(name) == nil {
+				return nil, fmt.Errorf("record group %v uses an unknown link %v", group.Name, name)
+			}
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,102 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ownership"
+)
+
+// Provider is where the DNS records are published.
+type Provider interface {
+	ManagedZones(ctx context.Context) ([]*gcloud.ManagedZone, error)
+	DnsRecords(ctx context.Context) (gcloud.DnsRecords, error)
+	DnsRecordsByNameAndType(ctx context.Context, names []string, recordType string) (gcloud.DnsRecords, error)
+	// ApplyChanges makes the changes, which are keyed by the ZoneKey of the records
+	ApplyChanges(ctx context.Context, changes gcloud.ChangeSet) (gcloud.DnsRecords, error)
+}
+
+// GroupScoped is implemented by providers which can limit the search to the zones of a record
+// group, i.e. its GOOGLE_PROJECT, ZONE_VISIBILITY and MANAGED_ZONES.
+type GroupScoped interface {
+	ForGroup(group config.RecordGroup) Provider
+}
+
+// CloudDns is the Google Cloud DNS provider.
+func CloudDns(client *gcloud.Client) Provider {
+	return cloudDns{client}
+}
+
+type cloudDns struct {
+	*gcloud.Client
+}
+
+func (provider cloudDns) ForGroup(group config.RecordGroup) Provider {
+	return cloudDns{GroupClient(provider.Client, group)}
+}
+
+// GroupClient returns a client which searches only the zones of the record group.
+func GroupClient(client *gcloud.Client, group config.RecordGroup) *gcloud.Client {
+	if group.GoogleProject != "" {
+		client = client.ForProject(group.GoogleProject)
+	}
+	return client.InZones(group.ZoneVisibility, group.ManagedZones)
+}
+
+// GoogleAuth returns the Google Cloud credentials settings.
+func GoogleAuth(conf *config.Config) gcloud.Auth {
+	return gcloud.Auth{
+		Endpoint:                  conf.DnsApiEndpoint,
+		CredentialsBase64:         conf.GoogleCredentialsBase64,
+		CredentialsFile:           conf.GoogleCredentialsFile,
+		ImpersonateServiceAccount: conf.ImpersonateServiceAccount,
+	}
+}
+
+// ForGroup returns a provider which searches only the zones of the record group, if the provider supports it.
+func ForGroup(provider Provider, group config.RecordGroup) Provider {
+	if scoped, ok := provider.(GroupScoped); ok {
+		return scoped.ForGroup(group)
+	}
+	return provider
+}
+
+// ReadRecords returns the A records of all record groups, each searched from the group's zones.
+func ReadRecords(ctx context.Context, provider Provider, conf *config.Config) (gcloud.DnsRecords, error) {
+	var records gcloud.DnsRecords
+	seen := make(map[string]bool)
+	for _, group := range conf.RecordGroups {
+		groupRecords, err := ForGroup(provider, group).DnsRecordsByNameAndType(ctx, group.DnsNames, "A")
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range groupRecords {
+			key := record.ZoneKey() + " " + record.Key()
+			if !seen[key] {
+				seen[key] = true
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+// ReadOwnership returns nil if ownership records are not used.
+func ReadOwnership(ctx context.Context, provider Provider, conf *config.Config) (*ownership.Registry, error) {
+	if conf.OwnerID == "" {
+		return nil, nil
+	}
+	if err := ownership.ValidateOwnerID(conf.OwnerID); err != nil {
+		return nil, fmt.Errorf("invalid OWNER_ID: %w", err)
+	}
+	records, err := provider.DnsRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ownership.NewRegistry(conf.OwnerID, records), nil
+}
@@ -0,0 +1,564 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+// Package updater keeps DNS records pointing to the current IP address. It's what the
+// sync command runs, and it may be embedded in other Go programs.
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/damping"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/heartbeat"
+	"github.com/luontola/gcp-dynamic-dns/src/app/hooks"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ownership"
+	"github.com/luontola/gcp-dynamic-dns/src/app/state"
+	"google.golang.org/api/googleapi"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrDeferred means that the DNS records were not updated, because the pre-hook vetoed
+// the update or the rate limit was reached. The update will be retried on the next run.
+var ErrDeferred = errors.New("the DNS update was deferred")
+
+type EventType string
+
+const (
+	// IPDetected has the current IP
+	IPDetected EventType = "ip-detected"
+	// DetectionFailed has the error of why no IP could be detected
+	DetectionFailed EventType = "detection-failed"
+	// IPUnstable has an IP which has not yet been detected for long enough to be published
+	IPUnstable EventType = "ip-unstable"
+	// RecordsUpToDate means that the DNS records already had the current IP
+	RecordsUpToDate EventType = "records-up-to-date"
+	// RecordsUpdated has the DNS records which were changed to the current IP
+	RecordsUpdated EventType = "records-updated"
+	// UpdateDeferred has the error of why the DNS records were not updated
+	UpdateDeferred EventType = "update-deferred"
+	// HeartbeatWritten has the heartbeat records which were written
+	HeartbeatWritten EventType = "heartbeat-written"
+)
+
+type Event struct {
+	Type EventType
+	Time time.Time
+	// IP is the current IP, or with multiple WAN links, the IP of each link, e.g. "isp-a=203.0.113.1 isp-b=down"
+	IP      string
+	Records gcloud.DnsRecords
+	Err     error
+}
+
+type Updater struct {
+	conf        *config.Config
+	provider    Provider
+	links       *Links
+	st          *state.State
+	damper      *damping.Damper
+	events      chan<- Event
+	syncNow     <-chan struct{}
+	publishedIP string
+}
+
+func New(options Options) (*Updater, error) {
+	conf, err := options.config()
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.RecordGroups) == 0 {
+		return nil, errors.New("there are no DNS names to update; set DNS_NAMES")
+	}
+	if conf.OwnerID != "" {
+		if err := ownership.ValidateOwnerID(conf.OwnerID); err != nil {
+			return nil, fmt.Errorf("invalid OWNER_ID: %w", err)
+		}
+	}
+	if conf.MergesValues() && conf.StateFile == "" {
+		return nil, errors.New("MERGE_VALUES requires STATE_FILE, to remember which values this instance has published")
+	}
+	provider := options.Provider
+	if provider == nil {
+		if len(conf.Projects()) == 0 {
+			return nil, errors.New("there are no Google Cloud projects to search; set GOOGLE_PROJECT")
+		}
+		client, err := gcloud.New(options.GoogleAuth, conf.Projects()...)
+		if err != nil {
+			return nil, err
+		}
+		provider = CloudDns(client)
+	}
+	links, err := NewLinks(conf, options.Sources)
+	if err != nil {
+		return nil, err
+	}
+	st, err := state.Load(conf.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read STATE_FILE: %w", err)
+	}
+	damper := damping.New(st)
+	damper.StableDetections = conf.StableDetections
+	damper.StableDuration = conf.StableDuration
+	damper.MaxChangesPerHour = conf.MaxChangesPerHour
+	return &Updater{
+		conf:     conf,
+		provider: provider,
+		links:    links,
+		st:       st,
+		damper:   damper,
+		events:   options.Events,
+		syncNow:  options.SyncNow,
+	}, nil
+}
+
+// Run checks the IP and updates the DNS records every POLL_INTERVAL, until ctx is done.
+// The check in progress then has SHUTDOWN_TIMEOUT to finish, after which it's cancelled,
+// unless it's already changing the DNS records. Failing to detect the IP is only logged,
+// but failing to read or change the DNS records stops the updater with an error.
+// If the check was cancelled, the error is context.Canceled.
+func (this *Updater) Run(ctx context.Context) error {
+	work, cancel := workContext(ctx, this.conf.ShutdownTimeout)
+	defer cancel()
+	for {
+		err := this.RunOnce(work)
+		if err != nil {
+			if Cancelled(work) != nil {
+				return work.Err()
+			}
+			var detectionErr *detectionError
+			if errors.As(err, &detectionErr) {
+				log.Println("WARN: Failed to read the current IP:", detectionErr.err)
+			} else if !errors.Is(err, ErrDeferred) {
+				return err
+			}
+		}
+		if !sleep(ctx, PollDelay(this.links.NextPoll()), this.syncNow, this.links.PollNow) {
+			return nil
+		}
+	}
+}
+
+// RunOnce checks the IP and updates the DNS records if it has changed since the last run.
+// It returns ErrDeferred if the update will be retried later, and context.Canceled if
+// ctx was cancelled before the DNS records were changed.
+func (this *Updater) RunOnce(ctx context.Context) error {
+	defer this.saveState()
+	current, err := this.links.Detect(ctx)
+	if err != nil {
+		this.emit(ctx, Event{Type: DetectionFailed, Err: err})
+		return &detectionError{err}
+	}
+	currentIP := current.String()
+	this.emit(ctx, Event{Type: IPDetected, IP: currentIP})
+
+	if !this.damper.Observe(time.Now(), currentIP) {
+		count, since := this.damper.Candidate()
+		log.Printf("IP %v has been detected %d times since %v; waiting for it to stabilize\n",
+			currentIP, count, since.Format(time.RFC3339))
+		this.emit(ctx, Event{Type: IPUnstable, IP: currentIP})
+	} else if currentIP != this.publishedIP {
+		err = this.handleChangedIP(ctx, current)
+		if err == nil {
+			this.publishedIP = currentIP
+		} else if !errors.Is(err, ErrDeferred) {
+			return err
+		}
+	}
+	if this.heartbeatDue(time.Now()) {
+		if err := this.sendHeartbeats(ctx, current); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+type detectionError struct {
+	err error
+}
+
+func (err *detectionError) Error() string {
+	return "failed to read the current IP: " + err.err.Error()
+}
+
+func (err *detectionError) Unwrap() error {
+	return err.err
+}
+
+// Links returns the WAN links whose IP is detected.
+func (this *Updater) Links() *Links {
+	return this.links
+}
+
+// Provider returns where the DNS records are published.
+func (this *Updater) Provider() Provider {
+	return this.provider
+}
+
+// PollDelay is how long to wait until the next poll of some IP source. Each source has
+// its own interval, which is randomized by up to POLL_JITTER, so that many instances
+// which were started at the same time won't all poll the external services at once.
+func PollDelay(nextPoll time.Time) time.Duration {
+	delay := time.Until(nextPoll)
+	if delay < time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// sleep returns false if ctx was done before the duration passed.
+// It returns early if an IP check is triggered, after calling pollNow.
+func sleep(ctx context.Context, duration time.Duration, syncNow <-chan struct{}, pollNow func()) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-syncNow:
+		pollNow()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// workContext is done timeout after ctx is done.
+func workContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-work.Done():
+		}
+	}()
+	return work, cancel
+}
+
+// Cancelled returns the error of ctx if it was cancelled. It's checked before
+// changing the DNS records, so that they are either changed fully or not at all.
+func Cancelled(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// WriteContext is for changing DNS records. Cancelling the work doesn't cancel it, so that
+// we always know whether the change was applied; only the DNS API timeout limits it.
+func WriteContext(dnsApiTimeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dnsApiTimeout)
+}
+
+func (this *Updater) writeContext() (context.Context, context.CancelFunc) {
+	return WriteContext(this.conf.DnsApiTimeout)
+}
+
+func (this *Updater) emit(ctx context.Context, event Event) {
+	if this.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case this.events <- event:
+	case <-ctx.Done():
+	}
+}
+
+func (this *Updater) saveState() {
+	if err := this.st.Save(this.conf.StateFile); err != nil {
+		log.Println("WARN: Failed to write STATE_FILE:", err)
+	}
+}
+
+// handleChangedIP returns ErrDeferred if the update was vetoed by the pre-hook
+// or the rate limit, so that it will be retried later.
+func (this *Updater) handleChangedIP(ctx context.Context, current *Detection) error {
+	conf := this.conf
+	readCtx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+	defer cancel()
+	type recordUpdate struct {
+		outdated  gcloud.DnsRecords
+		newValues []string
+		published []string
+	}
+	var updates []recordUpdate
+	var outdated gcloud.DnsRecords
+	var newIPs []string
+	registry, err := ReadOwnership(readCtx, this.provider, conf)
+	if err != nil {
+		return readFailure(ctx, err)
+	}
+	var unclaimed gcloud.DnsRecords
+	for _, group := range conf.RecordGroups {
+		newValues, sources, refusals := current.Values(group)
+		for _, err := range refusals {
+			log.Printf("WARN: Refusing to publish the IP to record group %v: %v\n", group.Name, err)
+		}
+		if len(newValues) == 0 {
+			if len(refusals) == 0 {
+				log.Printf("WARN: None of the WAN links of record group %v are up; leaving its DNS records unchanged\n", group.Name)
+			}
+			continue
+		}
+		log.Printf("Updating IP %v (detected using %v) to DNS records %v\n", strings.Join(newValues, " "), strings.Join(sources, ", "), group.DnsNames)
+		records, err := ForGroup(this.provider, group).DnsRecordsByNameAndType(readCtx, group.DnsNames, "A")
+		if err != nil {
+			return readFailure(ctx, err)
+		}
+		for _, record := range records {
+			if registry != nil {
+				if err := registry.Check(record); err != nil {
+					log.Println("WARN: Refusing to update a DNS record:", err)
+					continue
+				}
+				if !registry.Claimed(record) {
+					unclaimed = append(unclaimed, record)
+				}
+			}
+			values := newValues
+			if group.MergeValues {
+				values = gcloud.MergeValues(record.Values(), this.st.Published[record.Key()], newValues)
+			}
+			records := gcloud.DnsRecords{record}.Outdated(values)
+			if len(records) == 0 {
+				this.setPublished(record.Key(), newValues)
+				continue
+			}
+			updates = append(updates, recordUpdate{records, values, newValues})
+			outdated = append(outdated, records...)
+			newIPs = appendMissing(newIPs, newValues...)
+		}
+	}
+	// the records which are updated are claimed in the same change, so that a vetoed
+	// update doesn't claim them, and the update fails if another instance claimed them first
+	claimWithUpdate, claimNow := splitClaims(unclaimed, outdated)
+	this.claimOwnership(registry, claimNow)
+	if len(outdated) == 0 {
+		log.Println("Nothing to update")
+		this.emit(ctx, Event{Type: RecordsUpToDate, IP: current.String()})
+		return nil
+	}
+	event := hooks.Event{OldIP: oldIP(outdated), NewIP: strings.Join(newIPs, " "), DnsNames: outdated.Names()}
+
+	now := time.Now()
+	if !this.damper.AllowChange(now) {
+		err := fmt.Errorf("%w: the limit of %d changes per hour was reached", ErrDeferred, this.damper.MaxChangesPerHour)
+		log.Printf("WARN: DNS update was skipped, because the limit of %d changes per hour was reached\n", this.damper.MaxChangesPerHour)
+		if this.damper.ShouldAlert(now) {
+			log.Printf("ALERT: IP address is changing too often; the DNS records were updated %d times during the past hour\n",
+				this.damper.ChangesWithinHour(now))
+			alertHook := &hooks.Hook{Name: "alert-hook", Command: conf.AlertHook, Timeout: conf.AlertHookTimeout}
+			if err := alertHook.Run(ctx, event); err != nil {
+				log.Println("WARN:", err)
+			}
+		}
+		this.emit(ctx, Event{Type: UpdateDeferred, IP: current.String(), Records: outdated, Err: err})
+		return err
+	}
+
+	preHook := &hooks.Hook{Name: "pre-hook", Command: conf.PreHook, Timeout: conf.PreHookTimeout}
+	if err := preHook.Run(ctx, event); err != nil {
+		if err := Cancelled(ctx); err != nil {
+			return err
+		}
+		log.Println("WARN: DNS update was vetoed:", err)
+		err = fmt.Errorf("%w: %v", ErrDeferred, err)
+		this.emit(ctx, Event{Type: UpdateDeferred, IP: current.String(), Records: outdated, Err: err})
+		return err
+	}
+
+	changes := gcloud.ChangeSet{}
+	for _, update := range updates {
+		changes.Update(update.outdated, update.newValues)
+	}
+	for _, record := range claimWithUpdate {
+		changes.Add(record.ZoneKey(), registry.Claim(record))
+	}
+	if conf.HasHeartbeats() {
+		// the pre-hook may have used up the read timeout, so the heartbeats are read with a fresh one
+		heartbeatCtx, cancel := context.WithTimeout(ctx, conf.DnsApiTimeout)
+		defer cancel()
+		// the heartbeats are updated atomically with the IP, so that they never disagree
+		if err := this.addHeartbeats(heartbeatCtx, changes, current, now); err != nil {
+			return readFailure(ctx, err)
+		}
+	}
+	if err := Cancelled(ctx); err != nil {
+		return err
+	}
+	writeCtx, cancel := this.writeContext()
+	defer cancel()
+	written, err := this.provider.ApplyChanges(writeCtx, changes)
+	if err != nil && len(claimWithUpdate) > 0 && isConflict(err) {
+		// the records will be refused on the next run, if another instance owns them now
+		log.Println("WARN: Failed to claim the ownership of the DNS records; another instance may have claimed them first:", err)
+		err = fmt.Errorf("%w: %v", ErrDeferred, err)
+		this.emit(ctx, Event{Type: UpdateDeferred, IP: current.String(), Records: outdated, Err: err})
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update DNS records: %w", err)
+	}
+	updated := written.OfType("A")
+	for _, update := range updates {
+		for _, record := range update.outdated {
+			this.setPublished(record.Key(), update.published)
+		}
+	}
+	if conf.HasHeartbeats() {
+		this.st.Heartbeat = now
+	}
+	this.damper.RecordChange(now)
+	log.Printf("Updated %d DNS records:\n", len(updated))
+	for _, record := range updated {
+		log.Printf("    %v  %v -> %v\n", record.ItemName(), record.OldRrdatas, record.Values())
+	}
+	this.emit(ctx, Event{Type: RecordsUpdated, IP: current.String(), Records: updated})
+
+	postHook := &hooks.Hook{Name: "post-hook", Command: conf.PostHook, Timeout: conf.PostHookTimeout}
+	event.DnsNames = updated.Names()
+	if err := postHook.Run(ctx, event); err != nil {
+		log.Println("WARN:", err)
+	}
+	return nil
+}
+
+// readFailure returns the cancellation of ctx instead of the read error which it caused.
+func readFailure(ctx context.Context, err error) error {
+	if err := Cancelled(ctx); err != nil {
+		return err
+	}
+	return fmt.Errorf("failed to read DNS records: %w", err)
+}
+
+func (this *Updater) claimOwnership(registry *ownership.Registry, records gcloud.DnsRecords) {
+	ctx, cancel := this.writeContext()
+	defer cancel()
+	for _, record := range records {
+		// if another instance claimed the record at the same time, this fails and the record will be refused next time
+		if _, err := this.provider.ApplyChanges(ctx, gcloud.ChangeSet{record.ZoneKey(): registry.Claim(record)}); err != nil {
+			log.Printf("WARN: Failed to claim the ownership of %v: %v\n", record.Name, err)
+			continue
+		}
+		log.Printf("Claimed the ownership of %v as %v\n", record.Name, registry.Owner)
+	}
+}
+
+// splitClaims returns the unclaimed records which are also outdated, and those which are not,
+// each record set only once even if many items of its routing policy are updated.
+func splitClaims(unclaimed gcloud.DnsRecords, outdated gcloud.DnsRecords) (gcloud.DnsRecords, gcloud.DnsRecords) {
+	updating := make(map[string]bool)
+	for _, record := range outdated {
+		updating[record.ZoneKey()+" "+record.Name] = true
+	}
+	var withUpdate, now gcloud.DnsRecords
+	seen := make(map[string]bool)
+	for _, record := range unclaimed {
+		key := record.ZoneKey() + " " + record.Name
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if updating[key] {
+			withUpdate = append(withUpdate, record)
+		} else {
+			now = append(now, record)
+		}
+	}
+	return withUpdate, now
+}
+
+// isConflict tells whether the change failed because a record to be added already exists.
+func isConflict(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+func (this *Updater) heartbeatDue(now time.Time) bool {
+	return this.conf.HasHeartbeats() && now.Sub(this.st.Heartbeat) >= this.conf.HeartbeatInterval
+}
+
+// addHeartbeats adds to the changes the heartbeat records of all record groups. Each heartbeat
+// record goes to the most specific zone of its record group, e.g. with split-horizon DNS.
+func (this *Updater) addHeartbeats(ctx context.Context, changes gcloud.ChangeSet, current *Detection, now time.Time) error {
+	records, err := this.provider.DnsRecords(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*gcloud.DnsRecord)
+	for _, record := range records.OfType("TXT") {
+		existing[record.ZoneKey()+" "+record.Name] = record
+	}
+	for _, group := range this.conf.RecordGroups {
+		if group.HeartbeatName == "" {
+			continue
+		}
+		zones, err := ForGroup(this.provider, group).ManagedZones(ctx)
+		if err != nil {
+			return err
+		}
+		zone := gcloud.ZoneForName(zones, group.HeartbeatName)
+		if zone == nil {
+			log.Printf("WARN: No managed zone contains the heartbeat record %v of record group %v\n", group.HeartbeatName, group.Name)
+			continue
+		}
+		values, _, _ := current.Values(group)
+		changes.Set(zone.Key(), existing[zone.Key()+" "+group.HeartbeatName], heartbeat.New(now, values).RecordSet(group.HeartbeatName))
+	}
+	return nil
+}
+
+func (this *Updater) sendHeartbeats(ctx context.Context, current *Detection) error {
+	now := time.Now()
+	changes := gcloud.ChangeSet{}
+	readCtx, cancel := context.WithTimeout(ctx, this.conf.DnsApiTimeout)
+	defer cancel()
+	if err := this.addHeartbeats(readCtx, changes, current, now); err != nil {
+		return readFailure(ctx, err)
+	}
+	if err := Cancelled(ctx); err != nil {
+		return err
+	}
+	writeCtx, cancel := this.writeContext()
+	defer cancel()
+	written, err := this.provider.ApplyChanges(writeCtx, changes)
+	if err != nil {
+		log.Println("WARN: Failed to write the heartbeat records:", err)
+		return nil
+	}
+	this.st.Heartbeat = now
+	log.Printf("Wrote heartbeat records %v\n", written.Names())
+	this.emit(ctx, Event{Type: HeartbeatWritten, IP: current.String(), Records: written})
+	return nil
+}
+
+// setPublished remembers which values this instance wrote to the record,
+// so that they can be replaced later without touching the record's other values.
+func (this *Updater) setPublished(name string, values []string) {
+	if this.st.Published == nil {
+		this.st.Published = make(map[string][]string)
+	}
+	this.st.Published[name] = values
+}
+
+// oldIP returns the distinct values of the records, separated by space.
+func oldIP(records gcloud.DnsRecords) string {
+	var values []string
+	for _, record := range records {
+		values = appendMissing(values, record.Values()...)
+	}
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,272 @@
+// Copyright © 2023 Esko Luontola
+// This software is released under the Apache License 2.0.
+// The license text is at http://www.apache.org/licenses/LICENSE-2.0
+
+package updater
+
+import (
+	"context"
+	"errors"
+	"github.com/luontola/gcp-dynamic-dns/src/app/config"
+	"github.com/luontola/gcp-dynamic-dns/src/app/fakedns"
+	"github.com/luontola/gcp-dynamic-dns/src/app/gcloud"
+	"github.com/luontola/gcp-dynamic-dns/src/app/ip"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/api/dns/v1"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpdater(t *testing.T) {
+	Convey("UpdaterSpec", t, UpdaterSpec)
+}
+
+func UpdaterSpec() {
+	ctx := context.Background()
+
+	server := fakedns.New()
+	server.AddZone("project1", &dns.ManagedZone{Name: "example", DnsName: "example.com."})
+	server.AddRecordSets("project1", "example",
+		&dns.ResourceRecordSet{Name: "foo.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"93.184.216.1"}})
+	httpServer := httptest.NewServer(server)
+	Reset(httpServer.Close)
+	client, err := gcloud.New(gcloud.Auth{Endpoint: httpServer.URL + "/"}, "project1")
+	So(err, ShouldBeNil)
+
+	currentIP := "93.184.216.2"
+	var detectErr error
+	source := &ip.Source{Name: "fake", Timeout: time.Second, Detector: ip.DetectorFunc(func(ctx context.Context) (string, error) {
+		return currentIP, detectErr
+	})}
+	events := make(chan Event, 10)
+	syncNow := make(chan struct{}, 1)
+	options := Options{
+		RecordGroups: []config.RecordGroup{{Name: "default", DnsNames: []string{"foo.example.com."}}},
+		Provider:     CloudDns(client),
+		Sources:      map[string][]*ip.Source{config.DefaultLink: {source}},
+		Events:       events,
+		SyncNow:      syncNow,
+	}
+	receive := func() Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			return Event{Type: "timeout"}
+		}
+	}
+
+	Convey("updates the DNS records to the current IP", func() {
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		err = u.RunOnce(ctx)
+
+		So(err, ShouldBeNil)
+		So(server.RecordSets("project1", "example")[0].Rrdatas, ShouldResemble, []string{"93.184.216.2"})
+		So(receive().Type, ShouldEqual, IPDetected)
+		event := receive()
+		So(event.Type, ShouldEqual, RecordsUpdated)
+		So(event.IP, ShouldEqual, "93.184.216.2")
+		So(event.Records.Names(), ShouldResemble, []string{"foo.example.com."})
+
+		Convey("and doesn't read them again until the IP changes", func() {
+			So(u.RunOnce(ctx), ShouldBeNil)
+			So(receive().Type, ShouldEqual, IPDetected)
+			So(events, ShouldBeEmpty)
+
+			currentIP = "93.184.216.3"
+			So(u.RunOnce(ctx), ShouldBeNil)
+			So(server.Changes(), ShouldEqual, 2)
+		})
+	})
+
+	Convey("does nothing when the DNS records are up to date", func() {
+		currentIP = "93.184.216.1"
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(u.RunOnce(ctx), ShouldBeNil)
+
+		So(receive().Type, ShouldEqual, IPDetected)
+		So(receive().Type, ShouldEqual, RecordsUpToDate)
+		So(server.Changes(), ShouldEqual, 0)
+	})
+
+	Convey("reports failing to detect the IP", func() {
+		detectErr = errors.New("boom")
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		err = u.RunOnce(ctx)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "boom")
+		event := receive()
+		So(event.Type, ShouldEqual, DetectionFailed)
+		So(event.Err, ShouldNotBeNil)
+	})
+
+	Convey("the pre-hook may defer the update", func() {
+		options.PreHook = []string{"false"}
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		err = u.RunOnce(ctx)
+
+		So(errors.Is(err, ErrDeferred), ShouldBeTrue)
+		So(receive().Type, ShouldEqual, IPDetected)
+		So(receive().Type, ShouldEqual, UpdateDeferred)
+		So(server.Changes(), ShouldEqual, 0)
+	})
+
+	Convey("doesn't change the DNS records if the context was cancelled", func() {
+		u, err := New(options)
+		So(err, ShouldBeNil)
+		cancelled, cancel := context.WithCancel(ctx)
+		source.Detector = ip.DetectorFunc(func(ctx context.Context) (string, error) {
+			cancel()
+			return currentIP, nil
+		})
+
+		err = u.RunOnce(cancelled)
+
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		So(server.Changes(), ShouldEqual, 0)
+	})
+
+	Convey("Run checks the IP when triggered, until the context is done", func() {
+		source.Interval = time.Hour
+		u, err := New(options)
+		So(err, ShouldBeNil)
+		running, stop := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() {
+			done <- u.Run(running)
+		}()
+		So(receive().Type, ShouldEqual, IPDetected)
+		So(receive().Type, ShouldEqual, RecordsUpdated)
+
+		syncNow <- struct{}{}
+		So(receive().Type, ShouldEqual, IPDetected)
+
+		stop()
+		So(<-done, ShouldBeNil)
+	})
+
+	Convey("record groups may update different items of the same routing policy", func() {
+		options.RecordGroups = []config.RecordGroup{
+			{Name: "wrr1", DnsNames: []string{"w.example.com.@wrr=1"}},
+			{Name: "wrr2", DnsNames: []string{"w.example.com.@wrr=2"}},
+		}
+		server.AddRecordSets("project1", "example",
+			&dns.ResourceRecordSet{Name: "w.example.com.", Type: "A", Ttl: 300, RoutingPolicy: &dns.RRSetRoutingPolicy{
+				Wrr: &dns.RRSetRoutingPolicyWrrPolicy{Items: []*dns.RRSetRoutingPolicyWrrPolicyWrrPolicyItem{
+					{Weight: 1, Rrdatas: []string{"93.184.216.1"}},
+					{Weight: 2, Rrdatas: []string{"93.184.216.1"}},
+				}},
+			}})
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(u.RunOnce(ctx), ShouldBeNil)
+
+		items := server.RecordSets("project1", "example")[1].RoutingPolicy.Wrr.Items
+		So(items[0].Rrdatas, ShouldResemble, []string{"93.184.216.2"})
+		So(items[1].Rrdatas, ShouldResemble, []string{"93.184.216.2"})
+	})
+
+	Convey("heartbeats are written to the zones of the record group", func() {
+		options.RecordGroups[0].ZoneVisibility = "public"
+		options.RecordGroups[0].HeartbeatName = "hb.example.com."
+		server.AddZone("project1", &dns.ManagedZone{Name: "internal", DnsName: "example.com.", Visibility: "private"})
+		server.AddRecordSets("project1", "internal",
+			&dns.ResourceRecordSet{Name: "hb.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"private"`}})
+		server.AddRecordSets("project1", "example",
+			&dns.ResourceRecordSet{Name: "hb.example.com.", Type: "TXT", Ttl: 300, Rrdatas: []string{`"public"`}})
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(u.RunOnce(ctx), ShouldBeNil)
+
+		So(server.RecordSets("project1", "internal")[0].Rrdatas, ShouldResemble, []string{`"private"`})
+		public := server.RecordSets("project1", "example")
+		So(public, ShouldHaveLength, 2)
+		So(public[0].Rrdatas, ShouldResemble, []string{"93.184.216.2"})
+		So(public[1].Name, ShouldEqual, "hb.example.com.")
+		So(public[1].Rrdatas[0], ShouldContainSubstring, "93.184.216.2")
+	})
+
+	Convey("heartbeats are read after the pre-hook, even if it took longer than the DNS API timeout", func() {
+		options.RecordGroups[0].HeartbeatName = "hb.example.com."
+		options.DnsApiTimeout = 500 * time.Millisecond
+		options.PreHook = []string{"sleep", "1"}
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(u.RunOnce(ctx), ShouldBeNil)
+
+		records := server.RecordSets("project1", "example")
+		So(records, ShouldHaveLength, 2)
+		So(records[1].Name, ShouldEqual, "hb.example.com.")
+	})
+
+	Convey("claims the ownership of the records in the same change which updates them", func() {
+		options.OwnerID = "home"
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(u.RunOnce(ctx), ShouldBeNil)
+
+		So(server.Changes(), ShouldEqual, 1)
+		records := server.RecordSets("project1", "example")
+		So(records, ShouldHaveLength, 2)
+		So(records[1].Name, ShouldEqual, "_gcp-dynamic-dns.foo.example.com.")
+	})
+
+	Convey("doesn't claim the ownership of records whose update was vetoed", func() {
+		options.OwnerID = "home"
+		options.PreHook = []string{"false"}
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(errors.Is(u.RunOnce(ctx), ErrDeferred), ShouldBeTrue)
+
+		So(server.Changes(), ShouldEqual, 0)
+		So(server.RecordSets("project1", "example"), ShouldHaveLength, 1)
+	})
+
+	Convey("requires DNS names", func() {
+		options.RecordGroups = nil
+
+		_, err := New(options)
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("error: a record group uses an unknown WAN link", func() {
+		options.RecordGroups[0].Links = []string{"isp-b"}
+
+		_, err := New(options)
+
+		So(err, ShouldBeError, "record group default uses an unknown link isp-b")
+	})
+
+	Convey("the options which the sync command uses come from the config", func() {
+		os.Setenv("GOOGLE_PROJECT", "project1")
+		defer os.Unsetenv("GOOGLE_PROJECT")
+		os.Setenv("DNS_NAMES", "foo.example.com.")
+		defer os.Unsetenv("DNS_NAMES")
+		os.Setenv("PRE_HOOK", "false")
+		defer os.Unsetenv("PRE_HOOK")
+		options := FromConfig(config.FromEnv())
+		options.Provider = CloudDns(client)
+		options.Sources = map[string][]*ip.Source{config.DefaultLink: {source}}
+		u, err := New(options)
+		So(err, ShouldBeNil)
+
+		So(errors.Is(u.RunOnce(ctx), ErrDeferred), ShouldBeTrue)
+	})
+}
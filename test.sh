@@ -2,5 +2,5 @@
 set -eu
 cd src/app
 go test ./...
-#go test app/config app/gcloud
-#go test app/ip -o ip.test.tmp
+#go test ./config ./gcloud
+#go test ./ip -o ip.test.tmp